@@ -55,8 +55,17 @@ func listenIP(listen string) (string, error) {
 }
 
 func activate(c config.Config) error {
+	ip, err := activateIP(c)
+	if err != nil {
+		return err
+	}
+	return host.SetDNS(ip)
+}
+
+// activateIP returns the IP the system resolver is set to by activate.
+func activateIP(c config.Config) (string, error) {
 	if len(c.Listens) == 0 {
-		return errors.New("missing listen setting")
+		return "", errors.New("missing listen setting")
 	}
 	listen := c.Listens[0]
 	if c.SetupRouter {
@@ -66,11 +75,7 @@ func activate(c config.Config) error {
 		// from dnsmasq cache.
 		listen = "127.0.0.1:53"
 	}
-	listenIP, err := listenIP(listen)
-	if err != nil {
-		return err
-	}
-	return host.SetDNS(listenIP)
+	return listenIP(listen)
 }
 
 func deactivate() error {
@@ -0,0 +1,271 @@
+// Package captive detects captive portals by probing well-known connectivity
+// check URLs.
+package captive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	// StateUnknown is the state before the first check.
+	StateUnknown State = iota
+
+	// StateNone means probes succeeded, there is no captive portal.
+	StateNone
+
+	// StateDetected means at least one probe got intercepted.
+	StateDetected
+
+	// StateOffline means no probe could get a response.
+	StateOffline
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNone:
+		return "none"
+	case StateDetected:
+		return "detected"
+	case StateOffline:
+		return "offline"
+	default:
+		return "unknown"
+	}
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Probe is a connectivity check URL with the expected response.
+type Probe struct {
+	URL string
+
+	// Status is the expected HTTP status code.
+	Status int
+
+	// Body, if not empty, must be contained in the response body.
+	Body string
+}
+
+// DefaultProbes is the list of probes used when Detector.Probes is empty.
+var DefaultProbes = []Probe{
+	{URL: "http://captive.apple.com/hotspot-detect.html", Status: http.StatusOK, Body: "Success"},
+	{URL: "http://connectivitycheck.gstatic.com/generate_204", Status: http.StatusNoContent},
+	{URL: "http://detectportal.firefox.com/success.txt", Status: http.StatusOK, Body: "success"},
+}
+
+// DefaultInterval is the default value for Detector.Interval.
+const DefaultInterval = 30 * time.Second
+
+// Status describes the last detection result.
+type Status struct {
+	State     State     `json:"state"`
+	Since     time.Time `json:"since"`
+	LastCheck time.Time `json:"last_check"`
+	// URL is the probe that revealed the portal, if any.
+	URL string `json:"url,omitempty"`
+	// Location is the redirect target returned by the portal, if any.
+	Location string `json:"location,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Detector probes connectivity check URLs using the system DNS servers in
+// order to detect captive portals.
+type Detector struct {
+	// Probes is the list of connectivity checks to perform. If empty,
+	// DefaultProbes is used.
+	Probes []Probe
+
+	// Servers returns the DNS servers used to resolve probe hostnames. When
+	// nil or if no server is returned, the Go resolver is used.
+	Servers func() []string
+
+	// Interval defines how often a detected portal is checked again to
+	// detect when it is cleared. If zero, DefaultInterval is used.
+	Interval time.Duration
+
+	// Timeout defines the maximum duration of a probe. If zero, 5 seconds is
+	// used.
+	Timeout time.Duration
+
+	// OnChange is called each time the detected state changes.
+	OnChange func(s Status)
+
+	mu      sync.RWMutex
+	status  Status
+	trigger chan struct{}
+	once    sync.Once
+}
+
+// Status returns the last detection status.
+func (d *Detector) Status() Status {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.status
+}
+
+// Detected returns true if a captive portal is currently detected.
+func (d *Detector) Detected() bool {
+	return d.Status().State == StateDetected
+}
+
+// Trigger schedules a new check by Run as soon as possible. It is typically
+// called on network changes.
+func (d *Detector) Trigger() {
+	d.init()
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Detector) init() {
+	d.once.Do(func() {
+		d.trigger = make(chan struct{}, 1)
+	})
+}
+
+// Run performs a first check and then waits for Trigger to be called to check
+// again. While a portal is detected, checks are repeated every Interval. Run
+// returns when ctx is cancelled.
+func (d *Detector) Run(ctx context.Context) {
+	d.init()
+	d.Check(ctx)
+	for {
+		var recheck <-chan time.Time
+		if d.Detected() {
+			interval := d.Interval
+			if interval == 0 {
+				interval = DefaultInterval
+			}
+			recheck = time.After(interval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.trigger:
+		case <-recheck:
+		}
+		d.Check(ctx)
+	}
+}
+
+// Check runs all probes and updates the status.
+func (d *Detector) Check(ctx context.Context) Status {
+	probes := d.Probes
+	if len(probes) == 0 {
+		probes = DefaultProbes
+	}
+	c := d.client()
+	s := Status{State: StateOffline, LastCheck: time.Now()}
+	var errs []string
+	for _, p := range probes {
+		ok, location, err := d.probe(ctx, c, p)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if ok {
+			s.State = StateNone
+			break
+		}
+		s.State = StateDetected
+		s.URL = p.URL
+		s.Location = location
+		break
+	}
+	if s.State == StateOffline {
+		s.Error = strings.Join(errs, "; ")
+	}
+	d.mu.Lock()
+	prev := d.status
+	s.Since = prev.Since
+	changed := prev.State != s.State
+	if changed {
+		s.Since = s.LastCheck
+	}
+	d.status = s
+	d.mu.Unlock()
+	if changed && d.OnChange != nil {
+		d.OnChange(s)
+	}
+	return s
+}
+
+func (d *Detector) probe(ctx context.Context, c *http.Client, p Probe) (ok bool, location string, err error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", p.URL, nil)
+	if err != nil {
+		return false, "", err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return false, "", fmt.Errorf("%s: %v", p.URL, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != p.Status {
+		return false, res.Header.Get("Location"), nil
+	}
+	if p.Body != "" {
+		b, err := io.ReadAll(io.LimitReader(res.Body, 4096))
+		if err != nil {
+			return false, "", fmt.Errorf("%s: %v", p.URL, err)
+		}
+		if !strings.Contains(string(b), p.Body) {
+			return false, "", nil
+		}
+	}
+	return true, "", nil
+}
+
+func (d *Detector) client() *http.Client {
+	dialer := &net.Dialer{}
+	var servers []string
+	if d.Servers != nil {
+		servers = d.Servers()
+	}
+	if len(servers) > 0 {
+		// Resolve probe hostnames with the system DNS servers directly as the
+		// host resolver may point to us, and we might not be able to resolve
+		// anything while behind a portal.
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var err error
+				for _, server := range servers {
+					var c net.Conn
+					c, err = (&net.Dialer{}).DialContext(ctx, network, net.JoinHostPort(server, "53"))
+					if err == nil {
+						return c, nil
+					}
+				}
+				return nil, err
+			},
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		// Never follow redirects, a redirect is the sign of a portal.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
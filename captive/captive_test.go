@@ -0,0 +1,70 @@
+package captive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetector_Check(t *testing.T) {
+	portal := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if portal {
+			http.Redirect(w, r, "http://portal.example/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	var changes []State
+	d := &Detector{
+		Probes: []Probe{{URL: srv.URL + "/generate_204", Status: http.StatusNoContent}},
+		OnChange: func(s Status) {
+			changes = append(changes, s.State)
+		},
+	}
+
+	if s := d.Check(context.Background()); s.State != StateNone {
+		t.Errorf("Check() = %v, want %v", s.State, StateNone)
+	}
+	portal = true
+	s := d.Check(context.Background())
+	if s.State != StateDetected {
+		t.Errorf("Check() = %v, want %v", s.State, StateDetected)
+	}
+	if s.Location != "http://portal.example/login" {
+		t.Errorf("Check() location = %v, want portal login", s.Location)
+	}
+	if !d.Detected() {
+		t.Errorf("Detected() = false, want true")
+	}
+	// No change notification if state stays the same.
+	d.Check(context.Background())
+	portal = false
+	d.Check(context.Background())
+
+	want := []State{StateNone, StateDetected, StateNone}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("changes[%d] = %v, want %v", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestDetector_CheckOffline(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	d := &Detector{
+		Probes: []Probe{{URL: url, Status: http.StatusNoContent}},
+	}
+	if s := d.Check(context.Background()); s.State != StateOffline || s.Error == "" {
+		t.Errorf("Check() = %v (%s), want %v with error", s.State, s.Error, StateOffline)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/discovery"
+	"github.com/nextdns/nextdns/host"
+	"github.com/nextdns/nextdns/proxy"
+)
+
+// clientDiscovery manages the client discovery sources used to resolve local
+// names and report client info. The use-hosts, report-client-info,
+// discovery-dns and mdns settings can be changed while running with
+// Configure.
+type clientDiscovery struct {
+	log host.Logger
+
+	// local and lookup are the LocalResolver and DiscoveryResolver of the
+	// proxy.
+	local  *proxy.SwappableResolver
+	lookup *proxy.SwappableResolver
+
+	// report is true when client info is reported upstream.
+	report atomic.Bool
+	// names resolves client names, nil when discovery is disabled.
+	names atomic.Pointer[discovery.Resolver]
+
+	hosts     *discovery.Hosts
+	dhcp      *discovery.DHCP
+	merlin    *discovery.Merlin
+	ubios     *discovery.Ubios
+	firewalla *discovery.Firewalla
+
+	mu      sync.Mutex
+	conf    config.Config
+	enabled bool
+	dns     *discovery.DNS
+	mdns    discovery.Source
+	// mdnsStart starts mdns, nil if disabled.
+	mdnsStart func(ctx context.Context)
+	mdnsStop  context.CancelFunc
+	// ctx is the context of Run, nil while not running.
+	ctx context.Context
+}
+
+func newClientDiscovery(log host.Logger) *clientDiscovery {
+	return &clientDiscovery{
+		log:       log,
+		local:     &proxy.SwappableResolver{},
+		lookup:    &proxy.SwappableResolver{},
+		hosts:     &discovery.Hosts{OnError: func(err error) { log.Errorf("hosts: %v", err) }},
+		dhcp:      &discovery.DHCP{OnError: func(err error) { log.Errorf("dhcp: %v", err) }},
+		merlin:    &discovery.Merlin{},
+		ubios:     &discovery.Ubios{},
+		firewalla: &discovery.Firewalla{},
+		mdns:      discovery.Dummy{},
+	}
+}
+
+// Configure applies the discovery settings of c. Discovery is only enabled
+// with report-client-info when listening to requests outside the local host
+// or if setup router is on.
+func (d *clientDiscovery) Configure(c config.Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev, first := d.conf, d.dns == nil
+	d.conf = c
+
+	if c.UseHosts {
+		d.local.Store(discovery.Resolver{d.hosts})
+	} else {
+		d.local.Store(nil)
+	}
+	d.report.Store(c.ReportClientInfo)
+
+	enabled := c.ReportClientInfo && !isLocalhostMode(&c)
+	if first || c.DiscoveryDNS != prev.DiscoveryDNS {
+		d.dns = &discovery.DNS{Upstream: c.DiscoveryDNS}
+	}
+	if first || enabled != d.enabled || c.MDNS != prev.MDNS {
+		d.setMDNSLocked(enabled && c.MDNS != "disabled", c.MDNS)
+	}
+	d.enabled = enabled
+
+	if !enabled {
+		d.names.Store(nil)
+		if c.DiscoveryDNS != "" {
+			d.lookup.Store(d.dns)
+		} else {
+			d.lookup.Store(nil)
+		}
+		return
+	}
+	lookup := discovery.Resolver{d.mdns, d.dhcp}
+	if c.DiscoveryDNS != "" {
+		// Only include discovery DNS as discovery resolver if explicitly
+		// specified as auto-discovered DNS discovery can create loops.
+		lookup = append(discovery.Resolver{d.dns}, lookup...)
+	}
+	d.lookup.Store(lookup)
+	names := discovery.Resolver{
+		d.hosts,
+		d.merlin,
+		d.ubios,
+		d.firewalla,
+		d.mdns,
+		d.dhcp,
+		d.dns,
+	}
+	d.names.Store(&names)
+}
+
+// setMDNSLocked replaces the mDNS source, started with filter if enabled.
+func (d *clientDiscovery) setMDNSLocked(enabled bool, filter string) {
+	if d.mdnsStop != nil {
+		d.mdnsStop()
+		d.mdnsStop = nil
+	}
+	d.mdns = discovery.Dummy{}
+	d.mdnsStart = nil
+	if !enabled {
+		return
+	}
+	mdns := &discovery.MDNS{OnError: func(err error) { d.log.Errorf("mdns: %v", err) }}
+	d.mdns = mdns
+	d.mdnsStart = func(ctx context.Context) {
+		d.log.Info("Starting mDNS discovery")
+		if err := mdns.Start(ctx, filter); err != nil {
+			d.log.Errorf("Cannot start mDNS: %v", err)
+		}
+	}
+	if d.ctx != nil {
+		d.startMDNSLocked()
+	}
+}
+
+func (d *clientDiscovery) startMDNSLocked() {
+	if d.mdnsStart == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.mdnsStop = cancel
+	go d.mdnsStart(ctx)
+}
+
+// Run starts the discovery sources needing it until ctx is done. It is meant
+// to be called on each proxy start.
+func (d *clientDiscovery) Run(ctx context.Context) {
+	d.mu.Lock()
+	d.ctx = ctx
+	d.startMDNSLocked()
+	d.mu.Unlock()
+	<-ctx.Done()
+	d.mu.Lock()
+	if d.ctx == ctx {
+		d.ctx = nil
+		d.mdnsStop = nil
+	}
+	d.mu.Unlock()
+}
+
+// Enabled returns true if client discovery is enabled.
+func (d *clientDiscovery) Enabled() bool {
+	return d.names.Load() != nil
+}
+
+// ReportClientInfo returns true if client info is reported upstream.
+func (d *clientDiscovery) ReportClientInfo() bool {
+	return d.report.Load()
+}
+
+func (d *clientDiscovery) resolver() discovery.Resolver {
+	if r := d.names.Load(); r != nil {
+		return *r
+	}
+	return nil
+}
+
+func (d *clientDiscovery) LookupAddr(addr string) []string {
+	return d.resolver().LookupAddr(addr)
+}
+
+func (d *clientDiscovery) LookupHost(name string) []string {
+	return d.resolver().LookupHost(name)
+}
+
+func (d *clientDiscovery) LookupMAC(mac string) []string {
+	return d.resolver().LookupMAC(mac)
+}
+
+func (d *clientDiscovery) Visit(f func(source, name string, addrs []string)) {
+	d.resolver().Visit(f)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 
 	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/ctl"
 )
 
 func cfg(args []string) error {
@@ -22,10 +26,12 @@ func cfg(args []string) error {
 		c.Parse("nextdns config list", args, true)
 		return c.Write(os.Stdout)
 	case "set":
+		unsetConfigEnv()
 		var c config.Config
 		c.Parse("nextdns config set", args, true)
 		return c.Save()
 	case "edit":
+		unsetConfigEnv()
 		var c config.Config
 		c.Parse("nextdns config edit", nil, true)
 		tmp, err := os.CreateTemp("", "")
@@ -52,6 +58,72 @@ func cfg(args []string) error {
 		c.Parse("nextdns config edit", []string{"-config-file", tmp.Name()}, true)
 		c.File = ""
 		return c.Save()
+	case "migrate":
+		// Converts the legacy "name value" configuration to TOML.
+		to := ""
+		if len(args) >= 2 && (args[0] == "-to" || args[0] == "--to") {
+			to, args = args[1], args[2:]
+		}
+		var c config.Config
+		c.Parse("nextdns config migrate", args, true)
+		if to == "" {
+			return c.WriteTOML(os.Stdout)
+		}
+		if !strings.HasSuffix(to, ".toml") {
+			return fmt.Errorf("%s: must have a .toml extension", to)
+		}
+		if _, err := os.Stat(to); err == nil {
+			return fmt.Errorf("%s: already exists", to)
+		}
+		f, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		if err := c.WriteTOML(f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("Configuration written to %s, use it with -config-file %s.\n", to, to)
+		return nil
+	case "validate":
+		file := ""
+		if len(args) > 0 {
+			file = args[0]
+		}
+		errs := config.Validate(file)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%d error(s) found", len(errs))
+		}
+		fmt.Println("Configuration is valid.")
+		return nil
+	case "diff":
+		return cfgDiff(args)
+	case "export":
+		asJSON := false
+		for i := 0; i < len(args); i++ {
+			if args[i] == "-json" || args[i] == "--json" {
+				asJSON = true
+				args = append(args[:i:i], args[i+1:]...)
+				i--
+			}
+		}
+		var c config.Config
+		c.Parse("nextdns config export", args, true)
+		if !asJSON {
+			return c.Write(os.Stdout)
+		}
+		b, err := json.MarshalIndent(c.Export(), "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
 	case "wizard":
 		return installer("configure")
 	default:
@@ -60,6 +132,69 @@ func cfg(args []string) error {
 			"  config set [options]     set a configuration option\n" +
 			"                           (see config set -h for list of options)\n" +
 			"  config edit              edit configuration using default editor\n" +
+			"  config migrate [-to PATH] convert the configuration to TOML, written\n" +
+			"                           to PATH or stdout\n" +
+			"  config validate [file]   check a configuration file, or the stored one\n" +
+			"  config diff <file>       compare a configuration file with the running\n" +
+			"                           daemon configuration\n" +
+			"  config export [-json]    export the configuration, as JSON with -json\n" +
 			"  config wizard            run the configuration wizard")
 	}
 }
+
+// unsetConfigEnv removes the settings set in the environment so they are not
+// persisted with the configuration.
+func unsetConfigEnv() {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, config.EnvPrefix) {
+			k, _, _ := strings.Cut(kv, "=")
+			os.Unsetenv(k)
+		}
+	}
+}
+
+// cfgDiff prints the differences between the effective configuration of the
+// running daemon (-) and a configuration file (+).
+func cfgDiff(args []string) error {
+	fs := flag.NewFlagSet("config diff", flag.ExitOnError)
+	control := fs.String("control", config.DefaultControl, "Address to the control socket")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: config diff [-control ADDR] <file>")
+	}
+	var c config.Config
+	if err := c.Load("nextdns config diff", []string{"-config-file", fs.Arg(0)}, false); err != nil {
+		return err
+	}
+	// Encode to JSON like the daemon reply so values compare the same way.
+	b, err := json.Marshal(c.Export())
+	if err != nil {
+		return err
+	}
+	var file map[string]interface{}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return err
+	}
+
+	cl, err := ctl.Dial(*control)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	data, err := cl.Send(ctl.Event{Name: "config"})
+	if err != nil {
+		return err
+	}
+	running, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected reply: %v", data)
+	}
+	lines := config.DiffExport(running, file)
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+	if len(lines) == 0 {
+		fmt.Println("No difference.")
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// client describes the client of a query matched by a clientCondition.
+type client struct {
+	SourceIP, DestIP net.IP
+	MAC              net.HardwareAddr
+
+	// Listener is the proxy listen address the query was received on.
+	Listener string
+
+	// Names returns the discovered names of the client, nil if names are not
+	// resolved.
+	Names func() []string
+}
+
+func queryClient(q query.Query) client {
+	return client{SourceIP: q.PeerIP, DestIP: q.LocalIP, MAC: q.MAC, Listener: q.Listener}
+}
+
+// clientCondition matches the client of a query by source prefix or range,
+// MAC address or prefix, discovered name, the interface or the listener the
+// query was received on. The zero value matches all clients.
+type clientCondition struct {
+	Prefix  *net.IPNet
+	MAC     net.HardwareAddr
+	DestIPs []net.IP
+
+	// RangeFrom and RangeTo define an inclusive source IP range.
+	RangeFrom, RangeTo net.IP
+
+	// MACPrefix matches the first MACPrefixBits bits of the client MAC
+	// address, like the OUI of the manufacturer.
+	MACPrefix     net.HardwareAddr
+	MACPrefixBits int
+
+	// Name is a glob matched against the discovered names of the client.
+	Name string
+
+	// Listen matches the proxy listener the query was received on.
+	Listen *listenAddr
+
+	// raw is the condition as defined by the user.
+	raw string
+}
+
+// parseClientCondition parses a CIDR prefix, an IP range (IP-IP), a MAC
+// address, a MAC prefix (OUI or MAC/bits), a name glob (name:GLOB), a
+// listener address (listen=ADDR) or an interface name.
+func parseClientCondition(cond string) (clientCondition, error) {
+	c := clientCondition{raw: cond}
+	if strings.HasPrefix(cond, "listen=") {
+		l, err := parseListenAddr(strings.TrimPrefix(cond, "listen="))
+		if err != nil {
+			return clientCondition{}, err
+		}
+		c.Listen = l
+	} else if strings.HasPrefix(cond, "name:") {
+		c.Name = strings.ToLower(strings.TrimPrefix(cond, "name:"))
+		if _, err := path.Match(c.Name, ""); err != nil || c.Name == "" {
+			return clientCondition{}, fmt.Errorf("%s: invalid name pattern", cond)
+		}
+	} else if _, ipnet, err := net.ParseCIDR(cond); err == nil {
+		c.Prefix = ipnet
+	} else if from, to, ok := parseIPRange(cond); ok {
+		c.RangeFrom, c.RangeTo = from, to
+	} else if mac, err := net.ParseMAC(cond); err == nil {
+		c.MAC = mac
+	} else if iface, _ := net.InterfaceByName(cond); iface != nil {
+		// Interface names are tried before MAC prefixes as names like
+		// "ab-cd" are valid prefixes.
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				c.DestIPs = append(c.DestIPs, ipnet.IP)
+			}
+		}
+	} else if prefix, bits, ok := parseMACPrefix(cond); ok {
+		c.MACPrefix, c.MACPrefixBits = prefix, bits
+	} else {
+		return clientCondition{}, fmt.Errorf("%s: invalid condition format or non-existent interface name", cond)
+	}
+	return c, nil
+}
+
+// parseIPRange parses an inclusive range of IPs of the same family in the
+// form FROM-TO.
+func parseIPRange(s string) (from, to net.IP, ok bool) {
+	f, t, found := strings.Cut(s, "-")
+	if !found {
+		return nil, nil, false
+	}
+	from, to = net.ParseIP(f), net.ParseIP(t)
+	if from == nil || to == nil || (from.To4() == nil) != (to.To4() == nil) {
+		return nil, nil, false
+	}
+	if from.To4() != nil {
+		from, to = from.To4(), to.To4()
+	}
+	if bytes.Compare(from, to) > 0 {
+		return nil, nil, false
+	}
+	return from, to, true
+}
+
+// parseMACPrefix parses a partial MAC address of at least two octets like an
+// OUI (28:a0:2b), or a MAC address followed by a prefix length in bits
+// (28:a0:2b:50:00:00/28). A single octet is rejected so a hex-pair name like
+// "ab" is never taken for a prefix.
+func parseMACPrefix(s string) (prefix net.HardwareAddr, bits int, ok bool) {
+	addr, mask, hasMask := strings.Cut(s, "/")
+	octets := strings.Split(addr, ":")
+	if len(octets) == 1 {
+		octets = strings.Split(addr, "-")
+	}
+	if len(octets) < 2 || len(octets) > 6 {
+		return nil, 0, false
+	}
+	for _, o := range octets {
+		b, err := hex.DecodeString(o)
+		if err != nil || len(b) != 1 {
+			return nil, 0, false
+		}
+		prefix = append(prefix, b[0])
+	}
+	bits = len(prefix) * 8
+	if hasMask {
+		n, err := strconv.Atoi(mask)
+		if err != nil || n <= 0 || n > bits {
+			return nil, 0, false
+		}
+		bits = n
+	} else if len(prefix) == 6 {
+		// A full MAC address is not a prefix.
+		return nil, 0, false
+	}
+	return prefix, bits, true
+}
+
+// Match returns true if the condition matches cl. Name conditions never match
+// if cl.Names is nil.
+func (c clientCondition) Match(cl client) bool {
+	sourceIP, destIP, mac := cl.SourceIP, cl.DestIP, cl.MAC
+	if c.Prefix != nil {
+		if sourceIP == nil {
+			return false
+		}
+		if !c.Prefix.Contains(sourceIP) {
+			return false
+		}
+	}
+	if c.RangeFrom != nil && !ipInRange(sourceIP, c.RangeFrom, c.RangeTo) {
+		return false
+	}
+	if len(c.MAC) > 0 {
+		if len(mac) == 0 {
+			return false
+		}
+		if !bytes.Equal(c.MAC, mac) {
+			return false
+		}
+	}
+	if c.MACPrefixBits > 0 && !macHasPrefix(mac, c.MACPrefix, c.MACPrefixBits) {
+		return false
+	}
+	if c.Name != "" && (cl.Names == nil || !matchName(c.Name, cl.Names())) {
+		return false
+	}
+	if c.Listen != nil && !c.Listen.Match(cl.Listener, destIP) {
+		return false
+	}
+	if len(c.DestIPs) > 0 {
+		if destIP == nil {
+			return false
+		}
+		for i := range c.DestIPs {
+			if c.DestIPs[i].Equal(destIP) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func ipInRange(ip, from, to net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if len(from) == net.IPv4len {
+		if ip = ip.To4(); ip == nil {
+			return false
+		}
+	} else if ip.To4() != nil {
+		return false
+	} else {
+		ip = ip.To16()
+	}
+	return bytes.Compare(ip, from) >= 0 && bytes.Compare(ip, to) <= 0
+}
+
+func macHasPrefix(mac, prefix net.HardwareAddr, bits int) bool {
+	if len(mac)*8 < bits {
+		return false
+	}
+	full := bits / 8
+	if !bytes.Equal(mac[:full], prefix[:full]) {
+		return false
+	}
+	if rem := bits % 8; rem > 0 {
+		mask := byte(0xff) << (8 - rem)
+		return mac[full]&mask == prefix[full]&mask
+	}
+	return true
+}
+
+// matchName returns true if one of names, or its first label, matches the
+// glob pattern.
+func matchName(pattern string, names []string) bool {
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if idx := strings.IndexByte(name, '.'); idx != -1 {
+			if ok, _ := path.Match(pattern, name[:idx]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c clientCondition) isZero() bool {
+	return c.Prefix == nil && len(c.MAC) == 0 && len(c.DestIPs) == 0 &&
+		c.RangeFrom == nil && c.MACPrefixBits == 0 && c.Name == "" && c.Listen == nil
+}
+
+// sameCriteria returns true if c and c2 match on the same criteria.
+func (c clientCondition) sameCriteria(c2 clientCondition) bool {
+	return (c.MAC != nil && c2.MAC != nil && bytes.Equal(c.MAC, c2.MAC)) ||
+		(c.DestIPs != nil && c2.DestIPs != nil && ipListEqual(c.DestIPs, c2.DestIPs)) ||
+		(c.Prefix != nil && c2.Prefix != nil && c.Prefix.String() == c2.Prefix.String()) ||
+		(c.RangeFrom != nil && c2.RangeFrom != nil && c.RangeFrom.Equal(c2.RangeFrom) && c.RangeTo.Equal(c2.RangeTo)) ||
+		(c.MACPrefixBits > 0 && c.MACPrefixBits == c2.MACPrefixBits && macHasPrefix(c.MACPrefix, c2.MACPrefix, c.MACPrefixBits)) ||
+		(c.Name != "" && c.Name == c2.Name) ||
+		(c.Listen != nil && c2.Listen != nil && *c.Listen == *c2.Listen) ||
+		(c.isZero() && c2.isZero())
+}
+
+func (c clientCondition) String() string {
+	return c.raw
+}
+
+// listenAddr matches a proxy listener by host, port or both.
+type listenAddr struct {
+	Host string
+	Port string
+}
+
+// parseListenAddr parses HOST:PORT, :PORT or HOST.
+func parseListenAddr(s string) (*listenAddr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = strings.Trim(s, "[]"), ""
+	}
+	if port != "" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("%s: invalid listen port", s)
+		}
+	}
+	if host == "" && port == "" {
+		return nil, fmt.Errorf("%s: invalid listen address", s)
+	}
+	return &listenAddr{Host: host, Port: port}, nil
+}
+
+// Match returns true if the query received by listener on destIP matches l.
+// When the listener is bound to all addresses, the host is compared to destIP.
+func (l listenAddr) Match(listener string, destIP net.IP) bool {
+	host, port, err := net.SplitHostPort(listener)
+	if err != nil {
+		return false
+	}
+	if l.Port != "" && l.Port != port {
+		return false
+	}
+	if l.Host == "" {
+		return true
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		ip := net.ParseIP(l.Host)
+		return ip != nil && ip.Equal(destIP)
+	}
+	if ip := net.ParseIP(l.Host); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+	return strings.EqualFold(l.Host, host)
+}
+
+func (l *listenAddr) String() string {
+	if l == nil {
+		return ""
+	}
+	if l.Port == "" {
+		return l.Host
+	}
+	return net.JoinHostPort(l.Host, l.Port)
+}
+
+func ipListEqual(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
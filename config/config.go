@@ -1,11 +1,14 @@
 package config
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/nextdns/nextdns/host"
@@ -19,6 +22,7 @@ type Config struct {
 	ConfigDeprecated     Profiles
 	Profile              Profiles
 	Forwarders           Forwarders
+	SplitDNS             bool
 	LogQueries           bool
 	CacheSize            string
 	CacheMaxAge          time.Duration
@@ -27,13 +31,35 @@ type Config struct {
 	DiscoveryDNS         string
 	MDNS                 string
 	DetectCaptivePortals bool
+	Fallback             string
+	FallbackStrict       bool
+	FallbackDomains      []string
+	TolerateClockSkew    bool
+	UpstreamTLS          string
+	UpstreamInterface    string
+	UpstreamSource       string
+	UpstreamMark         uint
+	UpstreamProxy        string
+	Keepalive            time.Duration
+	Prewarm              time.Duration
 	BogusPriv            bool
 	UseHosts             bool
 	Timeout              time.Duration
 	MaxInflightRequests  uint
 	SetupRouter          bool
+	HijackDNS            bool
+	HijackDNSInterfaces  []string
+	BlockEncryptedDNS    bool
+	EncryptedDNSList     string
+	DoHCanary            bool
+	PrivateRelay         string
 	AutoActivate         bool
+	Container            bool
+	HealthAddr           string
 	Debug                bool
+
+	// env holds the settings applied from the environment by the last parse.
+	env map[string]envSetting
 }
 
 func (c *Config) Parse(cmd string, args []string, useStorage bool) {
@@ -42,10 +68,31 @@ func (c *Config) Parse(cmd string, args []string, useStorage bool) {
 	}
 	fs := c.flagSet(cmd)
 	fs.Parse(args, useStorage)
+	c.setDefaults(fs)
+}
+
+// Load is like Parse but returns an error instead of exiting when the
+// arguments or the stored configuration are invalid. It is used to reload the
+// configuration of a running daemon.
+func (c *Config) Load(cmd string, args []string, useStorage bool) error {
+	fs := c.flagSet(cmd)
+	fs.flag.Init(" "+cmd, flag.ContinueOnError)
+	fs.flag.SetOutput(io.Discard)
+	if err := fs.parse(args, useStorage); err != nil {
+		return err
+	}
+	c.setDefaults(fs)
+	return nil
+}
+
+func (c *Config) setDefaults(fs flagSet) {
 	defaultListen := "localhost:53"
 	if runtime.GOOS == "windows" {
 		defaultListen = "127.0.0.1:53"
 	}
+	if c.Container {
+		defaultListen = ":53"
+	}
 	if len(c.Listens) == 0 {
 		c.Listens = []string{defaultListen}
 	} else {
@@ -55,8 +102,35 @@ func (c *Config) Parse(cmd string, args []string, useStorage bool) {
 	}
 }
 
+// Changes returns the sorted names of the settings with a different value in
+// c and c2.
+func (c *Config) Changes(c2 *Config) []string {
+	s1, s2 := c.flagSet("").storage, c2.flagSet("").storage
+	var names []string
+	for name, entry := range s1 {
+		if entryString(entry) != entryString(s2[name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func entryString(entry service.ConfigEntry) string {
+	if entry, ok := entry.(service.ConfigListEntry); ok {
+		return strings.Join(entry.Strings(), "\n")
+	}
+	return entry.String()
+}
+
+// Save stores the configuration. Settings coming from the environment are
+// not stored, unless they were changed after the configuration was parsed.
 func (c *Config) Save() error {
-	fs := c.flagSet("")
+	cc := *c
+	fs := cc.flagSet("")
+	if err := unsetEnv(fs.storage, c.env); err != nil {
+		return err
+	}
 	cs, err := fs.storer()
 	if err != nil {
 		return err
@@ -66,7 +140,13 @@ func (c *Config) Save() error {
 
 func (c *Config) Write(w io.Writer) error {
 	fs := c.flagSet("")
-	for name, entry := range fs.storage {
+	names := make([]string, 0, len(fs.storage))
+	for name := range fs.storage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := fs.storage[name]
 		if entry, ok := entry.(service.ConfigListEntry); ok {
 			for _, value := range entry.Strings() {
 				fmt.Fprintf(w, "%s %s\n", name, value)
@@ -78,6 +158,12 @@ func (c *Config) Write(w io.Writer) error {
 	return nil
 }
 
+// WriteTOML writes the configuration in the TOML format, as read when the
+// configuration file has a .toml extension.
+func (c *Config) WriteTOML(w io.Writer) error {
+	return WriteTOML(w, c.flagSet("").storage)
+}
+
 func (c *Config) flagSet(cmd string) flagSet {
 	fs := flagSet{
 		config:  c,
@@ -85,7 +171,14 @@ func (c *Config) flagSet(cmd string) flagSet {
 	}
 	if cmd != "" {
 		fs.flag = flag.NewFlagSet(" "+cmd, flag.ExitOnError)
-		fs.flag.StringVar(&c.File, "config-file", "", "Custom path to configuration file.")
+		fs.flag.StringVar(&c.File, "config-file", "", "Custom path to configuration file. Files with a .toml extension use\n"+
+			"the TOML format, see nextdns config migrate.\n"+
+			"\n"+
+			"Settings are applied in increasing order of precedence from the\n"+
+			"defaults, the configuration file, NEXTDNS_* environment variables\n"+
+			"(like NEXTDNS_CACHE_SIZE for cache-size) and command line flags. List\n"+
+			"settings take several values separated by ; or indexed variables\n"+
+			"like NEXTDNS_PROFILE_1.")
 	}
 	fs.BoolVar(&c.Debug, "debug", false, "Enable debug logs.")
 	fs.StringsVar(&c.Listens, "listen", "Listen address for UDP DNS proxy server.")
@@ -103,8 +196,30 @@ func (c *Config) flagSet(cmd string) flagSet {
 			"  profile to a specific host on the LAN.\n"+
 			"* eth0=abcdef: An interface name can be used to restrict a profile\n"+
 			"  to all hosts behind this interface.\n"+
+			"* 10.10.10.20-10.10.10.40=abcdef: An inclusive range of IPs.\n"+
+			"* 28:a0:2b=abcdef: A MAC address prefix (OUI), or a MAC address with\n"+
+			"  a prefix length in bits like 28:a0:2b:50:00:00/28, to match all the\n"+
+			"  devices of a manufacturer.\n"+
+			"* name:*-ipad=abcdef: A glob matched against the client names found\n"+
+			"  by LAN client discovery (requires -report-client-info). Unlike MAC\n"+
+			"  addresses, names survive MAC randomization and device replacement.\n"+
+			"* listen=192.168.1.1:5353=abcdef: The -listen address the query was\n"+
+			"  received on. The host or the port can be omitted (listen=:5353).\n"+
+			"\n"+
+			"A schedule can be added to a condition with @[DAYS ]HH:MM-HH:MM,\n"+
+			"evaluated in the local timezone of the host. DAYS is a comma separated\n"+
+			"list of days or day ranges (Mon-Fri,Sun); when omitted, the window\n"+
+			"applies every day. A window ending before its start ends the next day,\n"+
+			"DAYS being the days the window starts: Mon-Fri 21:00-07:00 covers\n"+
+			"Friday night but not Sunday night, use Sun-Thu for school nights. A\n"+
+			"window ending at its start lasts 24 hours, Sat,Sun 00:00-00:00 covers\n"+
+			"the whole weekend:\n"+
+			"* 00:1c:42:2e:60:4a@Sun-Thu 21:00-07:00=abcdef: Use abcdef for this host\n"+
+			"  on school nights.\n"+
+			"* @Mon-Fri 09:00-17:00=abcdef: Use abcdef as default during work hours.\n"+
 			"\n"+
-			"This parameter can be repeated. The first match wins.")
+			"This parameter can be repeated. Scheduled profiles are evaluated\n"+
+			"first, then the first match wins.")
 	fs.Var(&c.Forwarders, "forwarder",
 		"A DNS server to use for a specified domain.\n"+
 			"\n"+
@@ -115,10 +230,50 @@ func (c *Config) flagSet(cmd string) flagSet {
 			"A SERVER_ADDR can ben either an IP[:PORT] for DNS53 (unencrypted UDP,\n"+
 			"TCP), or a HTTPS URL for a DNS over HTTPS server. For DoH, a bootstrap\n"+
 			"IP can be specified as follow: https://dns.nextdns.io#45.90.28.0.\n"+
+			"TLS options can be appended to the fragment, separated by &:\n"+
+			"ca=/path/to/ca.pem to trust an extra CA bundle, pin=sha256/BASE64 to\n"+
+			"pin the SPKI of a certificate of the chain (repeatable), sni=NAME to\n"+
+			"override the TLS server name, and min-tls=1.2|1.3. For instance:\n"+
+			"https://doh.corp#10.0.0.1&ca=/etc/corp-ca.pem&min-tls=1.3.\n"+
 			"Several servers can be specified, separated by commas to implement\n"+
-			"failover."+
+			"failover.\n"+
 			"\n"+
-			"This parameter can be repeated. The first match wins.")
+			"The DOMAIN can be prefixed by *. to only match sub-domains, and a\n"+
+			"rule in the form !DOMAIN (without server) excludes a domain from less\n"+
+			"specific rules so it is sent to NextDNS. The most specific rule wins,\n"+
+			"whatever the order of the rules. Note that older versions used the\n"+
+			"first matching rule: a rule defined after a less specific one, which\n"+
+			"used to be ignored, is now used. A warning is logged at startup for\n"+
+			"such rules.\n"+
+			"\n"+
+			"Large rule sets can be loaded from a file with file:PATH=SERVER. The\n"+
+			"file contains one domain per line, using the same *. and ! syntax,\n"+
+			"with # comments. The file is reloaded automatically when modified.\n"+
+			"\n"+
+			"Options can be added after the server list, separated by spaces:\n"+
+			"* strategy=NAME: how queries are distributed over the servers, one of\n"+
+			"  failover (default), round-robin, random, fastest or parallel-race.\n"+
+			"* probe=DOMAIN: domain queried by health checks, requires interval.\n"+
+			"* interval=DURATION: interval between health checks. Servers marked\n"+
+			"  down are only brought back by a successful health check.\n"+
+			"* max-fails=N: consecutive errors before a server is marked down\n"+
+			"  (default 3).\n"+
+			"* client=COND: only apply the rule to some clients, using the same\n"+
+			"  conditions as -profile, except names.\n"+
+			"* listen=ADDR: only apply the rule to queries received on some\n"+
+			"  listeners, like the -profile listen= condition.\n"+
+			"* qtype=TYPE[,TYPE...]: only apply the rule to some query types.\n"+
+			"For instance: corp.example=10.0.0.1,10.0.0.2 strategy=round-robin\n"+
+			"probe=dc.corp.example interval=30s.\n"+
+			"\n"+
+			"This parameter can be repeated.")
+	fs.BoolVar(&c.SplitDNS, "split-dns", false,
+		"Automatically forward the search domains of each network interface to\n"+
+			"the DNS servers of this interface, as configured by DHCP or a VPN\n"+
+			"(NetworkManager, systemd-networkd, dhcpcd or resolv.conf). The rules\n"+
+			"are updated on network changes and removed when the interface goes\n"+
+			"away. Explicit forwarders take precedence over learned ones for the\n"+
+			"same domain.")
 	fs.BoolVar(&c.LogQueries, "log-queries", false, "Log DNS queries.")
 	fs.StringVar(&c.CacheSize, "cache-size", "0",
 		"Set the size of the cache in byte. Use 0 to disable caching. The value\n"+
@@ -146,11 +301,77 @@ func (c *Config) flagSet(cmd string) flagSet {
 			"Use \"all\" to listen on all interface or an interface name to limit mDNS on a\n"+
 			"specific network interface. Use \"disabled\" to disable mDNS altogether.")
 	fs.BoolVar(&c.DetectCaptivePortals, "detect-captive-portals", false,
-		"Automatic detection of captive portals and fallback on system DNS to\n"+
-			"allow the connection to establish.\n"+
+		"Always allow fallback on system DNS when DoH fails.\n"+
+			"\n"+
+			"When listening on localhost only, captive portals are detected\n"+
+			"automatically after each network change and fallback is allowed\n"+
+			"while a portal is present. This option keeps fallback enabled at all\n"+
+			"times instead.\n"+
 			"\n"+
 			"Beware that enabling this feature can allow an attacker to force nextdns\n"+
 			"to disable DoH and leak unencrypted DNS traffic.")
+	fs.StringVar(&c.Fallback, "fallback", "system",
+		"Servers to fall back to when NextDNS can't be reached over DoH.\n"+
+			"\n"+
+			"The value is a comma separated list of SERVER_ADDR using the same\n"+
+			"format as -forwarder. The special value \"system\" expands to the\n"+
+			"DNS servers configured on the host followed by the NextDNS anycast\n"+
+			"plain DNS address. Use \"none\" to disable fallback altogether.")
+	fs.BoolVar(&c.FallbackStrict, "fallback-strict", false,
+		"Only resolve captive portal and time synchronization related domains\n"+
+			"while on plain DNS fallback. Other queries are answered with SERVFAIL.\n"+
+			"\n"+
+			"This closes the window during which an attacker could force nextdns\n"+
+			"to downgrade to unencrypted DNS, at the cost of a degraded service\n"+
+			"until DoH is reachable again.")
+	fs.StringsVar(&c.FallbackDomains, "fallback-domain",
+		"Domain allowed to be resolved while on plain DNS fallback when\n"+
+			"fallback-strict is enabled, in addition to a builtin list of captive\n"+
+			"portal and time synchronization domains. Sub-domains are included.\n"+
+			"\n"+
+			"This parameter can be repeated.")
+	fs.BoolVar(&c.TolerateClockSkew, "tolerate-clock-skew", false,
+		"Keep using DoH when the system clock is wrong.\n"+
+			"\n"+
+			"When TLS certificate validation fails because of validity dates, the\n"+
+			"time reported by the DoH server is used to validate the certificate\n"+
+			"chain for up to one hour at a time, and 24 hours in total until the\n"+
+			"system clock is valid again. This is useful on routers without a\n"+
+			"real time clock that can't sync their time with NTP before DNS works.\n"+
+			"\n"+
+			"Beware that the server time is not authenticated, enabling this\n"+
+			"option weakens the protection against expired certificates.")
+	fs.StringVar(&c.UpstreamTLS, "upstream-tls", "",
+		"TLS options for the NextDNS DoH endpoints, using the same format as\n"+
+			"forwarder URL options: ca=/path/to/ca.pem to trust an extra CA\n"+
+			"bundle, pin=sha256/BASE64 to require a certificate of the chain to\n"+
+			"match this SPKI pin (repeatable), sni=NAME and min-tls=1.2|1.3.\n"+
+			"For instance: pin=sha256/AAAA...&pin=sha256/BBBB...&min-tls=1.3.\n"+
+			"\n"+
+			"Pin mismatches are logged as endpoint errors.")
+	fs.StringVar(&c.UpstreamInterface, "upstream-interface", "",
+		"Bind upstream DNS connections (DoH, plain DNS and endpoint tests) to\n"+
+			"this network interface. On Linux, the socket is bound to the device\n"+
+			"so policy routing can't send it elsewhere. On other platforms, an\n"+
+			"address of the interface is used as source address.")
+	fs.StringVar(&c.UpstreamSource, "upstream-source", "",
+		"Source IP address for upstream DNS connections. Only used for\n"+
+			"servers of the same address family.")
+	fs.UintVar(&c.UpstreamMark, "upstream-mark", 0,
+		"Firewall mark (SO_MARK) set on upstream DNS connections, to be\n"+
+			"matched by policy routing rules. Linux only.")
+	fs.StringVar(&c.UpstreamProxy, "upstream-proxy", "",
+		"Send DoH connections through a proxy. Supported formats are\n"+
+			"socks5://[user:pass@]host:port and http://[user:pass@]host:port (HTTP\n"+
+			"CONNECT). Plain DNS is never proxied.")
+	fs.DurationVar(&c.Keepalive, "keepalive", 0,
+		"Interval at which HTTP/2 PING frames are sent to keep DoH connections\n"+
+			"alive. When set, idle connections are kept open instead of being\n"+
+			"closed after 90 seconds. Set to 0 to disable.")
+	fs.DurationVar(&c.Prewarm, "prewarm", 0,
+		"Send a test query to the active DoH endpoint when idle for this\n"+
+			"duration, and to the next fallback endpoint at the same interval, so\n"+
+			"a connection is ready when needed. Set to 0 to disable.")
 	fs.BoolVar(new(bool), "hardened-privacy", false, "Deprecated.")
 	fs.BoolVar(&c.BogusPriv, "bogus-priv", true,
 		"Bogus private reverse lookups.\n"+
@@ -172,8 +393,66 @@ func (c *Config) flagSet(cmd string) flagSet {
 			"Common types of router are detected to integrate gracefully. Changes\n"+
 			"applies are undone on daemon exit. The listen option is ignored when\n"+
 			"this option is used.")
+	fs.BoolVar(&c.HijackDNS, "hijack-dns", false,
+		"Redirect DNS queries sent by LAN clients to other servers to NextDNS.\n"+
+			"\n"+
+			"Some devices use hardcoded DNS servers like 8.8.8.8, bypassing the\n"+
+			"router DNS. With setup-router, NAT rules are installed with nftables or\n"+
+			"iptables to redirect their UDP and TCP port 53 traffic, over IPv4 and\n"+
+			"IPv6, to the router. The rules are removed on exit.\n"+
+			"\n"+
+			"When log-queries is enabled, queries are logged with their original\n"+
+			"destination. The original destination is never logged on routers\n"+
+			"where dnsmasq forwards the queries to NextDNS: OpenWrt,\n"+
+			"ASUSWRT-Merlin, DD-WRT, EdgeOS, Synology, UniFi and Firewalla.\n"+
+			"NextDNS then receives the queries from dnsmasq on the loopback, and\n"+
+			"cannot tell where the clients originally sent them.")
+	fs.StringsVar(&c.HijackDNSInterfaces, "hijack-dns-interface",
+		"LAN interface on which DNS queries are redirected by hijack-dns.\n"+
+			"\n"+
+			"Defaults to the LAN interface of the router (br-lan on OpenWrt, br0\n"+
+			"on ASUSWRT-Merlin and DD-WRT, br* on UniFi), and must be set on\n"+
+			"other routers. A name ending with * matches all the interfaces with\n"+
+			"this prefix. Queries to private networks are never redirected.\n"+
+			"\n"+
+			"This parameter can be repeated.")
+	fs.BoolVar(&c.BlockEncryptedDNS, "block-encrypted-dns", false,
+		"Prevent LAN clients from bypassing NextDNS with their own encrypted DNS.\n"+
+			"\n"+
+			"With setup-router, filter rules are installed with nftables or\n"+
+			"iptables to reject DNS over TLS and QUIC (port 853) as well as HTTPS\n"+
+			"to a list of known public DNS over HTTPS resolvers. The rules are\n"+
+			"removed on exit.")
+	fs.StringVar(&c.EncryptedDNSList, "block-encrypted-dns-list", "",
+		"File listing the IPs of the DNS over HTTPS resolvers blocked by\n"+
+			"block-encrypted-dns, one per line, replacing the builtin list. Empty\n"+
+			"lines and lines starting with # are ignored. The file is read when\n"+
+			"the router is setup.")
+	fs.BoolVar(&c.DoHCanary, "doh-canary", false,
+		"Answer the use-application-dns.net canary domain with \"no such domain\",\n"+
+			"signaling Firefox not to enable its own DNS over HTTPS by default.\n"+
+			"\n"+
+			"It is typically enabled along with block-encrypted-dns, so Firefox\n"+
+			"uses the network DNS instead of failing on blocked resolvers.")
+	fs.StringVar(&c.PrivateRelay, "private-relay", "allow",
+		"Policy for iCloud Private Relay, which bypasses the network DNS.\n"+
+			"\n"+
+			"With block, mask.icloud.com and mask-h2.icloud.com are answered with\n"+
+			"\"no such domain\", signaling Apple devices that Private Relay is not\n"+
+			"allowed on the network. With allow, they are resolved normally.")
 	fs.BoolVar(&c.AutoActivate, "auto-activate", false,
 		"Run activate at startup and deactivate on exit.")
+	fs.BoolVar(&c.Container, "container", false,
+		"Run in a container.\n"+
+			"\n"+
+			"There is no service integration: logs go to the console, the system\n"+
+			"DNS configuration is not changed and auto-activate and setup-router\n"+
+			"are ignored. The default listen address is :53.")
+	fs.StringVar(&c.HealthAddr, "health-addr", "",
+		"Listen address of an HTTP health endpoint, like :8080.\n"+
+			"\n"+
+			"GET /health returns 200 while the proxy is serving queries and 503\n"+
+			"otherwise.")
 	return fs
 }
 
@@ -207,21 +486,48 @@ type flagSet struct {
 }
 
 func (fs flagSet) Parse(args []string, useStorage bool) {
+	if err := fs.parse(args, useStorage); err != nil {
+		if errors.Is(err, errUnrecognizedParameter) {
+			fmt.Fprintf(fs.flag.Output(), "Unrecognized parameter: %v\n", fs.flag.Args()[0])
+			fs.flag.PrintDefaults()
+		} else {
+			fmt.Fprintln(fs.flag.Output(), err)
+		}
+		os.Exit(2)
+	}
+}
+
+var errUnrecognizedParameter = errors.New("unrecognized parameter")
+
+func (fs flagSet) parse(args []string, useStorage bool) error {
 	// Parse a copy of args to get the config file.
 	_ = fs.flag.Parse(append([]string{}, args...))
+	if fs.config.File == "" {
+		fs.config.File = envConfigFile()
+	}
 	if useStorage || fs.config.File != "" {
 		cs, err := fs.storer()
 		if err != nil {
-			fmt.Fprintln(fs.flag.Output(), err)
-			os.Exit(2)
+			return err
 		}
 		if err = cs.LoadConfig(fs.storage); err != nil {
-			fmt.Fprintln(fs.flag.Output(), err)
-			os.Exit(2)
+			return err
 		}
 	}
 
+	env, err := setEnv(fs.storage, os.Environ())
+	if err != nil {
+		return err
+	}
+	fs.config.env = env
+
 	// Migrate from config to profile
+	if e, found := env["config"]; found {
+		p := env["profile"]
+		p.values = append(p.values, e.values...)
+		env["profile"] = p
+		delete(env, "config")
+	}
 	if len(fs.config.ConfigDeprecated) > 0 {
 		fs.config.Profile = append(fs.config.Profile, fs.config.ConfigDeprecated...)
 		fs.config.ConfigDeprecated = nil
@@ -232,12 +538,19 @@ func (fs flagSet) Parse(args []string, useStorage bool) {
 		}
 	}
 
-	_ = fs.flag.Parse(args)
+	if err := fs.flag.Parse(args); err != nil {
+		return err
+	}
 	if len(fs.flag.Args()) > 0 {
-		fmt.Fprintf(fs.flag.Output(), "Unrecognized parameter: %v\n", fs.flag.Args()[0])
-		fs.flag.PrintDefaults()
-		os.Exit(2)
+		return fmt.Errorf("%w: %v", errUnrecognizedParameter, fs.flag.Args()[0])
 	}
+	// Flags take precedence over the environment and are saved.
+	fs.flag.Visit(func(f *flag.Flag) {
+		if _, ok := fs.storage[f.Name].(service.ConfigListEntry); !ok {
+			delete(env, f.Name)
+		}
+	})
+	return nil
 }
 
 func (fs flagSet) StringsVar(p *[]string, name string, usage string) {
@@ -286,6 +599,9 @@ func (fs flagSet) Var(value flag.Value, name string, usage string) {
 func (fs flagSet) storer() (service.ConfigStorer, error) {
 	if file := fs.config.File; file != "" {
 		// If config file is not provided, use system's default config manager.
+		if strings.HasSuffix(file, ".toml") {
+			return tomlStorer{File: file}, nil
+		}
 		return service.ConfigFileStorer{File: file}, nil
 	}
 	return host.NewService(service.Config{Name: "nextdns"})
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nextdns/nextdns/host/service"
+)
+
+// EnvPrefix is the prefix of the environment variables used to set the
+// settings. The variable name of a setting is its name in upper case with
+// dashes replaced by underscores, like NEXTDNS_CACHE_SIZE for cache-size.
+//
+// List settings accept several values separated by semicolons, or indexed
+// variables like NEXTDNS_PROFILE_1, NEXTDNS_PROFILE_2, applied in index order
+// after the non-indexed one.
+//
+// Settings are applied by increasing order of precedence: defaults, the
+// configuration file, the environment and the command line flags. Like flags,
+// list values from the environment are added to the ones of the configuration
+// file.
+const EnvPrefix = "NEXTDNS_"
+
+// envName returns the environment variable name of a setting.
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// envConfigFile returns the config file set in the environment, if any.
+func envConfigFile() string {
+	return os.Getenv(envName("config-file"))
+}
+
+// envSetting records a setting applied from the environment so it can be
+// left out when the configuration is saved.
+type envSetting struct {
+	// prev is the value of a non-list setting before the environment was
+	// applied.
+	prev string
+	// values are the values set from the environment. Lists hold the values
+	// added to the list.
+	values []string
+}
+
+// setEnv sets the settings of c found in environ, a list of key=value
+// strings as returned by os.Environ. It returns the settings it changed.
+func setEnv(c map[string]service.ConfigEntry, environ []string) (map[string]envSetting, error) {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, EnvPrefix) {
+			env[k] = v
+		}
+	}
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	applied := map[string]envSetting{}
+	for _, name := range names {
+		entry := c[name]
+		key := envName(name)
+		if list, ok := entry.(service.ConfigListEntry); ok {
+			values := envList(env, key)
+			if len(values) == 0 {
+				continue
+			}
+			n := len(list.Strings())
+			for _, value := range values {
+				if err := entry.Set(value); err != nil {
+					return nil, fmt.Errorf("%s: %v", key, err)
+				}
+			}
+			applied[name] = envSetting{values: list.Strings()[n:]}
+			continue
+		}
+		if value, found := env[key]; found {
+			prev := entry.String()
+			if err := entry.Set(value); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			applied[name] = envSetting{prev: prev, values: []string{entry.String()}}
+		}
+	}
+	return applied, nil
+}
+
+// unsetEnv reverts in c the settings applied from the environment and
+// recorded in applied. Settings changed since are kept.
+func unsetEnv(c map[string]service.ConfigEntry, applied map[string]envSetting) error {
+	for name, e := range applied {
+		entry, found := c[name]
+		if !found {
+			continue
+		}
+		list, ok := entry.(service.ConfigListEntry)
+		if !ok {
+			if entry.String() == e.values[0] {
+				if err := entry.Set(e.prev); err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+			}
+			continue
+		}
+		values := list.Strings()
+		for _, v := range e.values {
+			for i := range values {
+				if values[i] == v {
+					values = append(values[:i], values[i+1:]...)
+					break
+				}
+			}
+		}
+		resetList(entry)
+		for _, v := range values {
+			if err := entry.Set(v); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resetList empties the list setting entry.
+func resetList(entry service.ConfigEntry) {
+	switch l := entry.(type) {
+	case *multiStringValue:
+		*l = nil
+	case *Profiles:
+		*l = nil
+	case *Forwarders:
+		*l = nil
+	}
+}
+
+// envList returns the values of the list setting with the key variable name.
+func envList(env map[string]string, key string) []string {
+	var values []string
+	for _, v := range strings.Split(env[key], ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	type indexed struct {
+		i     int
+		value string
+	}
+	var idx []indexed
+	for k, v := range env {
+		if s, found := strings.CutPrefix(k, key+"_"); found {
+			if i, err := strconv.Atoi(s); err == nil && strings.TrimSpace(v) != "" {
+				idx = append(idx, indexed{i, strings.TrimSpace(v)})
+			}
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool { return idx[i].i < idx[j].i })
+	for _, e := range idx {
+		values = append(values, e.value)
+	}
+	return values
+}
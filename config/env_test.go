@@ -0,0 +1,92 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_LoadEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nextdns.conf")
+	writeFile(t, file, "cache-size 1MB\nmax-ttl 5s\nlog-queries true\n")
+	t.Setenv("NEXTDNS_CONFIG_FILE", file)
+	t.Setenv("NEXTDNS_CACHE_SIZE", "2MB")
+	t.Setenv("NEXTDNS_MAX_TTL", "10s")
+	t.Setenv("NEXTDNS_LISTEN", ":53; :5353")
+	t.Setenv("NEXTDNS_PROFILE_10", "ghijkl")
+	t.Setenv("NEXTDNS_PROFILE_2", "10.0.0.0/8=abcdef")
+
+	var c Config
+	if err := c.Load("test", []string{"-max-ttl", "20s"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if c.CacheSize != "2MB" {
+		t.Errorf("CacheSize = %q, want env value 2MB", c.CacheSize)
+	}
+	if c.MaxTTL != 20*time.Second {
+		t.Errorf("MaxTTL = %v, want flag value 20s", c.MaxTTL)
+	}
+	if !c.LogQueries {
+		t.Error("LogQueries = false, want file value true")
+	}
+	if got, want := strings.Join(c.Listens, " "), ":53 :5353"; got != want {
+		t.Errorf("Listens = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(c.Profile.Strings(), "|"), "10.0.0.0/8=abcdef|ghijkl"; got != want {
+		t.Errorf("Profile = %q, want %q", got, want)
+	}
+
+	t.Setenv("NEXTDNS_LOG_QUERIES", "maybe")
+	if err := (&Config{}).Load("test", nil, false); err == nil || !strings.HasPrefix(err.Error(), "NEXTDNS_LOG_QUERIES:") {
+		t.Errorf("Load() err = %v, want NEXTDNS_LOG_QUERIES error", err)
+	}
+}
+
+func TestConfig_SaveWithoutEnv(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nextdns.conf")
+	writeFile(t, file, "cache-size 1MB\nlisten :53\nprofile abcdef\n")
+	t.Setenv("NEXTDNS_CONFIG_FILE", file)
+	t.Setenv("NEXTDNS_CACHE_SIZE", "2MB")
+	t.Setenv("NEXTDNS_MAX_TTL", "10s")
+	t.Setenv("NEXTDNS_LISTEN", ":5353")
+	t.Setenv("NEXTDNS_PROFILE", "10.0.0.0/8=ghijkl")
+
+	var c Config
+	if err := c.Load("test", []string{"-max-ttl", "20s"}, false); err != nil {
+		t.Fatal(err)
+	}
+	c.LogQueries = true
+	for i := 0; i < 2; i++ {
+		if err := c.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := strings.Join(c.Listens, " "), ":53 :5353"; got != want {
+		t.Errorf("Listens = %q after Save, want %q", got, want)
+	}
+
+	for _, k := range []string{"NEXTDNS_CACHE_SIZE", "NEXTDNS_MAX_TTL", "NEXTDNS_LISTEN", "NEXTDNS_PROFILE"} {
+		os.Unsetenv(k)
+	}
+	var saved Config
+	if err := saved.Load("test", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if saved.CacheSize != "1MB" {
+		t.Errorf("CacheSize = %q, want file value 1MB", saved.CacheSize)
+	}
+	if saved.MaxTTL != 20*time.Second {
+		t.Errorf("MaxTTL = %v, want flag value 20s", saved.MaxTTL)
+	}
+	if !saved.LogQueries {
+		t.Error("LogQueries = false, want changed value true")
+	}
+	if got, want := strings.Join(saved.Listens, " "), ":53"; got != want {
+		t.Errorf("Listens = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(saved.Profile.Strings(), "|"), "abcdef"; got != want {
+		t.Errorf("Profile = %q, want %q", got, want)
+	}
+}
@@ -2,8 +2,11 @@ package config
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nextdns/nextdns/resolver"
 	"github.com/nextdns/nextdns/resolver/query"
@@ -13,38 +16,237 @@ import (
 type Resolver struct {
 	resolver.Resolver
 	addr   string
+	opts   []string
 	Domain string
+
+	// Wildcard is true when the rule only applies to sub-domains of Domain
+	// (*.domain syntax).
+	Wildcard bool
+
+	// Exclude is true when queries matching Domain must not be forwarded and
+	// use the default resolver instead (!domain syntax).
+	Exclude bool
+
+	// File is the path of a list of domains, one per line, all forwarded to
+	// the rule servers (file:PATH syntax).
+	File string
+
+	// Client restricts the rule to some clients (client=COND option).
+	Client clientCondition
+
+	// QTypes restricts the rule to some query types (qtype=TYPE,... option).
+	QTypes []query.Type
+
+	// Listen restricts the rule to queries received by some proxy listeners
+	// (listen=ADDR option).
+	Listen *listenAddr
 }
 
-// newResolver parses a server definition with an optional condition.
+// newResolver parses a server definition with an optional condition and
+// options separated by spaces:
+//
+//	[DOMAIN=]SERVER[,SERVER...] [strategy=STRATEGY] [probe=NAME] [interval=DURATION]
+//
+// DOMAIN can be prefixed with *. to only match sub-domains, or be
+// file:PATH to load a list of domains from a file. A rule in the form !DOMAIN,
+// without servers, excludes DOMAIN from less specific rules.
 func newResolver(v string) (Resolver, error) {
-	idx := strings.IndexByte(v, '=')
 	var r Resolver
-	r.addr = v
+	fields := strings.Fields(v)
+	if len(fields) == 0 {
+		return r, errors.New("empty forwarder")
+	}
+	spec := fields[0]
+	if len(fields) > 1 && strings.HasSuffix(spec, "=") {
+		// Support spaces after the domain separator.
+		spec += fields[1]
+		fields = fields[1:]
+	}
+	r.opts = fields[1:]
+	groupOpts, err := r.parseConditions()
+	if err != nil {
+		return r, err
+	}
+	if strings.HasPrefix(spec, "!") {
+		if len(groupOpts) > 0 || strings.IndexByte(spec, '=') != -1 {
+			return r, fmt.Errorf("%s: exclusions take no server", v)
+		}
+		r.Exclude = true
+		r.Domain = fqdn(spec[1:])
+		return r, nil
+	}
+	idx := strings.IndexByte(spec, '=')
+	if idx != -1 && !strings.HasPrefix(spec, "file:") && strings.ContainsAny(spec[:idx], ":/#") {
+		// The = is part of a DoH URL option, not a domain separator.
+		idx = -1
+	}
+	r.addr = spec
 	if idx != -1 {
-		r.addr = strings.TrimSpace(v[idx+1:])
-		r.Domain = fqdn(strings.TrimSpace(v[:idx]))
+		r.addr = strings.TrimSpace(spec[idx+1:])
+		domain := strings.TrimSpace(spec[:idx])
+		switch {
+		case strings.HasPrefix(domain, "file:"):
+			r.File = domain[5:]
+			if r.File == "" {
+				return r, fmt.Errorf("%s: missing file path", v)
+			}
+		case strings.HasPrefix(domain, "*."):
+			r.Wildcard = true
+			r.Domain = fqdn(domain[2:])
+		default:
+			r.Domain = fqdn(domain)
+		}
+	}
+	if len(groupOpts) == 0 {
+		r.Resolver, err = resolver.New(r.addr)
+		return r, err
+	}
+	g, err := resolver.NewGroup(r.addr)
+	if err != nil {
+		return r, err
+	}
+	for _, opt := range groupOpts {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "strategy":
+			if g.Strategy, err = resolver.ParseStrategy(value); err != nil {
+				return r, err
+			}
+		case "probe":
+			g.ProbeName = value
+		case "interval":
+			if g.HealthInterval, err = time.ParseDuration(value); err != nil {
+				return r, fmt.Errorf("interval: %v", err)
+			}
+		case "max-fails":
+			if g.MaxFails, err = strconv.Atoi(value); err != nil {
+				return r, fmt.Errorf("max-fails: %v", err)
+			}
+		default:
+			return r, fmt.Errorf("%s: unsupported forwarder option", opt)
+		}
+	}
+	if g.ProbeName != "" && g.HealthInterval <= 0 {
+		// Health checks only run with an interval, the probe would be ignored.
+		return r, fmt.Errorf("%s: probe requires interval", v)
+	}
+	r.Resolver = g
+	return r, nil
+}
+
+// parseConditions parses the client, listen and qtype options and returns the
+// remaining options.
+func (r *Resolver) parseConditions() (opts []string, err error) {
+	for _, opt := range r.opts {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "client":
+			if r.Client, err = parseClientCondition(value); err != nil {
+				return nil, err
+			}
+		case "listen":
+			if r.Listen, err = parseListenAddr(value); err != nil {
+				return nil, err
+			}
+		case "qtype":
+			for _, name := range strings.Split(value, ",") {
+				t, err := query.ParseType(name)
+				if err != nil {
+					return nil, err
+				}
+				r.QTypes = append(r.QTypes, t)
+			}
+		default:
+			opts = append(opts, opt)
+		}
 	}
-	var err error
-	r.Resolver, err = resolver.New(r.addr)
-	return r, err
+	return opts, nil
 }
 
-// Match returns true if the rule matches domain.
-func (r Resolver) Match(domain string) bool {
+// Match returns true if the rule matches the domain, client and type of q.
+// Rules with a File never match, use ForwarderTable to get them evaluated.
+func (r Resolver) Match(q query.Query) bool {
+	if r.File != "" {
+		return false
+	}
 	if r.Domain != "" {
-		if domain != r.Domain && !isSubDomain(domain, r.Domain) {
+		if (r.Wildcard || q.Name != r.Domain) && !isSubDomain(q.Name, r.Domain) {
 			return false
 		}
 	}
+	return r.matchConditions(q)
+}
+
+// matchConditions returns true if the client, listener and type conditions
+// match q.
+func (r Resolver) matchConditions(q query.Query) bool {
+	if !r.Client.Match(queryClient(q)) {
+		return false
+	}
+	if r.Listen != nil && !r.Listen.Match(q.Listener, q.LocalIP) {
+		return false
+	}
+	if len(r.QTypes) > 0 {
+		for _, t := range r.QTypes {
+			if t == q.Type {
+				return true
+			}
+		}
+		return false
+	}
 	return true
 }
 
+// key identifies the rule conditions so a rule can be replaced by a later one
+// with the same conditions.
+func (r Resolver) key() string {
+	k := r.pattern()
+	if !r.Client.isZero() {
+		k += " client=" + r.Client.String()
+	}
+	if r.Listen != nil {
+		k += " listen=" + r.Listen.String()
+	}
+	for _, t := range r.QTypes {
+		k += " " + t.String()
+	}
+	return k
+}
+
+// conditional returns true if the rule has client, listener or type
+// conditions.
+func (r Resolver) conditional() bool {
+	return !r.Client.isZero() || r.Listen != nil || len(r.QTypes) > 0
+}
+
+// pattern returns the condition part of the rule.
+func (r Resolver) pattern() string {
+	switch {
+	case r.Exclude:
+		return "!" + r.Domain
+	case r.File != "":
+		return "file:" + r.File
+	case r.Wildcard:
+		return "*." + r.Domain
+	}
+	return r.Domain
+}
+
 func (r Resolver) String() string {
-	if r.Domain != "" {
-		return fmt.Sprintf("%s=%s", r.Domain, r.addr)
+	if r.Exclude {
+		if len(r.opts) > 0 {
+			return r.pattern() + " " + strings.Join(r.opts, " ")
+		}
+		return r.pattern()
+	}
+	s := r.addr
+	if p := r.pattern(); p != "" {
+		s = fmt.Sprintf("%s=%s", p, r.addr)
 	}
-	return r.addr
+	if len(r.opts) > 0 {
+		s += " " + strings.Join(r.opts, " ")
+	}
+	return s
 }
 
 func fqdn(s string) string {
@@ -61,10 +263,14 @@ func isSubDomain(sub, domain string) bool {
 // Forwarders is a list of Resolver with rules.
 type Forwarders []Resolver
 
-// Get returns the server matching the domain conditions.
-func (f *Forwarders) Get(domain string) resolver.Resolver {
+// Get returns the server matching q. The list is walked in order and the
+// first match wins, see ForwarderTable for longest match semantics.
+func (f *Forwarders) Get(q query.Query) resolver.Resolver {
 	for _, s := range *f {
-		if s.Match(domain) {
+		if s.Match(q) {
+			if s.Exclude {
+				return nil
+			}
 			return s.Resolver
 		}
 	}
@@ -94,7 +300,7 @@ func (f *Forwarders) Set(value string) error {
 		return err
 	}
 	for i, _r := range *f {
-		if r.Domain == _r.Domain {
+		if r.key() == _r.key() {
 			(*f)[i] = r
 			return nil
 		}
@@ -105,7 +311,7 @@ func (f *Forwarders) Set(value string) error {
 
 // Resolve implements proxy.Resolver interface.
 func (f *Forwarders) Resolve(ctx context.Context, q query.Query, buf []byte) (int, resolver.ResolveInfo, error) {
-	r := f.Get(q.Name)
+	r := f.Get(q)
 	if r == nil {
 		return -1, resolver.ResolveInfo{}, fmt.Errorf("%s: no forwarder defined", q.Name)
 	}
@@ -0,0 +1,361 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// DefaultForwarderWatchInterval is the default interval at which forwarder
+// list files are checked for changes.
+const DefaultForwarderWatchInterval = 30 * time.Second
+
+// ForwarderTable is an index of forwarder rules supporting large rule sets
+// loaded from list files. Contrary to Forwarders, the most specific rule
+// wins. When several rules have the same specificity, rules with client or
+// query type conditions are evaluated first, then the first defined wins.
+//
+// The table is safe for concurrent use and is atomically updated when a list
+// file changes (see Watch).
+type ForwarderTable struct {
+	// Default is the resolver used when no rule matches or an exclusion rule
+	// matches.
+	Default resolver.Resolver
+
+	// OnReload is called after list files were reloaded. If err is not nil,
+	// the previous rules are kept.
+	OnReload func(rules int, err error)
+
+	forwarders Forwarders
+	trie       atomic.Pointer[forwarderTrie]
+
+	mu      sync.Mutex // serializes compilations
+	dynamic Forwarders
+}
+
+type forwarderTrie struct {
+	root  *forwarderNode
+	rules int
+	files map[string]time.Time
+}
+
+type forwarderNode struct {
+	children map[string]*forwarderNode
+
+	// rules match the node domain and its sub-domains.
+	rules []*Resolver
+
+	// wildcards only match sub-domains of the node domain.
+	wildcards []*Resolver
+}
+
+// NewForwarderTable compiles f into a table using def as default resolver.
+func NewForwarderTable(f Forwarders, def resolver.Resolver) (*ForwarderTable, error) {
+	t := &ForwarderTable{
+		Default:    def,
+		forwarders: f,
+	}
+	trie, err := compileForwarders(f)
+	if err != nil {
+		return nil, err
+	}
+	t.trie.Store(trie)
+	return t, nil
+}
+
+// OrderConflicts returns a description of the rules of f that are evaluated
+// differently since the most specific rule wins: a rule defined after a less
+// specific one used to be shadowed by it when the first match won.
+func OrderConflicts(f Forwarders) []string {
+	var conflicts []string
+	for i, a := range f {
+		if a.File != "" || a.Exclude {
+			continue
+		}
+		for _, b := range f[i+1:] {
+			if b.File != "" || b.Exclude || b.Domain == "" {
+				continue
+			}
+			if a.Domain == "" || isSubDomain(b.Domain, a.Domain) {
+				conflicts = append(conflicts, fmt.Sprintf("%s now takes precedence over %s, defined before it", b.String(), a.String()))
+			}
+		}
+	}
+	return conflicts
+}
+
+// Len returns the number of domains indexed.
+func (t *ForwarderTable) Len() int {
+	return t.trie.Load().rules
+}
+
+// Get returns the resolver for q.
+func (t *ForwarderTable) Get(q query.Query) resolver.Resolver {
+	if r := t.trie.Load().lookup(q); r != nil && !r.Exclude {
+		return r.Resolver
+	}
+	return t.Default
+}
+
+// Resolve implements proxy.Resolver interface.
+func (t *ForwarderTable) Resolve(ctx context.Context, q query.Query, buf []byte) (int, resolver.ResolveInfo, error) {
+	r := t.Get(q)
+	if r == nil {
+		return -1, resolver.ResolveInfo{}, fmt.Errorf("%s: no forwarder defined", q.Name)
+	}
+	return r.Resolve(ctx, q, buf)
+}
+
+// Watch checks list files for modifications every interval and reloads the
+// table when one changed, including files added with SetForwarders. If
+// interval is zero, DefaultForwarderWatchInterval is used. Watch returns when
+// ctx is done.
+func (t *ForwarderTable) Watch(ctx context.Context, interval time.Duration) {
+	if interval == 0 {
+		interval = DefaultForwarderWatchInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if !t.trie.Load().changed() {
+			continue
+		}
+		rules, err := t.reload()
+		if t.OnReload != nil {
+			t.OnReload(rules, err)
+		}
+	}
+}
+
+// Forwarders returns the static rules of the table.
+func (t *ForwarderTable) Forwarders() Forwarders {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.forwarders
+}
+
+// SetForwarders atomically replaces the static rules of the table. On error,
+// the current rules are kept.
+func (t *ForwarderTable) SetForwarders(f Forwarders) error {
+	t.mu.Lock()
+	prev := t.forwarders
+	t.forwarders = f
+	t.mu.Unlock()
+	if _, err := t.reload(); err != nil {
+		t.mu.Lock()
+		t.forwarders = prev
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// SetDynamic replaces the rules added at runtime, like the ones learned from
+// the host network configuration. Dynamic rules are evaluated after static
+// rules of the same specificity.
+func (t *ForwarderTable) SetDynamic(f Forwarders) error {
+	t.mu.Lock()
+	prev := t.dynamic
+	t.dynamic = f
+	t.mu.Unlock()
+	if _, err := t.reload(); err != nil {
+		t.mu.Lock()
+		t.dynamic = prev
+		t.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Dynamic returns the rules set with SetDynamic.
+func (t *ForwarderTable) Dynamic() Forwarders {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dynamic
+}
+
+// reload compiles the rules and swaps the table. On error, the current table
+// is kept.
+func (t *ForwarderTable) reload() (rules int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := make(Forwarders, 0, len(t.forwarders)+len(t.dynamic))
+	f = append(f, t.forwarders...)
+	f = append(f, t.dynamic...)
+	trie, err := compileForwarders(f)
+	if err != nil {
+		return 0, err
+	}
+	t.trie.Store(trie)
+	return trie.rules, nil
+}
+
+func compileForwarders(f Forwarders) (*forwarderTrie, error) {
+	t := &forwarderTrie{
+		root:  &forwarderNode{},
+		files: map[string]time.Time{},
+	}
+	for i := range f {
+		r := &f[i]
+		if r.File == "" {
+			t.insert(r.pattern(), r)
+			continue
+		}
+		fi, err := os.Stat(r.File)
+		if err != nil {
+			return nil, err
+		}
+		t.files[r.File] = fi.ModTime()
+		if err := t.load(r); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// load inserts the domains listed in r.File.
+func (t *forwarderTrie) load(r *Resolver) error {
+	fd, err := os.Open(r.File)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	s := bufio.NewScanner(fd)
+	for line := 1; s.Scan(); line++ {
+		pattern := s.Text()
+		if idx := strings.IndexByte(pattern, '#'); idx != -1 {
+			pattern = pattern[:idx]
+		}
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if strings.ContainsAny(pattern, " \t=") {
+			return fmt.Errorf("%s:%d: invalid domain: %s", r.File, line, pattern)
+		}
+		rule := r
+		if strings.HasPrefix(pattern, "!") {
+			rule = &Resolver{Exclude: true, Client: r.Client, QTypes: r.QTypes, Listen: r.Listen}
+		}
+		t.insert(pattern, rule)
+	}
+	return s.Err()
+}
+
+// insert adds r for pattern. The first rule inserted for a given pattern and
+// conditions wins.
+func (t *forwarderTrie) insert(pattern string, r *Resolver) {
+	pattern = strings.TrimPrefix(pattern, "!")
+	wildcard := strings.HasPrefix(pattern, "*.")
+	pattern = strings.TrimPrefix(pattern, "*.")
+	n := t.root
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(pattern, ".")), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if labels[i] == "" {
+			continue
+		}
+		if n.children == nil {
+			n.children = map[string]*forwarderNode{}
+		}
+		child := n.children[labels[i]]
+		if child == nil {
+			child = &forwarderNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	rules := &n.rules
+	if wildcard {
+		rules = &n.wildcards
+	}
+	for _, r2 := range *rules {
+		if r2.Client.String() == r.Client.String() && qtypesEqual(r2.QTypes, r.QTypes) &&
+			r2.Listen.String() == r.Listen.String() {
+			return
+		}
+	}
+	*rules = append(*rules, r)
+	t.rules++
+}
+
+func qtypesEqual(a, b []query.Type) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the first of rules matching the conditions of q. Like for
+// profiles, rules with conditions are evaluated before unconditional ones.
+func match(rules []*Resolver, q query.Query) *Resolver {
+	var def *Resolver
+	for _, r := range rules {
+		if !r.conditional() {
+			if def == nil {
+				def = r
+			}
+			continue
+		}
+		if r.matchConditions(q) {
+			return r
+		}
+	}
+	return def
+}
+
+// lookup returns the most specific rule matching q.
+func (t *forwarderTrie) lookup(q query.Query) *Resolver {
+	n := t.root
+	best := match(n.rules, q)
+	domain := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	for domain != "" {
+		var label string
+		if idx := strings.LastIndexByte(domain, '.'); idx != -1 {
+			label, domain = domain[idx+1:], domain[:idx]
+		} else {
+			label, domain = domain, ""
+		}
+		if n = n.children[label]; n == nil {
+			break
+		}
+		if r := match(n.rules, q); r != nil {
+			best = r
+		}
+		if domain != "" {
+			// There are labels left, a matching wildcard is more specific
+			// than the node rules.
+			if r := match(n.wildcards, q); r != nil {
+				best = r
+			}
+		}
+	}
+	return best
+}
+
+// changed returns true if one of the list files was modified.
+func (t *forwarderTrie) changed() bool {
+	for file, mtime := range t.files {
+		fi, err := os.Stat(file)
+		if err != nil || !fi.ModTime().Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+type namedResolver string
+
+func (r namedResolver) Resolve(ctx context.Context, q query.Query, buf []byte) (int, resolver.ResolveInfo, error) {
+	return 0, resolver.ResolveInfo{}, nil
+}
+
+func TestForwarderTable_Get(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "domestic.txt")
+	if err := os.WriteFile(list, []byte("# domestic domains\nexample.cn\n*.wild.cn\n!excluded.example.cn # comment\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var f Forwarders
+	for _, v := range []string{
+		"corp.example=10.0.0.1",
+		"*.lab.corp.example=10.0.0.2",
+		"!public.corp.example",
+		"file:" + list + "=10.0.0.3",
+		"example.cn=10.0.0.4", // shadowed by the list file, first defined wins
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tbl, err := NewForwarderTable(f, namedResolver("default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"corp.example.", "corp.example.=10.0.0.1"},
+		{"www.corp.example.", "corp.example.=10.0.0.1"},
+		{"lab.corp.example.", "corp.example.=10.0.0.1"},
+		{"host.lab.corp.example.", "*.lab.corp.example.=10.0.0.2"},
+		{"public.corp.example.", "default"},
+		{"www.public.corp.example.", "default"},
+		{"www.example.cn.", "file:" + list + "=10.0.0.3"},
+		{"wild.cn.", "default"},
+		{"a.wild.cn.", "file:" + list + "=10.0.0.3"},
+		{"excluded.example.cn.", "default"},
+		{"EXAMPLE.CN.", "file:" + list + "=10.0.0.3"},
+		{"other.example.", "default"},
+	}
+	rules := map[resolver.Resolver]string{namedResolver("default"): "default"}
+	for _, r := range f {
+		if r.Resolver != nil {
+			rules[r.Resolver] = r.String()
+		}
+	}
+	for _, tt := range tests {
+		if got := rules[tbl.Get(query.Query{Name: tt.domain})]; got != tt.want {
+			t.Errorf("Get(%s) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	// Reload on file change.
+	reloaded := make(chan int, 1)
+	tbl.OnReload = func(rules int, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		reloaded <- rules
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tbl.Watch(ctx, 10*time.Millisecond)
+	if err := os.WriteFile(list, []byte("other.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(list, time.Now(), time.Now().Add(time.Minute))
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("table not reloaded")
+	}
+	if got := rules[tbl.Get(query.Query{Name: "other.example."})]; got != "file:"+list+"=10.0.0.3" {
+		t.Errorf("Get(other.example.) after reload = %v", got)
+	}
+	if got := rules[tbl.Get(query.Query{Name: "www.example.cn."})]; got != "example.cn.=10.0.0.4" {
+		t.Errorf("Get(www.example.cn.) after reload = %v", got)
+	}
+}
+
+func TestForwarderTable_Conditions(t *testing.T) {
+	var f Forwarders
+	for _, v := range []string{
+		"corp.example=10.0.0.1",
+		"corp.example=10.0.0.2 client=192.168.100.0/24",
+		"168.192.in-addr.arpa=10.0.0.3 qtype=PTR",
+		"!corp.example client=aa:bb:cc:dd:ee:ff",
+		"corp.example=10.0.0.4 listen=:5353",
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(f) != 5 {
+		t.Fatalf("%d rules, want 5", len(f))
+	}
+	tbl, err := NewForwarderTable(f, namedResolver("default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := map[resolver.Resolver]string{namedResolver("default"): "default"}
+	for _, r := range f {
+		if r.Resolver != nil {
+			rules[r.Resolver] = r.String()
+		}
+	}
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:ff")
+	tests := []struct {
+		q    query.Query
+		want string
+	}{
+		{query.Query{Name: "www.corp.example.", PeerIP: net.ParseIP("10.1.1.1")}, "corp.example.=10.0.0.1"},
+		{query.Query{Name: "www.corp.example.", PeerIP: net.ParseIP("192.168.100.7")}, "corp.example.=10.0.0.2 client=192.168.100.0/24"},
+		{query.Query{Name: "www.corp.example.", PeerIP: net.ParseIP("10.1.1.1"), MAC: mac}, "default"},
+		{query.Query{Name: "1.0.168.192.in-addr.arpa.", Type: query.TypePTR}, "168.192.in-addr.arpa.=10.0.0.3 qtype=PTR"},
+		{query.Query{Name: "1.0.168.192.in-addr.arpa.", Type: query.TypeTXT}, "default"},
+		{query.Query{Name: "www.corp.example.", PeerIP: net.ParseIP("10.1.1.1"), Listener: "0.0.0.0:5353"}, "corp.example.=10.0.0.4 listen=:5353"},
+	}
+	for _, tt := range tests {
+		if got := rules[tbl.Get(tt.q)]; got != tt.want {
+			t.Errorf("Get(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestOrderConflicts(t *testing.T) {
+	var f Forwarders
+	for _, v := range []string{
+		"corp.example=10.0.0.1",
+		"lab.corp.example=10.0.0.2", // was shadowed by corp.example
+		"other.example=10.0.0.3",
+		"!public.corp.example",
+		"10.0.0.4",              // catch all
+		"late.example=10.0.0.5", // was shadowed by the catch all
+	} {
+		if err := f.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := OrderConflicts(f)
+	want := []string{
+		"lab.corp.example.=10.0.0.2 now takes precedence over corp.example.=10.0.0.1, defined before it",
+		"late.example.=10.0.0.5 now takes precedence over 10.0.0.4, defined before it",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OrderConflicts() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/nextdns/nextdns/resolver"
+)
+
+func TestNewResolver(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantDomain string
+		wantString string
+		wantGroup  bool
+		wantErr    bool
+	}{
+		{"10.0.0.1", "", "10.0.0.1", false, false},
+		{"corp.example=10.0.0.1,10.0.0.2", "corp.example.", "corp.example.=10.0.0.1,10.0.0.2", false, false},
+		{"https://doh.example#10.0.0.1&min-tls=1.3", "", "https://doh.example#10.0.0.1&min-tls=1.3", false, false},
+		{"corp.example=10.0.0.1,10.0.0.2 strategy=round-robin probe=dc.corp.example interval=30s",
+			"corp.example.", "corp.example.=10.0.0.1,10.0.0.2 strategy=round-robin probe=dc.corp.example interval=30s", true, false},
+		{"corp.example=10.0.0.1 strategy=foo", "", "", false, true},
+		{"corp.example=10.0.0.1 foo=bar", "", "", false, true},
+		{"corp.example=10.0.0.1 probe=dc.corp.example", "", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			r, err := newResolver(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newResolver() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if r.Domain != tt.wantDomain {
+				t.Errorf("Domain = %v, want %v", r.Domain, tt.wantDomain)
+			}
+			if r.String() != tt.wantString {
+				t.Errorf("String() = %v, want %v", r.String(), tt.wantString)
+			}
+			if _, ok := r.Resolver.(*resolver.Group); ok != tt.wantGroup {
+				t.Errorf("Resolver = %T, want group %v", r.Resolver, tt.wantGroup)
+			}
+		})
+	}
+}
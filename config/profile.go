@@ -1,23 +1,25 @@
 package config
 
 import (
-	"bytes"
 	"fmt"
 	"net"
 	"strings"
+	"time"
 )
 
 // profile defines a profile ID with some optional conditions.
 type profile struct {
-	ID      string
-	Prefix  *net.IPNet
-	MAC     net.HardwareAddr
-	DestIPs []net.IP
+	ID string
+	clientCondition
+
+	// Schedule, when set, restricts the profile to a weekly time window.
+	Schedule *schedule
 }
 
-// newConfig parses a configuration id with an optional condition.
+// newConfig parses a configuration id with an optional condition and
+// schedule, in the form [COND][@SCHEDULE]=ID.
 func newConfig(v string) (profile, error) {
-	idx := strings.IndexByte(v, '=')
+	idx := strings.LastIndexByte(v, '=')
 	if idx == -1 {
 		return profile{ID: v}, nil
 	}
@@ -25,68 +27,56 @@ func newConfig(v string) (profile, error) {
 	cond := strings.TrimSpace(v[:idx])
 	conf := strings.TrimSpace(v[idx+1:])
 	c := profile{ID: conf}
-
-	if _, ipnet, err := net.ParseCIDR(cond); err == nil {
-		c.Prefix = ipnet
-	} else if mac, err := net.ParseMAC(cond); err == nil {
-		c.MAC = mac
-	} else if iface, _ := net.InterfaceByName(cond); iface != nil {
-		addrs, _ := iface.Addrs()
-		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok {
-				c.DestIPs = append(c.DestIPs, ipnet.IP)
-			}
+	if at := strings.IndexByte(cond, '@'); at != -1 {
+		var err error
+		if c.Schedule, err = parseSchedule(strings.TrimSpace(cond[at+1:])); err != nil {
+			return profile{}, err
 		}
-	} else {
-		if err != nil {
-			return profile{}, fmt.Errorf("%s: invalid condition format or non-existent interface name", cond)
+		cond = strings.TrimSpace(cond[:at])
+		if cond == "" {
+			return c, nil
 		}
 	}
+	var err error
+	if c.clientCondition, err = parseClientCondition(cond); err != nil {
+		return profile{}, err
+	}
 	return c, nil
 }
 
-// Match returns true if the rule matches ip or interface and mac.
-func (p profile) Match(sourceIP, destIP net.IP, mac net.HardwareAddr) bool {
-	if p.Prefix != nil {
-		if sourceIP == nil {
-			return false
-		}
-		if !p.Prefix.Contains(sourceIP) {
-			return false
-		}
-	}
-	if len(p.MAC) > 0 {
-		if len(mac) == 0 {
-			return false
-		}
-		if !bytes.Equal(p.MAC, mac) {
-			return false
-		}
-	}
-	if len(p.DestIPs) > 0 {
-		if destIP == nil {
-			return false
-		}
-		for i := range p.DestIPs {
-			if p.DestIPs[i].Equal(destIP) {
-				return true
-			}
-		}
+// Match returns true if the rule matches cl at time now.
+func (p profile) Match(cl client, now time.Time) bool {
+	if p.Schedule != nil && !p.Schedule.Active(now) {
 		return false
 	}
-	return true
+	return p.clientCondition.Match(cl)
 }
 
 func (p profile) isDefault() bool {
-	return p.Prefix == nil && len(p.MAC) == 0 && len(p.DestIPs) == 0
+	return p.isZero()
+}
+
+// sameCriteria returns true if p and p2 are defined for the same conditions.
+func (p profile) sameCriteria(p2 profile) bool {
+	return p.clientCondition.sameCriteria(p2.clientCondition) &&
+		p.Schedule.String() == p2.Schedule.String()
 }
 
 func (p profile) String() string {
-	if p.MAC != nil {
-		return fmt.Sprintf("%s=%s", p.MAC, p.ID)
+	var cond string
+	switch {
+	case p.MAC != nil:
+		cond = p.MAC.String()
+	case p.Prefix != nil:
+		cond = p.Prefix.String()
+	case !p.isZero():
+		cond = p.raw
+	}
+	if p.Schedule != nil {
+		cond += "@" + p.Schedule.String()
 	}
-	if p.Prefix != nil {
-		return fmt.Sprintf("%s=%s", p.Prefix, p.ID)
+	if cond != "" {
+		return fmt.Sprintf("%s=%s", cond, p.ID)
 	}
 	return p.ID
 }
@@ -94,21 +84,69 @@ func (p profile) String() string {
 // Profiles is a list of profile with rules.
 type Profiles []profile
 
-// Get returns the configuration matching the ip and mac conditions.
+// Get returns the configuration matching the ip and mac conditions at the
+// current local time. Scheduled profiles are evaluated before the others, and
+// profiles with conditions before the default ones. Name and listen
+// conditions never match, use ProfileSelector to get them evaluated.
 func (ps *Profiles) Get(sourceIP, destIP net.IP, mac net.HardwareAddr) string {
-	var def string
-	for _, p := range *ps {
-		if p.Match(sourceIP, destIP, mac) {
+	return ps.get(client{SourceIP: sourceIP, DestIP: destIP, MAC: mac}, timeNow())
+}
+
+func (ps *Profiles) get(cl client, now time.Time) string {
+	var def, scheduledDef string
+	for _, scheduled := range []bool{true, false} {
+		for _, p := range *ps {
+			if (p.Schedule != nil) != scheduled || !p.Match(cl, now) {
+				continue
+			}
 			if p.isDefault() {
-				def = p.ID
+				if scheduled {
+					if scheduledDef == "" {
+						scheduledDef = p.ID
+					}
+				} else {
+					def = p.ID
+				}
 				continue
 			}
 			return p.ID
 		}
 	}
+	if scheduledDef != "" {
+		return scheduledDef
+	}
 	return def
 }
 
+// Static returns true if the same profile is used for all queries.
+func (ps *Profiles) Static() bool {
+	return len(*ps) == 1 && (*ps)[0].isDefault() && (*ps)[0].Schedule == nil
+}
+
+// scheduled returns true if some profiles have a schedule.
+func (ps *Profiles) scheduled() bool {
+	for _, p := range *ps {
+		if p.Schedule != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HasNameConditions returns true if some profiles are conditioned on client
+// names.
+func (ps *Profiles) HasNameConditions() bool {
+	for _, p := range *ps {
+		if p.Name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// timeNow is used by Get to evaluate schedules.
+var timeNow = time.Now
+
 // String is the method to format the flag's value
 func (ps *Profiles) String() string {
 	return fmt.Sprint(*ps)
@@ -133,10 +171,7 @@ func (ps *Profiles) Set(value string) error {
 	}
 	// Replace if c match the same criteria of an existing config
 	for i, _p := range *ps {
-		if (p.MAC != nil && _p.MAC != nil && bytes.Equal(p.MAC, _p.MAC)) ||
-			(p.DestIPs != nil && _p.DestIPs != nil && ipListEqual(p.DestIPs, _p.DestIPs)) ||
-			(p.Prefix != nil && _p.Prefix != nil && p.Prefix.String() == _p.Prefix.String()) ||
-			(p.MAC == nil && p.Prefix == nil && p.DestIPs == nil && _p.MAC == nil && _p.Prefix == nil && _p.DestIPs == nil) {
+		if p.sameCriteria(_p) {
 			(*ps)[i] = p
 			return nil
 		}
@@ -144,15 +179,3 @@ func (ps *Profiles) Set(value string) error {
 	*ps = append(*ps, p)
 	return nil
 }
-
-func ipListEqual(a, b []net.IP) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i := range a {
-		if !a[i].Equal(b[i]) {
-			return false
-		}
-	}
-	return true
-}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// NameResolver resolves the names of a client, like discovery.Resolver.
+type NameResolver interface {
+	LookupAddr(addr string) []string
+	LookupMAC(mac string) []string
+}
+
+const (
+	// DefaultProfileSelectorTTL is the default duration for which the
+	// profile selected for a client is memoized.
+	DefaultProfileSelectorTTL = time.Minute
+
+	// profileSelectorMaxEntries bounds the number of memoized clients.
+	profileSelectorMaxEntries = 4096
+)
+
+// ProfileSelector selects the profile of a client like Profiles.Get, with
+// support for name conditions resolved using Names. When profiles have name
+// conditions, selections are memoized per client for TTL so discovery lookups
+// and rule evaluation are not performed for every query. Profiles can be
+// replaced at runtime with SetProfiles.
+type ProfileSelector struct {
+	// Names resolves client names for name conditions. If nil, name
+	// conditions never match.
+	Names NameResolver
+
+	// TTL is the duration a selection is memoized. If zero,
+	// DefaultProfileSelectorTTL is used.
+	TTL time.Duration
+
+	set atomic.Pointer[profileSet]
+
+	mu    sync.Mutex
+	cache map[string]selection
+}
+
+type profileSet struct {
+	profiles  Profiles
+	static    bool
+	scheduled bool
+	hasNames  bool
+}
+
+type selection struct {
+	set     *profileSet
+	profile string
+	expires time.Time
+}
+
+// NewProfileSelector returns a selector for ps.
+func NewProfileSelector(ps Profiles) *ProfileSelector {
+	s := &ProfileSelector{}
+	s.SetProfiles(ps)
+	return s
+}
+
+// Profiles returns the profiles currently used.
+func (s *ProfileSelector) Profiles() Profiles {
+	return s.set.Load().profiles
+}
+
+// SetProfiles atomically replaces the profiles used by the selector.
+func (s *ProfileSelector) SetProfiles(ps Profiles) {
+	s.set.Store(&profileSet{
+		profiles:  ps,
+		static:    len(ps) == 0 || ps.Static(),
+		scheduled: ps.scheduled(),
+		hasNames:  ps.HasNameConditions(),
+	})
+	s.mu.Lock()
+	s.cache = nil
+	s.mu.Unlock()
+}
+
+// Get returns the profile for the client of q.
+func (s *ProfileSelector) Get(q query.Query) string {
+	set := s.set.Load()
+	if set.static {
+		if len(set.profiles) == 0 {
+			return ""
+		}
+		return set.profiles[0].ID
+	}
+	now := timeNow()
+	if !set.hasNames {
+		// Other conditions are cheap to evaluate, no need to memoize.
+		return set.profiles.get(queryClient(q), now)
+	}
+	key := string(q.PeerIP) + "|" + string(q.LocalIP) + "|" + string(q.MAC) + "|" + q.Listener
+	s.mu.Lock()
+	if sel, found := s.cache[key]; found && sel.set == set && now.Before(sel.expires) {
+		s.mu.Unlock()
+		return sel.profile
+	}
+	s.mu.Unlock()
+
+	cl := queryClient(q)
+	var names []string
+	var resolved bool
+	cl.Names = func() []string {
+		if !resolved && s.Names != nil {
+			resolved = true
+			if len(q.MAC) > 0 {
+				names = s.Names.LookupMAC(strings.ToLower(q.MAC.String()))
+			}
+			if len(names) == 0 && q.PeerIP != nil {
+				names = s.Names.LookupAddr(q.PeerIP.String())
+			}
+		}
+		return names
+	}
+	profile := set.profiles.get(cl, now)
+
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = DefaultProfileSelectorTTL
+	}
+	expires := now.Add(ttl)
+	if set.scheduled {
+		// Schedules have a minute granularity, re-evaluate at the next
+		// minute boundary at the latest.
+		if next := now.Truncate(time.Minute).Add(time.Minute); next.Before(expires) {
+			expires = next
+		}
+	}
+	s.mu.Lock()
+	if s.cache == nil || len(s.cache) >= profileSelectorMaxEntries {
+		s.cache = map[string]selection{}
+	}
+	s.cache[key] = selection{set: set, profile: profile, expires: expires}
+	s.mu.Unlock()
+	return profile
+}
@@ -2,7 +2,11 @@ package config
 
 import (
 	"net"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/query"
 )
 
 func TestProfiles_Get(t *testing.T) {
@@ -64,6 +68,40 @@ func TestProfiles_Get(t *testing.T) {
 			args{sourceIP: net.ParseIP("10.10.10.21"), destIP: net.ParseIP("10.10.10.1"), mac: parseMAC("84:89:ad:7c:e3:db")},
 			"profile3",
 		},
+		{"RangeMatch",
+			[]string{
+				"10.10.10.30-10.10.10.40=profile1",
+				"28:a0:2b=profile2",
+				"profile3",
+			},
+			args{sourceIP: net.ParseIP("10.10.10.40"), mac: parseMAC("84:89:ad:7c:e3:db")},
+			"profile1",
+		},
+		{"OUIMatch",
+			[]string{
+				"10.10.10.30-10.10.10.40=profile1",
+				"28:a0:2b=profile2",
+				"profile3",
+			},
+			args{sourceIP: net.ParseIP("10.10.10.41"), mac: parseMAC("28:a0:2b:56:e9:66")},
+			"profile2",
+		},
+		{"MACPrefixBitsNoMatch",
+			[]string{
+				"28:a0:2b:50:00:00/28=profile1",
+				"profile2",
+			},
+			args{mac: parseMAC("28:a0:2b:60:e9:66")},
+			"profile2",
+		},
+		{"NameWithoutResolver",
+			[]string{
+				"name:*-ipad=profile1",
+				"profile2",
+			},
+			args{mac: parseMAC("28:a0:2b:56:e9:66")},
+			"profile2",
+		},
 		{"MultipleDefaults",
 			[]string{
 				"profile1",
@@ -87,3 +125,157 @@ func TestProfiles_Get(t *testing.T) {
 		})
 	}
 }
+
+func TestProfiles_GetSchedule(t *testing.T) {
+	defer func(f func() time.Time) { timeNow = f }(timeNow)
+	mac, _ := net.ParseMAC("28:a0:2b:56:e9:66")
+	var ps Profiles
+	for _, def := range []string{
+		"profile1",
+		"28:a0:2b:56:e9:66=profile2",
+		"28:a0:2b:56:e9:66@Sun-Thu 21:00-07:00=profile3",
+		"@Sat,Sun 10:00-12:00=profile4",
+	} {
+		if err := ps.Set(def); err != nil {
+			t.Fatalf("Profiles.Set(%s) = Err %v", def, err)
+		}
+	}
+	tests := []struct {
+		name string
+		now  string
+		mac  net.HardwareAddr
+		want string
+	}{
+		{"ScheduleStart", "2026-10-18 21:00", mac, "profile3"},     // Sunday
+		{"ScheduleOvernight", "2026-10-19 06:59", mac, "profile3"}, // Monday
+		{"ScheduleEnd", "2026-10-19 07:00", mac, "profile2"},
+		{"ScheduleDayOff", "2026-10-17 06:00", mac, "profile2"}, // Saturday after Friday
+		{"DefaultSchedule", "2026-10-17 11:00", nil, "profile4"},
+		{"DefaultScheduleConditionWins", "2026-10-17 11:00", mac, "profile2"},
+		{"Default", "2026-10-17 12:00", nil, "profile1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, err := time.ParseInLocation("2006-01-02 15:04", tt.now, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			timeNow = func() time.Time { return now }
+			if got := ps.Get(nil, nil, tt.mac); got != tt.want {
+				t.Errorf("Profiles.Get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if ps.Static() {
+		t.Error("Profiles.Static() = true, want false")
+	}
+	if got, want := strings.Join(ps.Strings(), "|"), "profile1|28:a0:2b:56:e9:66=profile2|28:a0:2b:56:e9:66@Sun-Thu 21:00-07:00=profile3|@Sat,Sun 10:00-12:00=profile4"; got != want {
+		t.Errorf("Profiles.Strings() = %q, want %q", got, want)
+	}
+}
+
+type testNameResolver struct {
+	names   map[string][]string
+	lookups int
+}
+
+func (r *testNameResolver) LookupAddr(addr string) []string {
+	r.lookups++
+	return r.names[addr]
+}
+
+func (r *testNameResolver) LookupMAC(mac string) []string {
+	r.lookups++
+	return r.names[mac]
+}
+
+func TestProfileSelector_Get(t *testing.T) {
+	var ps Profiles
+	for _, def := range []string{"name:*-ipad=profile1", "profile2"} {
+		if err := ps.Set(def); err != nil {
+			t.Fatalf("Profiles.Set(%s) = Err %v", def, err)
+		}
+	}
+	names := &testNameResolver{names: map[string][]string{
+		"28:a0:2b:56:e9:66": {"Kids-iPad.local."},
+		"10.0.0.2":          {"laptop.lan."},
+	}}
+	s := NewProfileSelector(ps)
+	s.Names = names
+	mac, _ := net.ParseMAC("28:a0:2b:56:e9:66")
+	for i := 0; i < 3; i++ {
+		if got := s.Get(query.Query{PeerIP: net.ParseIP("10.0.0.1"), MAC: mac}); got != "profile1" {
+			t.Errorf("ProfileSelector.Get() = %v, want profile1", got)
+		}
+	}
+	if names.lookups != 1 {
+		t.Errorf("lookups = %d, want 1", names.lookups)
+	}
+	if got := s.Get(query.Query{PeerIP: net.ParseIP("10.0.0.2")}); got != "profile2" {
+		t.Errorf("ProfileSelector.Get() = %v, want profile2", got)
+	}
+}
+
+func TestProfileSelector_GetListen(t *testing.T) {
+	var ps Profiles
+	for _, def := range []string{"listen=:5353=guest", "listen=192.168.1.1:53=lan", "default"} {
+		if err := ps.Set(def); err != nil {
+			t.Fatalf("Profiles.Set(%s) = Err %v", def, err)
+		}
+	}
+	s := NewProfileSelector(ps)
+	tests := []struct {
+		listener string
+		localIP  string
+		want     string
+	}{
+		{"192.168.1.1:5353", "192.168.1.1", "guest"},
+		{"192.168.1.1:53", "192.168.1.1", "lan"},
+		{":53", "192.168.1.1", "lan"},
+		{":53", "10.0.0.1", "default"},
+	}
+	for _, tt := range tests {
+		q := query.Query{PeerIP: net.ParseIP("192.168.1.10"), LocalIP: net.ParseIP(tt.localIP), Listener: tt.listener}
+		if got := s.Get(q); got != tt.want {
+			t.Errorf("ProfileSelector.Get(%s, %s) = %v, want %v", tt.listener, tt.localIP, got, tt.want)
+		}
+	}
+	if len(s.cache) != 0 {
+		t.Errorf("ProfileSelector memoized %d selections without name conditions", len(s.cache))
+	}
+	if got, want := strings.Join(ps.Strings(), "|"), "listen=:5353=guest|listen=192.168.1.1:53=lan|default"; got != want {
+		t.Errorf("Profiles.Strings() = %q, want %q", got, want)
+	}
+}
+
+func TestParseClientCondition_MACPrefix(t *testing.T) {
+	tests := []struct {
+		cond    string
+		wantErr bool
+		bits    int
+	}{
+		{"28:a0:2b", false, 24},
+		{"28-a0", false, 16},
+		{"28:a0:2b:50:00:00/28", false, 28},
+		{"ab", true, 0},
+		{"ab:", true, 0},
+		{"28:a0-2b", true, 0},
+	}
+	for _, tt := range tests {
+		c, err := parseClientCondition(tt.cond)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClientCondition(%q) err = %v, wantErr %v", tt.cond, err, tt.wantErr)
+			continue
+		}
+		if c.MACPrefixBits != tt.bits {
+			t.Errorf("parseClientCondition(%q) bits = %d, want %d", tt.cond, c.MACPrefixBits, tt.bits)
+		}
+	}
+	iface, err := net.InterfaceByIndex(1)
+	if err != nil {
+		t.Skip("no interface")
+	}
+	if c, err := parseClientCondition(iface.Name); err != nil || c.MACPrefix != nil {
+		t.Errorf("parseClientCondition(%q) = %v, %v, want an interface condition", iface.Name, c.MACPrefix, err)
+	}
+}
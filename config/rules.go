@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Insert returns a copy of ps with the profile defined by value
+// inserted at index i. If i is negative or past the end, the profile is
+// appended. It is an error to insert a profile with the same conditions as an
+// existing one.
+func (ps Profiles) Insert(i int, value string) (Profiles, error) {
+	p, err := newConfig(value)
+	if err != nil {
+		return nil, err
+	}
+	for j, _p := range ps {
+		if p.sameCriteria(_p) {
+			return nil, fmt.Errorf("%s: conflicts with rule %d: %s", value, j+1, _p)
+		}
+	}
+	return insertRule(ps, i, p), nil
+}
+
+// Remove returns a copy of ps without the profile at index i.
+func (ps Profiles) Remove(i int) (Profiles, error) {
+	return removeRule(ps, i)
+}
+
+// Move returns a copy of ps with the profile at index from moved to index to.
+func (ps Profiles) Move(from, to int) (Profiles, error) {
+	return moveRule(ps, from, to)
+}
+
+// Insert returns a copy of f with the rule defined by value inserted at index
+// i. If i is negative or past the end, the rule is appended. It is an error to
+// insert a rule with the same domain and conditions as an existing one.
+func (f Forwarders) Insert(i int, value string) (Forwarders, error) {
+	r, err := newResolver(value)
+	if err != nil {
+		return nil, err
+	}
+	for j, _r := range f {
+		if r.key() == _r.key() {
+			return nil, fmt.Errorf("%s: conflicts with rule %d: %s", value, j+1, _r)
+		}
+	}
+	return insertRule(f, i, r), nil
+}
+
+// Remove returns a copy of f without the rule at index i.
+func (f Forwarders) Remove(i int) (Forwarders, error) {
+	return removeRule(f, i)
+}
+
+// Move returns a copy of f with the rule at index from moved to index to.
+func (f Forwarders) Move(from, to int) (Forwarders, error) {
+	return moveRule(f, from, to)
+}
+
+func insertRule[S ~[]E, E any](s S, i int, e E) S {
+	if i < 0 || i > len(s) {
+		i = len(s)
+	}
+	return slices.Insert(slices.Clone(s), i, e)
+}
+
+// removeRule and moveRule take 0-based indexes but report 1-based positions in
+// errors, like the rule commands.
+func removeRule[S ~[]E, E any](s S, i int) (S, error) {
+	if i < 0 || i >= len(s) {
+		return nil, fmt.Errorf("%d: no such rule", i+1)
+	}
+	return slices.Delete(slices.Clone(s), i, i+1), nil
+}
+
+func moveRule[S ~[]E, E any](s S, from, to int) (S, error) {
+	if from < 0 || from >= len(s) {
+		return nil, fmt.Errorf("%d: no such rule", from+1)
+	}
+	if to < 0 || to >= len(s) {
+		return nil, fmt.Errorf("%d: invalid position", to+1)
+	}
+	e := s[from]
+	s = slices.Delete(slices.Clone(s), from, from+1)
+	return slices.Insert(s, to, e), nil
+}
+
+// SaveRules replaces the profile and forwarder rules of the stored
+// configuration with ps and f. Other settings are left untouched, including
+// the ones only given as command line arguments to the running daemon.
+func (c *Config) SaveRules(ps Profiles, f Forwarders) error {
+	stored := Config{File: c.File}
+	fs := stored.flagSet("")
+	cs, err := fs.storer()
+	if err != nil {
+		return err
+	}
+	if err := cs.LoadConfig(fs.storage); err != nil {
+		return err
+	}
+	stored.ConfigDeprecated = nil
+	stored.Profile = ps
+	stored.Forwarders = f
+	return cs.SaveConfig(fs.storage)
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProfiles_InsertRemoveMove(t *testing.T) {
+	var ps Profiles
+	var err error
+	for _, def := range []string{"10.0.0.0/8=profile1", "profile2"} {
+		if ps, err = ps.Insert(-1, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ps, err = ps.Insert(0, "28:a0:2b:56:e9:66=profile3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ps.Insert(-1, "10.0.0.0/8=profile4"); err == nil {
+		t.Error("Insert with same conditions succeeded, want error")
+	}
+	if ps, err = ps.Move(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if ps, err = ps.Remove(0); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(ps.Strings(), "|"), "profile2|28:a0:2b:56:e9:66=profile3"; got != want {
+		t.Errorf("Profiles = %q, want %q", got, want)
+	}
+	if _, err := ps.Remove(2); err == nil || err.Error() != "3: no such rule" {
+		t.Errorf("Remove(2) err = %v, want 3: no such rule", err)
+	}
+}
+
+func TestConfig_SaveRules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nextdns.conf")
+	if err := os.WriteFile(file, []byte("profile abcdef\nlog-queries true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := Config{File: file}
+	var f Forwarders
+	if err := f.Set("corp.example=10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	ps, _ := Profiles{}.Insert(-1, "123456")
+	if err := c.SaveRules(ps, f); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"profile 123456\n", "forwarder corp.example.=10.0.0.1\n", "log-queries true\n"} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("saved config missing %q:\n%s", line, b)
+		}
+	}
+	if strings.Contains(string(b), "abcdef") {
+		t.Errorf("saved config kept previous profile:\n%s", b)
+	}
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var dayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// schedule is a weekly time window in the form [DAYS ]HH:MM-HH:MM where DAYS
+// is a comma separated list of days or day ranges (e.g. Mon-Fri,Sun). When
+// the end is before the start, the window ends the next day, DAYS being the
+// days the window starts. When the end equals the start, the window lasts 24
+// hours, 00:00-00:00 covering whole days.
+type schedule struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+	raw        string
+}
+
+func parseSchedule(s string) (*schedule, error) {
+	sc := &schedule{raw: s}
+	fields := strings.Fields(s)
+	var window string
+	switch len(fields) {
+	case 1:
+		window = fields[0]
+		for i := range sc.days {
+			sc.days[i] = true
+		}
+	case 2:
+		window = fields[1]
+		for _, r := range strings.Split(fields[0], ",") {
+			from, to, isRange := strings.Cut(r, "-")
+			if !isRange {
+				to = from
+			}
+			f, t := dayIndex(from), dayIndex(to)
+			if f == -1 || t == -1 {
+				return nil, fmt.Errorf("%s: invalid day range", r)
+			}
+			for d := f; ; d = (d + 1) % 7 {
+				sc.days[d] = true
+				if d == t {
+					break
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s: invalid schedule", s)
+	}
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid time window", window)
+	}
+	var err error
+	if sc.start, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if sc.end, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func dayIndex(name string) int {
+	for i, d := range dayNames {
+		if strings.EqualFold(d, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid time, HH:MM expected", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Active returns true if t is within the schedule. The location of t is used.
+func (sc *schedule) Active(t time.Time) bool {
+	min := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+	if sc.start < sc.end {
+		return sc.days[day] && min >= sc.start && min < sc.end
+	}
+	// The window spans midnight, or lasts 24 hours if start equals end: it
+	// is either started today or the previous day.
+	return (sc.days[day] && min >= sc.start) ||
+		(sc.days[(day+6)%7] && min < sc.end)
+}
+
+func (sc *schedule) String() string {
+	if sc == nil {
+		return ""
+	}
+	return sc.raw
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule_ActiveOvernight(t *testing.T) {
+	sc, err := parseSchedule("Mon-Fri 21:00-07:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		now  string
+		want bool
+	}{
+		{"2026-10-19 21:00", true},  // Monday night
+		{"2026-10-20 06:59", true},  // Tuesday morning, started Monday
+		{"2026-10-20 07:00", false}, // Tuesday, window ended
+		{"2026-10-23 23:00", true},  // Friday night
+		{"2026-10-24 06:00", true},  // Saturday morning, started Friday
+		{"2026-10-24 21:00", false}, // Saturday night
+		{"2026-10-18 22:00", false}, // Sunday night, Sunday is not in the days
+		{"2026-10-19 06:00", false}, // Monday morning, started Sunday
+	}
+	for _, tt := range tests {
+		t.Run(tt.now, func(t *testing.T) {
+			now, err := time.ParseInLocation("2006-01-02 15:04", tt.now, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sc.Active(now); got != tt.want {
+				t.Errorf("Active(%s %s) = %v, want %v", now.Weekday(), tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedule_ActiveWholeDay(t *testing.T) {
+	tests := []struct {
+		schedule string
+		now      string
+		want     bool
+	}{
+		{"Sat,Sun 00:00-00:00", "2026-10-24 00:00", true},  // Saturday midnight
+		{"Sat,Sun 00:00-00:00", "2026-10-25 23:59", true},  // Sunday night
+		{"Sat,Sun 00:00-00:00", "2026-10-26 00:00", false}, // Monday
+		{"Sat,Sun 00:00-00:00", "2026-10-23 23:59", false}, // Friday night
+		{"Mon 12:00-12:00", "2026-10-19 12:00", true},      // Monday noon
+		{"Mon 12:00-12:00", "2026-10-20 11:59", true},      // Tuesday morning, started Monday
+		{"Mon 12:00-12:00", "2026-10-20 12:00", false},     // Tuesday noon, window ended
+		{"Mon 12:00-12:00", "2026-10-19 11:59", false},     // Monday morning
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule+"/"+tt.now, func(t *testing.T) {
+			sc, err := parseSchedule(tt.schedule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now, err := time.ParseInLocation("2006-01-02 15:04", tt.now, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sc.Active(now); got != tt.want {
+				t.Errorf("Active(%s %s) = %v, want %v", now.Weekday(), tt.now, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,547 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nextdns/nextdns/host/service"
+)
+
+// tomlSections maps the keys of the TOML config sections to setting names.
+// Settings not listed here are set at the top level using their name.
+var tomlSections = []struct {
+	name string
+	keys [][2]string // key, setting
+}{
+	{"listeners", [][2]string{
+		{"addrs", "listen"},
+		{"setup-router", "setup-router"},
+		{"hijack-dns", "hijack-dns"},
+		{"hijack-dns-interfaces", "hijack-dns-interface"},
+		{"timeout", "timeout"},
+		{"max-inflight-requests", "max-inflight-requests"},
+	}},
+	{"profiles", [][2]string{
+		{"rules", "profile"},
+	}},
+	{"forwarders", [][2]string{
+		{"rules", "forwarder"},
+		{"split-dns", "split-dns"},
+	}},
+	{"cache", [][2]string{
+		{"size", "cache-size"},
+		{"max-age", "cache-max-age"},
+		{"max-ttl", "max-ttl"},
+	}},
+	{"discovery", [][2]string{
+		{"report-client-info", "report-client-info"},
+		{"dns", "discovery-dns"},
+		{"mdns", "mdns"},
+		{"use-hosts", "use-hosts"},
+	}},
+}
+
+// maxIncludeDepth limits nested includes.
+const maxIncludeDepth = 8
+
+// tomlStorer stores the configuration in a TOML file. Only the subset of TOML
+// needed to express the configuration is supported: top level keys, sections,
+// strings, booleans, integers and arrays of those.
+//
+// Settings are validated strictly: unknown sections or keys, duplicated keys
+// and values of the wrong type are reported with their file and line number.
+// The top level include key loads other TOML files, typically drop-in
+// directories of *.toml files, relative to the including file directory.
+type tomlStorer struct {
+	File string
+}
+
+type tomlValue struct {
+	kind  byte // 's'tring, 'b'ool, 'i'nteger or 'a'rray
+	s     string
+	array []tomlValue
+}
+
+type tomlError struct {
+	file string
+	line int
+	err  error
+}
+
+func (e *tomlError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.file, e.line, e.err)
+}
+
+func (e *tomlError) Unwrap() error {
+	return e.err
+}
+
+func (s tomlStorer) LoadConfig(c map[string]service.ConfigEntry) error {
+	if _, err := os.Stat(s.File); os.IsNotExist(err) {
+		return nil
+	}
+	return s.load(s.File, c, map[string]bool{}, 0)
+}
+
+func (s tomlStorer) load(file string, c map[string]service.ConfigEntry, loading map[string]bool, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested includes", file)
+	}
+	if loading[file] {
+		return fmt.Errorf("%s: include loop", file)
+	}
+	loading[file] = true
+	defer delete(loading, file)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var includes []string
+	err = parseTOML(file, f, func(line int, section, key string, v tomlValue) error {
+		if section == "" && key == "include" {
+			paths, err := v.strings()
+			if err != nil {
+				return err
+			}
+			includes = append(includes, paths...)
+			return nil
+		}
+		name, err := tomlSetting(section, key)
+		if err != nil {
+			return err
+		}
+		entry := c[name]
+		if entry == nil {
+			return fmt.Errorf("%s: unknown setting", key)
+		}
+		return setTOMLEntry(entry, v)
+	})
+	errs := []error{err}
+	for _, inc := range includes {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(file), inc)
+		}
+		files, err := tomlIncludeFiles(inc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: include: %v", file, err))
+			continue
+		}
+		for _, f := range files {
+			errs = append(errs, s.load(f, c, loading, depth+1))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tomlIncludeFiles returns the *.toml files of a directory or the files
+// matching a glob pattern, sorted.
+func tomlIncludeFiles(path string) ([]string, error) {
+	if st, err := os.Stat(path); err == nil && st.IsDir() {
+		path = filepath.Join(path, "*.toml")
+	} else if err == nil {
+		return []string{path}, nil
+	}
+	files, err := filepath.Glob(path)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func tomlSetting(section, key string) (string, error) {
+	if section == "" {
+		for _, s := range tomlSections {
+			for _, k := range s.keys {
+				if k[1] == key {
+					return "", fmt.Errorf("%s: must be set as %s in [%s]", key, k[0], s.name)
+				}
+			}
+		}
+		return key, nil
+	}
+	for _, s := range tomlSections {
+		if s.name != section {
+			continue
+		}
+		for _, k := range s.keys {
+			if k[0] == key {
+				return k[1], nil
+			}
+		}
+		return "", fmt.Errorf("%s: unknown key in [%s]", key, section)
+	}
+	return "", fmt.Errorf("%s: unknown section", section)
+}
+
+func setTOMLEntry(entry service.ConfigEntry, v tomlValue) error {
+	if _, ok := entry.(service.ConfigListEntry); ok {
+		values, err := v.strings()
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if err := entry.Set(value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	want := byte('s')
+	switch entry.(type) {
+	case service.ConfigFlag:
+		want = 'b'
+	case service.ConfigUint:
+		want = 'i'
+	}
+	if v.kind != want {
+		return fmt.Errorf("%s expected", tomlKindName(want))
+	}
+	return entry.Set(v.s)
+}
+
+func tomlKindName(kind byte) string {
+	switch kind {
+	case 'b':
+		return "boolean"
+	case 'i':
+		return "integer"
+	case 'a':
+		return "array"
+	default:
+		return "string"
+	}
+}
+
+// strings returns v as a list of strings, v being a string or an array of
+// strings.
+func (v tomlValue) strings() ([]string, error) {
+	switch v.kind {
+	case 's':
+		return []string{v.s}, nil
+	case 'a':
+		values := make([]string, 0, len(v.array))
+		for _, e := range v.array {
+			if e.kind != 's' {
+				return nil, errors.New("array of strings expected")
+			}
+			values = append(values, e.s)
+		}
+		return values, nil
+	}
+	return nil, errors.New("string or array of strings expected")
+}
+
+// parseTOML calls set for each key of r. Parsing continues after an invalid
+// line so all the errors are reported, joined.
+func parseTOML(file string, r io.Reader, set func(line int, section, key string, v tomlValue) error) error {
+	sc := bufio.NewScanner(r)
+	section := ""
+	skip := false // keys of an invalid section
+	seen := map[string]bool{}
+	var errs []error
+	fail := func(line int, err error) {
+		errs = append(errs, &tomlError{file: file, line: line, err: err})
+	}
+	for line := 1; sc.Scan(); line++ {
+		start := line
+		text := strings.TrimSpace(stripTOMLComment(sc.Text()))
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			section, skip = strings.TrimSpace(strings.Trim(text, "[]")), true
+			switch {
+			case !strings.HasSuffix(text, "]"):
+				fail(line, errors.New("invalid section header"))
+			case !isTOMLSection(section):
+				fail(line, fmt.Errorf("%s: unknown section", section))
+			case seen["["+section+"]"]:
+				fail(line, fmt.Errorf("[%s]: duplicated section", section))
+			default:
+				seen["["+section+"]"] = true
+				skip = false
+			}
+			continue
+		}
+		key, value, found := strings.Cut(text, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !found || !isTOMLBareKey(key) {
+			fail(line, errors.New("key = value expected"))
+			continue
+		}
+		// Arrays may span several lines.
+		for !tomlBalanced(value) && sc.Scan() {
+			line++
+			value += " " + strings.TrimSpace(stripTOMLComment(sc.Text()))
+		}
+		v, rest, err := parseTOMLValue(value)
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = fmt.Errorf("unexpected %q after value", rest)
+		}
+		switch {
+		case err != nil:
+			fail(start, fmt.Errorf("%s: %v", key, err))
+		case skip:
+		case seen[section+"."+key]:
+			fail(start, fmt.Errorf("%s: duplicated key", key))
+		default:
+			seen[section+"."+key] = true
+			if err := set(start, section, key, v); err != nil {
+				fail(start, err)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func isTOMLSection(name string) bool {
+	for _, s := range tomlSections {
+		if s.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isTOMLBareKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// stripTOMLComment removes the comment from line, ignoring # in strings.
+func stripTOMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// tomlBalanced returns false if s has unclosed brackets.
+func tomlBalanced(s string) bool {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+func parseTOMLValue(s string) (v tomlValue, rest string, err error) {
+	s = strings.TrimLeft(s, " \t")
+	switch {
+	case s == "":
+		return v, "", errors.New("missing value")
+	case s[0] == '"':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; c {
+			case '"':
+				return tomlValue{kind: 's', s: b.String()}, s[i+1:], nil
+			case '\\':
+				if i++; i == len(s) {
+					break
+				}
+				switch s[i] {
+				case '"', '\\':
+					b.WriteByte(s[i])
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					return v, "", fmt.Errorf("invalid escape sequence \\%c", s[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return v, "", errors.New("unterminated string")
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end == -1 {
+			return v, "", errors.New("unterminated string")
+		}
+		return tomlValue{kind: 's', s: s[1 : end+1]}, s[end+2:], nil
+	case s[0] == '[':
+		v.kind = 'a'
+		rest = s[1:]
+		for {
+			rest = strings.TrimLeft(rest, " \t")
+			if strings.HasPrefix(rest, "]") {
+				return v, rest[1:], nil
+			}
+			var e tomlValue
+			if e, rest, err = parseTOMLValue(rest); err != nil {
+				return v, "", err
+			}
+			if e.kind == 'a' {
+				return v, "", errors.New("nested arrays are not supported")
+			}
+			v.array = append(v.array, e)
+			rest = strings.TrimLeft(rest, " \t")
+			if strings.HasPrefix(rest, ",") {
+				rest = rest[1:]
+			} else if !strings.HasPrefix(rest, "]") {
+				return v, "", errors.New("unterminated array")
+			}
+		}
+	}
+	end := strings.IndexAny(s, " \t,]")
+	if end == -1 {
+		end = len(s)
+	}
+	word, rest := s[:end], s[end:]
+	switch word {
+	case "true", "false":
+		return tomlValue{kind: 'b', s: word}, rest, nil
+	}
+	if _, err := strconv.ParseUint(word, 10, 64); err == nil {
+		return tomlValue{kind: 'i', s: word}, rest, nil
+	}
+	return v, "", fmt.Errorf("invalid value %q (strings must be quoted)", word)
+}
+
+func (s tomlStorer) SaveConfig(c map[string]service.ConfigEntry) error {
+	if hasInclude, err := tomlHasInclude(s.File); err != nil {
+		return err
+	} else if hasInclude {
+		return fmt.Errorf("%s: configuration with includes must be edited manually", s.File)
+	}
+	dir := filepath.Dir(s.File)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.File, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := WriteTOML(f, c); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func tomlHasInclude(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	hasInclude := false
+	err = parseTOML(file, f, func(line int, section, key string, v tomlValue) error {
+		if section == "" && key == "include" {
+			hasInclude = true
+		}
+		return nil
+	})
+	return hasInclude, err
+}
+
+// WriteTOML writes the settings of c in TOML format, sorted and grouped in
+// sections. Settings with a default value are written commented out.
+func WriteTOML(w io.Writer, c map[string]service.ConfigEntry) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# NextDNS configuration, see nextdns run -h for the description of")
+	fmt.Fprintln(bw, "# each setting. Settings commented out use their default value.")
+	inSection := map[string]bool{}
+	for _, s := range tomlSections {
+		for _, k := range s.keys {
+			inSection[k[1]] = true
+		}
+	}
+	var names []string
+	for name := range c {
+		if !inSection[name] && name != "config" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintln(bw)
+	for _, name := range names {
+		writeTOMLEntry(bw, name, c[name])
+	}
+	for _, s := range tomlSections {
+		fmt.Fprintf(bw, "\n[%s]\n", s.name)
+		for _, k := range s.keys {
+			if entry := c[k[1]]; entry != nil {
+				writeTOMLEntry(bw, k[0], entry)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func writeTOMLEntry(w *bufio.Writer, key string, entry service.ConfigEntry) {
+	if entry, ok := entry.(service.ConfigListEntry); ok {
+		values := entry.Strings()
+		if len(values) == 0 {
+			fmt.Fprintf(w, "# %s = []\n", key)
+			return
+		}
+		fmt.Fprintf(w, "%s = [\n", key)
+		for _, v := range values {
+			fmt.Fprintf(w, "    %s,\n", strconv.Quote(v))
+		}
+		fmt.Fprintln(w, "]")
+		return
+	}
+	prefix := ""
+	if d, ok := entry.(service.ConfigDefaultTester); ok && d.IsDefault() {
+		prefix = "# "
+	}
+	value := strconv.Quote(entry.String())
+	switch entry.(type) {
+	case service.ConfigFlag, service.ConfigUint:
+		value = entry.String()
+	}
+	fmt.Fprintf(w, "%s%s = %s\n", prefix, key, value)
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, file, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfig_LoadTOML(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "nextdns.toml")
+	writeFile(t, file, `# main config
+include = "nextdns.d"
+log-queries = true
+
+[listeners]
+addrs = [
+    "127.0.0.1:53", # local
+    ":5353",
+]
+
+[profiles]
+rules = ["10.0.0.0/8=abcdef", 'ghijkl']
+
+[cache]
+size = "10MB"
+max-ttl = "5s"
+`)
+	writeFile(t, filepath.Join(dir, "nextdns.d", "10-fwd.toml"), `
+[forwarders]
+rules = "lan=192.168.1.1"
+`)
+	writeFile(t, filepath.Join(dir, "nextdns.d", "ignored.conf"), "garbage\n")
+
+	var c Config
+	if err := c.Load("test", []string{"-config-file", file}, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(c.Listens, " "), "127.0.0.1:53 :5353"; got != want {
+		t.Errorf("Listens = %q, want %q", got, want)
+	}
+	if got, want := strings.Join(c.Profile.Strings(), "|"), "10.0.0.0/8=abcdef|ghijkl"; got != want {
+		t.Errorf("Profile = %q, want %q", got, want)
+	}
+	if got, want := len(c.Forwarders), 1; got != want {
+		t.Errorf("len(Forwarders) = %d, want %d", got, want)
+	}
+	if !c.LogQueries || c.CacheSize != "10MB" || c.MaxTTL != 5*time.Second {
+		t.Errorf("LogQueries, CacheSize, MaxTTL = %v, %v, %v", c.LogQueries, c.CacheSize, c.MaxTTL)
+	}
+}
+
+func TestConfig_LoadTOMLErrors(t *testing.T) {
+	tests := []struct {
+		data, err string
+	}{
+		{"log-queries = \"yes\"\n", ":1: boolean expected"},
+		{"\nunknown = 1\n", ":2: unknown: unknown setting"},
+		{"listen = \"127.0.0.1\"\n", ":1: listen: must be set as addrs in [listeners]"},
+		{"[cache]\nsize = \"1MB\"\nsize = \"2MB\"\n", ":3: size: duplicated key"},
+		{"[caches]\n", ":1: caches: unknown section"},
+		{"[cache]\nsizes = \"1MB\"\n", ":2: sizes: unknown key in [cache]"},
+		{"[profiles]\nrules = [\n  \"abcdef\",\n  1,\n]\n", ":2: array of strings expected"},
+		{"debug = yes\n", ":1: debug: invalid value \"yes\" (strings must be quoted)"},
+		{"include = \"loop.toml\"\n", "include loop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "loop.toml")
+			writeFile(t, file, tt.data)
+			var c Config
+			err := c.Load("test", []string{"-config-file", file}, false)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load() err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestConfig_WriteTOML(t *testing.T) {
+	var c Config
+	if err := c.Load("test", []string{"-profile", "abcdef", "-listen", "127.0.0.1:53", "-log-queries"}, false); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := c.WriteTOML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"\nlog-queries = true\n", "\n# debug = false\n", "[listeners]\naddrs = [\n    \"127.0.0.1:53\",\n]\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("WriteTOML() does not contain %q:\n%s", want, buf.String())
+		}
+	}
+
+	// Round trip.
+	file := filepath.Join(t.TempDir(), "nextdns.toml")
+	writeFile(t, file, buf.String())
+	var c2 Config
+	if err := c2.Load("test", []string{"-config-file", file}, false); err != nil {
+		t.Fatal(err)
+	}
+	c.File = file
+	if changes := c.Changes(&c2); len(changes) > 0 {
+		t.Errorf("Changes after round trip = %v", changes)
+	}
+}
@@ -9,6 +9,18 @@ import (
 	"unicode"
 )
 
+// ParsePrivateRelay returns true if the private-relay policy s blocks iCloud
+// Private Relay.
+func ParsePrivateRelay(s string) (block bool, err error) {
+	switch s {
+	case "", "allow":
+		return false, nil
+	case "block":
+		return true, nil
+	}
+	return false, fmt.Errorf("%s: must be allow or block", s)
+}
+
 // ParseBytes returns the number of bytes express using human notation like 1MB
 // or 1.5GB.
 func ParseBytes(s string) (uint64, error) {
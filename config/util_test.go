@@ -35,3 +35,27 @@ func TestByteParsing(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePrivateRelay(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    bool
+		wantErr bool
+	}{
+		{"", false, false},
+		{"allow", false, false},
+		{"block", true, false},
+		{"deny", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePrivateRelay(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePrivateRelay() Err=%v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePrivateRelay() got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nextdns/nextdns/host/service"
+	"github.com/nextdns/nextdns/resolver/endpoint"
+)
+
+// Validate checks the configuration stored in file, or the system's
+// configuration file if empty, and returns all the errors found. Each setting
+// is parsed the same way as when the daemon starts. Errors are prefixed with
+// the file name and line number.
+func Validate(file string) []error {
+	if file == "" {
+		var c Config
+		cs, err := c.flagSet("").storer()
+		if err != nil {
+			return []error{err}
+		}
+		cf, ok := cs.(interface{ ConfigFile() string })
+		if !ok {
+			return []error{errors.New("configuration is not stored in a file")}
+		}
+		file = cf.ConfigFile()
+	}
+	var c Config
+	fs := c.flagSet("nextdns config validate") // sets the defaults
+	var errs []error
+	if strings.HasSuffix(file, ".toml") {
+		err := tomlStorer{File: file}.load(file, fs.storage, map[string]bool{}, 0)
+		errs = flattenErrors(err)
+	} else {
+		errs = validateFile(file, fs.storage)
+	}
+	if _, err := os.Stat(file); err != nil {
+		return errs
+	}
+	if len(c.ConfigDeprecated) > 0 {
+		c.Profile = append(c.Profile, c.ConfigDeprecated...)
+	}
+	for _, err := range c.check() {
+		errs = append(errs, fmt.Errorf("%s: %v", file, err))
+	}
+	return errs
+}
+
+// validateFile loads a file in the "name value" format, reporting unknown and
+// invalid settings.
+func validateFile(file string, c map[string]service.ConfigEntry) []error {
+	f, err := os.Open(file)
+	if err != nil {
+		return []error{err}
+	}
+	defer f.Close()
+	var errs []error
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(text, " ")
+		entry := c[name]
+		if entry == nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: unknown setting", file, line, name))
+			continue
+		}
+		if err := entry.Set(strings.TrimSpace(value)); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: %v", file, line, name, err))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// check validates the settings only parsed when the daemon starts.
+func (c *Config) check() []error {
+	var errs []error
+	if _, err := ParseBytes(c.CacheSize); err != nil {
+		errs = append(errs, fmt.Errorf("cache-size: %v", err))
+	}
+	if c.UpstreamTLS != "" {
+		if _, err := endpoint.ParseTLSOptions(c.UpstreamTLS); err != nil {
+			errs = append(errs, fmt.Errorf("upstream-tls: %v", err))
+		}
+	}
+	if c.UpstreamSource != "" && net.ParseIP(c.UpstreamSource) == nil {
+		errs = append(errs, fmt.Errorf("upstream-source: %s: invalid IP", c.UpstreamSource))
+	}
+	if c.UpstreamProxy != "" {
+		if _, err := url.Parse(c.UpstreamProxy); err != nil {
+			errs = append(errs, fmt.Errorf("upstream-proxy: %v", err))
+		}
+	}
+	if _, err := ParsePrivateRelay(c.PrivateRelay); err != nil {
+		errs = append(errs, fmt.Errorf("private-relay: %v", err))
+	}
+	return errs
+}
+
+func flattenErrors(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, err := range j.Unwrap() {
+			errs = append(errs, flattenErrors(err)...)
+		}
+		return errs
+	}
+	return []error{err}
+}
+
+// Export returns the settings of c by name, for JSON encoding. List settings
+// are exported as arrays of strings, flags as booleans and integers as
+// numbers.
+func (c *Config) Export() map[string]interface{} {
+	m := map[string]interface{}{}
+	for name, entry := range c.flagSet("").storage {
+		if name == "config" {
+			// Deprecated alias of profile.
+			continue
+		}
+		switch entry := entry.(type) {
+		case service.ConfigListEntry:
+			values := entry.Strings()
+			if values == nil {
+				values = []string{}
+			}
+			m[name] = values
+		case service.ConfigFlag:
+			m[name] = *entry.Value
+		case service.ConfigUint:
+			m[name] = *entry.Value
+		default:
+			m[name] = entry.String()
+		}
+	}
+	return m
+}
+
+// DiffExport returns the lines of a diff between two exported configurations,
+// the settings of a prefixed by - and those of b by +, sorted by name.
+func DiffExport(a, b map[string]interface{}) []string {
+	names := map[string]bool{}
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	var lines []string
+	for _, name := range sorted {
+		va, vb := exportStrings(a[name]), exportStrings(b[name])
+		if strings.Join(va, "\n") == strings.Join(vb, "\n") {
+			continue
+		}
+		for _, v := range va {
+			lines = append(lines, fmt.Sprintf("- %s %s", name, v))
+		}
+		for _, v := range vb {
+			lines = append(lines, fmt.Sprintf("+ %s %s", name, v))
+		}
+	}
+	return lines
+}
+
+func exportStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []string:
+		return v
+	case []interface{}:
+		s := make([]string, 0, len(v))
+		for _, e := range v {
+			s = append(s, fmt.Sprint(e))
+		}
+		return s
+	case float64:
+		// Numbers decoded from JSON.
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	}
+	return []string{fmt.Sprint(v)}
+}
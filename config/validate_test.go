@@ -0,0 +1,54 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "nextdns.conf")
+	writeFile(t, file, "# comment\n"+
+		"profile abcdef\n"+
+		"log-queries maybe\n"+
+		"unknown value\n"+
+		"cache-size 10XB\n"+
+		"max-ttl 5\n"+
+		"private-relay deny\n")
+	var got []string
+	for _, err := range Validate(file) {
+		got = append(got, strings.TrimPrefix(err.Error(), file))
+	}
+	want := []string{
+		":3: log-queries: maybe: invalid bool value",
+		":4: unknown: unknown setting",
+		":6: max-ttl: time: missing unit in duration \"5\"",
+		": cache-size: unknown unit name: xb",
+		": private-relay: deny: must be allow or block",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Validate() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("Validate()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDiffExport(t *testing.T) {
+	a := map[string]interface{}{"profile": []interface{}{"abcdef"}, "max-ttl": "0s", "cache-size": "10MB"}
+	b := map[string]interface{}{"profile": []interface{}{"abcdef", "ghijkl"}, "max-ttl": "5s", "cache-size": "10MB"}
+	got := DiffExport(a, b)
+	want := []string{
+		"- max-ttl 0s",
+		"+ max-ttl 5s",
+		"- profile abcdef",
+		"+ profile abcdef",
+		"+ profile ghijkl",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffExport() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/nextdns/nextdns/host"
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// fallbackDomains is the list of domains resolved while on plain DNS fallback
+// when strict fallback is enabled. It covers connectivity checks performed by
+// common OSes to detect captive portals, and time synchronization servers
+// needed to get a valid clock before TLS can be established.
+var fallbackDomains = []string{
+	// Captive portal detection.
+	"captive.apple.com",
+	"www.appleiphonecell.com",
+	"connectivitycheck.gstatic.com",
+	"connectivitycheck.android.com",
+	"clients1.google.com",
+	"clients3.google.com",
+	"www.msftconnecttest.com",
+	"www.msftncsi.com",
+	"dns.msftncsi.com",
+	"detectportal.firefox.com",
+	"nmcheck.gnome.org",
+	"network-test.debian.org",
+	"connectivity-check.ubuntu.com",
+
+	// Time synchronization.
+	"pool.ntp.org",
+	"time.apple.com",
+	"time.windows.com",
+	"time.google.com",
+	"time.cloudflare.com",
+	"time.nist.gov",
+	"ntp.ubuntu.com",
+}
+
+// fallbackProvider parses spec and returns a provider for the fallback
+// endpoints it describes. A nil provider is returned if fallback is disabled.
+//
+// The spec is a comma separated list of server addresses as understood by
+// endpoint.New. The special value "system" is expanded at query time with the
+// DNS servers of the host, followed by the NextDNS anycast IP. The value
+// "none" disables fallback.
+func fallbackProvider(spec string) (endpoint.Provider, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "none", "disabled":
+		return nil, nil
+	case "":
+		spec = "system"
+	}
+	// A nil entry stands for the system servers, expanded at query time so
+	// the configured order is kept.
+	var entries []endpoint.Endpoint
+	var system bool
+	for _, addr := range strings.Split(spec, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "system" {
+			system = true
+			entries = append(entries, nil)
+			continue
+		}
+		e, err := endpoint.New(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid fallback server: %v", addr, err)
+		}
+		entries = append(entries, e)
+	}
+	if !system {
+		return endpoint.StaticProvider(entries), nil
+	}
+	return endpoint.ProviderFunc(func(ctx context.Context) ([]endpoint.Endpoint, error) {
+		var endpoints []endpoint.Endpoint
+		for _, e := range entries {
+			if e != nil {
+				endpoints = append(endpoints, e)
+				continue
+			}
+			for _, ip := range host.DNS() {
+				endpoints = append(endpoints, &endpoint.DNSEndpoint{
+					Addr: net.JoinHostPort(ip, "53"),
+				})
+			}
+			// Add NextDNS anycast IP in case none of the system DNS works or
+			// we did not find any.
+			endpoints = append(endpoints, &endpoint.DNSEndpoint{
+				Addr: "45.90.28.0:53",
+			})
+		}
+		return endpoints, nil
+	}), nil
+}
+
+// fallbackAllowList returns a function reporting if a query can be sent over
+// plain DNS when strict fallback is enabled. Extra domains are allowed in
+// addition to the builtin fallbackDomains.
+func fallbackAllowList(extra []string) func(q query.Query) bool {
+	domains := make(map[string]struct{}, len(fallbackDomains)+len(extra))
+	for _, list := range [][]string{fallbackDomains, extra} {
+		for _, d := range list {
+			d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+			if d != "" {
+				domains[d] = struct{}{}
+			}
+		}
+	}
+	return func(q query.Query) bool {
+		name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+		for name != "" {
+			if _, found := domains[name]; found {
+				return true
+			}
+			idx := strings.IndexByte(name, '.')
+			if idx == -1 {
+				break
+			}
+			name = name[idx+1:]
+		}
+		return false
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+func Test_fallbackProvider(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []string
+		wantNil bool
+		wantErr bool
+	}{
+		{spec: "none", wantNil: true},
+		{spec: "disabled", wantNil: true},
+		{spec: "1.2.3.4", want: []string{"1.2.3.4:53"}},
+		{spec: "1.2.3.4:5353, https://doh.example.com", want: []string{"1.2.3.4:5353", "https://doh.example.com"}},
+		{spec: "not-an-ip", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			p, err := fallbackProvider(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fallbackProvider() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (p == nil) != tt.wantNil {
+				t.Fatalf("fallbackProvider() = %v, wantNil %v", p, tt.wantNil)
+			}
+			if p == nil {
+				return
+			}
+			endpoints, _ := p.GetEndpoints(context.Background())
+			var got []string
+			for _, e := range endpoints {
+				got = append(got, e.String())
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("GetEndpoints() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("GetEndpoints()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_fallbackAllowList(t *testing.T) {
+	allow := fallbackAllowList([]string{"portal.hotel.example."})
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"captive.apple.com.", true},
+		{"CAPTIVE.apple.com.", true},
+		{"0.pool.ntp.org.", true},
+		{"portal.hotel.example.", true},
+		{"login.portal.hotel.example.", true},
+		{"hotel.example.", false},
+		{"example.com.", false},
+		{"apple.com.", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allow(query.Query{Name: tt.name}); got != tt.want {
+				t.Errorf("allow(%s) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fallbackProvider_order(t *testing.T) {
+	p, err := fallbackProvider("1.2.3.4, system, 5.6.7.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, _ := p.GetEndpoints(context.Background())
+	var got []string
+	for _, e := range endpoints {
+		got = append(got, e.String())
+	}
+	// System servers depend on the host, only check they stay in place.
+	if n := len(got); n < 3 || got[0] != "1.2.3.4:53" || got[n-2] != "45.90.28.0:53" || got[n-1] != "5.6.7.8:53" {
+		t.Errorf("GetEndpoints() = %v, want 1.2.3.4:53, system servers, 45.90.28.0:53, 5.6.7.8:53", got)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// serveHealth serves the health endpoint used by container orchestrators on
+// addr. GET /health returns 200 while the proxy is serving queries and 503
+// otherwise.
+func serveHealth(addr string, p *proxySvc) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if !p.Running() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "stopped")
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	s := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if err := s.ListenAndServe(); err != nil {
+		p.log.Errorf("Health endpoint: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDNSGuardNotSupported is returned by DNSGuard.Run when the system DNS
+// configuration is not managed using /etc/resolv.conf.
+var ErrDNSGuardNotSupported = errors.New("DNS guard not supported on this system")
+
+const (
+	dnsGuardMinBackoff = time.Second
+	dnsGuardMaxBackoff = 5 * time.Minute
+)
+
+// DNSGuardState is the state of a DNSGuard.
+type DNSGuardState struct {
+	// Active is true while the guard is watching the system DNS configuration.
+	Active bool `json:"active"`
+
+	// Repairs is the number of times the configuration was re-applied.
+	Repairs int `json:"repairs"`
+
+	// LastChange is the last time the configuration was found changed.
+	LastChange time.Time `json:"last_change,omitempty"`
+
+	// LastError is the error of the last repair, if it failed.
+	LastError string `json:"last_error,omitempty"`
+
+	// Backoff is the delay before the next repair is allowed.
+	Backoff string `json:"backoff,omitempty"`
+}
+
+// DNSGuard watches the system DNS configuration set by SetDNS and re-applies
+// it when another program, like a DHCP or VPN client, overwrites it. It is only
+// supported on systems configured using /etc/resolv.conf. The backup of the
+// original resolv.conf made by SetDNS is kept as is, so ResetDNS still
+// restores the configuration from before activation. Nothing is repaired while
+// the system is not activated, so the guard can be run whether or not SetDNS
+// was called, and does not undo ResetDNS.
+type DNSGuard struct {
+	// DNS is the DNS server IP set with SetDNS.
+	DNS string
+
+	// OnRepair is called after the configuration was found changed and
+	// re-applied, with the error of the repair if any.
+	OnRepair func(err error)
+
+	mu    sync.Mutex
+	state DNSGuardState
+}
+
+// State returns the current state of the guard.
+func (g *DNSGuard) State() DNSGuardState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.state
+}
+
+// Run watches the DNS configuration until ctx is done. Repairs are delayed
+// with an exponential backoff when they keep being overwritten, to not fight
+// endlessly with another program.
+func (g *DNSGuard) Run(ctx context.Context) error {
+	if !dnsGuardSupported() {
+		return ErrDNSGuardNotSupported
+	}
+	notify := make(chan struct{}, 1)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- watchResolvConf(ctx, notify)
+	}()
+	g.mu.Lock()
+	g.state.Active = true
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.state.Active = false
+		g.mu.Unlock()
+	}()
+
+	backoff := dnsGuardMinBackoff
+	var lastRepair time.Time
+	// Check once at startup in case it changed before we started watching.
+	notify <- struct{}{}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errC:
+			return err
+		case <-notify:
+		}
+		if time.Since(lastRepair) > 2*dnsGuardMaxBackoff {
+			backoff = dnsGuardMinBackoff
+			g.mu.Lock()
+			g.state.Backoff = ""
+			g.mu.Unlock()
+		}
+		for resolvConfActivated() && !resolvConfUses(g.DNS) {
+			err := setupResolvConf(g.DNS)
+			lastRepair = time.Now()
+			g.mu.Lock()
+			g.state.Repairs++
+			g.state.LastChange = lastRepair
+			g.state.LastError = ""
+			if err != nil {
+				g.state.LastError = err.Error()
+			}
+			g.state.Backoff = backoff.String()
+			g.mu.Unlock()
+			if g.OnRepair != nil {
+				g.OnRepair(err)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > dnsGuardMaxBackoff {
+				backoff = dnsGuardMaxBackoff
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// +build freebsd openbsd netbsd dragonfly
+
+package host
+
+import (
+	"context"
+	"time"
+)
+
+func dnsGuardSupported() bool {
+	return true
+}
+
+// watchResolvConf sends to notify periodically so resolv.conf is checked.
+func watchResolvConf(ctx context.Context, notify chan<- struct{}) error {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
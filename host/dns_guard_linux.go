@@ -0,0 +1,78 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func dnsGuardSupported() bool {
+	// With systemd-resolved, resolv.conf is not rewritten by SetDNS.
+	return !resolvedManaged()
+}
+
+// watchResolvConf sends to notify when resolv.conf is changed, using inotify
+// on its directory as the file is usually replaced rather than written. As the
+// file may be a symlink to a file changed elsewhere, it is also checked
+// periodically.
+func watchResolvConf(ctx context.Context, notify chan<- struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+	const mask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	if _, err := unix.InotifyAddWatch(fd, filepath.Dir(resolvFile), mask); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				f.Close()
+				return
+			case <-ticker.C:
+				signalNotify(notify)
+			}
+		}
+	}()
+	name := []byte(filepath.Base(resolvFile))
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += unix.SizeofInotifyEvent
+			end := off + int(ev.Len)
+			if end > n {
+				break
+			}
+			if bytes.Equal(bytes.TrimRight(buf[off:end], "\x00"), name) {
+				signalNotify(notify)
+			}
+			off = end
+		}
+	}
+}
+
+// signalNotify sends to notify without blocking.
+func signalNotify(notify chan<- struct{}) {
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
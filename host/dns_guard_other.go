@@ -0,0 +1,27 @@
+// +build !linux,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package host
+
+import (
+	"context"
+)
+
+func dnsGuardSupported() bool {
+	return false
+}
+
+func watchResolvConf(ctx context.Context, notify chan<- struct{}) error {
+	return ErrDNSGuardNotSupported
+}
+
+func resolvConfActivated() bool {
+	return false
+}
+
+func resolvConfUses(dns string) bool {
+	return true
+}
+
+func setupResolvConf(dns string) error {
+	return ErrDNSGuardNotSupported
+}
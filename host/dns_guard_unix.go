@@ -0,0 +1,18 @@
+// +build linux freebsd openbsd netbsd dragonfly
+
+package host
+
+import "os"
+
+// resolvConfActivated returns true if resolv.conf was set up by SetDNS and not
+// restored by ResetDNS since.
+func resolvConfActivated() bool {
+	_, err := os.Stat(resolvBackupFile)
+	return err == nil
+}
+
+// resolvConfUses returns true if dns is the only nameserver of resolv.conf.
+func resolvConfUses(dns string) bool {
+	servers := resolvConfDNS(resolvFile).Servers
+	return len(servers) == 1 && servers[0] == dns
+}
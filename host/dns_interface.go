@@ -0,0 +1,16 @@
+package host
+
+// InterfaceDNS is the DNS configuration learned for a network interface.
+type InterfaceDNS struct {
+	// Interface is the interface name, empty when the source does not tell.
+	Interface string `json:"interface,omitempty"`
+
+	// Servers is the list of DNS server IPs.
+	Servers []string `json:"servers"`
+
+	// Domains is the list of search and routing domains.
+	Domains []string `json:"domains"`
+
+	// Source describes where the configuration was found.
+	Source string `json:"source"`
+}
@@ -0,0 +1,8 @@
+// +build freebsd openbsd netbsd dragonfly
+
+package host
+
+// InterfacesDNS returns the DNS configuration of the host per interface.
+func InterfacesDNS() []InterfaceDNS {
+	return mergeInterfacesDNS([]InterfaceDNS{resolvConfDNS(resolvFile)})
+}
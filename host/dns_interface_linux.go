@@ -0,0 +1,132 @@
+package host
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// InterfacesDNS returns the DNS configuration of the host per interface as
+// found in NetworkManager, systemd-networkd, dhcpcd and resolv.conf.
+func InterfacesDNS() []InterfaceDNS {
+	var all []InterfaceDNS
+	all = append(all, nmcliInterfacesDNS()...)
+	all = append(all, networkdInterfacesDNS()...)
+	if ifaces, err := net.Interfaces(); err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			all = append(all, dhcpcdInterfaceDNS(iface.Name))
+		}
+	}
+	all = append(all, resolvConfDNS(resolvFile))
+	return mergeInterfacesDNS(all)
+}
+
+func nmcliInterfacesDNS() (dns []InterfaceDNS) {
+	b, err := exec.Command("nmcli", "-t", "-f", "GENERAL.DEVICE,IP4.DNS,IP4.DOMAIN,IP6.DNS,IP6.DOMAIN", "dev", "show").Output()
+	if err != nil {
+		return nil
+	}
+	var cur *InterfaceDNS
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		key, value, found := strings.Cut(s.Text(), ":")
+		if !found {
+			continue
+		}
+		// Terse mode escapes colons in values (IPv6).
+		value = strings.ReplaceAll(value, `\:`, ":")
+		key, _, _ = strings.Cut(key, "[")
+		switch key {
+		case "GENERAL.DEVICE":
+			dns = append(dns, InterfaceDNS{Interface: value, Source: "NetworkManager"})
+			cur = &dns[len(dns)-1]
+		case "IP4.DNS", "IP6.DNS":
+			if cur != nil && value != "" {
+				cur.Servers = appendUniq(cur.Servers, value)
+			}
+		case "IP4.DOMAIN", "IP6.DOMAIN":
+			if cur != nil && value != "" {
+				cur.Domains = appendUniq(cur.Domains, value)
+			}
+		}
+	}
+	return dns
+}
+
+func networkdInterfacesDNS() (dns []InterfaceDNS) {
+	const linkDir = "/run/systemd/netif/links"
+	links, err := os.ReadDir(linkDir)
+	if err != nil {
+		return nil
+	}
+	for _, link := range links {
+		idx, err := strconv.Atoi(link.Name())
+		if err != nil {
+			continue
+		}
+		iface, err := net.InterfaceByIndex(idx)
+		if err != nil {
+			continue
+		}
+		i := InterfaceDNS{Interface: iface.Name, Source: "systemd-networkd"}
+		for _, file := range []string{
+			filepath.Join(linkDir, link.Name()),
+			filepath.Join("/run/systemd/netif/leases", link.Name()),
+		} {
+			f, err := os.Open(file)
+			if err != nil {
+				continue
+			}
+			s := bufio.NewScanner(f)
+			for s.Scan() {
+				key, value, found := strings.Cut(s.Text(), "=")
+				if !found {
+					continue
+				}
+				switch key {
+				case "DNS":
+					i.Servers = appendUniq(i.Servers, strings.Fields(value)...)
+				case "DOMAINS", "ROUTE_DOMAINS", "DOMAINNAME":
+					i.Domains = appendUniq(i.Domains, strings.Fields(value)...)
+				}
+			}
+			f.Close()
+		}
+		dns = append(dns, i)
+	}
+	return dns
+}
+
+func dhcpcdInterfaceDNS(iface string) (i InterfaceDNS) {
+	i.Interface = iface
+	i.Source = "dhcpcd"
+	b, err := exec.Command("dhcpcd", "-U", iface).Output()
+	if err != nil {
+		return
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		key, value, found := strings.Cut(s.Text(), "=")
+		if !found {
+			continue
+		}
+		if v, err := strconv.Unquote(value); err == nil {
+			value = v
+		}
+		switch key {
+		case "domain_name_servers":
+			i.Servers = appendUniq(i.Servers, strings.Fields(value)...)
+		case "domain_name", "domain_search":
+			i.Domains = appendUniq(i.Domains, strings.Fields(value)...)
+		}
+	}
+	return
+}
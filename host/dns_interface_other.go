@@ -0,0 +1,8 @@
+// +build !linux,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package host
+
+// InterfacesDNS returns the DNS configuration of the host per interface.
+func InterfacesDNS() []InterfaceDNS {
+	return nil
+}
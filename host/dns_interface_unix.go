@@ -0,0 +1,54 @@
+// +build linux freebsd openbsd netbsd dragonfly
+
+package host
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// mergeInterfacesDNS merges entries for the same interface and source.
+func mergeInterfacesDNS(in []InterfaceDNS) []InterfaceDNS {
+	var out []InterfaceDNS
+next:
+	for _, i := range in {
+		if len(i.Servers) == 0 {
+			continue
+		}
+		for j := range out {
+			if out[j].Interface == i.Interface && out[j].Source == i.Source {
+				out[j].Servers = appendUniq(out[j].Servers, i.Servers...)
+				out[j].Domains = appendUniq(out[j].Domains, i.Domains...)
+				continue next
+			}
+		}
+		out = append(out, i)
+	}
+	return out
+}
+
+// resolvConfDNS returns the nameservers and search domains of a resolv.conf
+// file.
+func resolvConfDNS(file string) (i InterfaceDNS) {
+	i.Source = file
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			i.Servers = appendUniq(i.Servers, fields[1])
+		case "domain", "search":
+			i.Domains = appendUniq(i.Domains, fields[1:]...)
+		}
+	}
+	return
+}
@@ -52,6 +52,12 @@ func DNS() []string {
 }
 
 func SetDNS(dns string) error {
+	if resolvedManaged() {
+		if err := setupResolved(dns); err != nil {
+			return fmt.Errorf("setup systemd-resolved: %v", err)
+		}
+		return nil
+	}
 	if err := setupResolvConf(dns); err != nil {
 		return fmt.Errorf("setup resolv.conf: %v", err)
 	}
@@ -62,6 +68,9 @@ func SetDNS(dns string) error {
 }
 
 func ResetDNS() error {
+	if err := resetResolved(); err != nil {
+		return fmt.Errorf("restore systemd-resolved: %v", err)
+	}
 	if err := os.Rename(resolvBackupFile, resolvFile); err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -0,0 +1,200 @@
+package host
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// systemd-resolved global DNS servers cannot be set using resolvectl, which
+// only changes per link settings lost when the link is reconfigured. A
+// configuration drop-in is used instead, setting our listener as global DNS
+// server with the ~. routing domain. Per link routing domains, like the ones
+// of VPN clients, are more specific and keep being resolved by their link
+// servers.
+//
+// Links with DefaultRoute enabled, the default when they have no routing
+// domain, would still get queries matching no routing domain. DefaultRoute is
+// disabled on those links and restored on reset.
+var (
+	resolvedConfDir  = "/etc/systemd/resolved.conf.d"
+	resolvedConfFile = filepath.Join(resolvedConfDir, "nextdns.conf")
+	resolvedRunDir   = "/run/systemd/resolve"
+	resolvedResolv   = resolvFile
+	// resolvedStubs are the resolv.conf files pointing to the stub resolver.
+	resolvedStubs = []string{
+		"/run/systemd/resolve/stub-resolv.conf",
+		"/usr/lib/systemd/resolv.conf",
+		"/lib/systemd/resolv.conf",
+	}
+
+	systemctl = func(args ...string) ([]byte, error) {
+		return exec.Command("systemctl", args...).CombinedOutput()
+	}
+	resolvectl = func(args ...string) ([]byte, error) {
+		return exec.Command("resolvectl", args...).CombinedOutput()
+	}
+)
+
+const (
+	// resolvedCreatedDir marks a drop-in for which the directory was
+	// created, so it is removed on reset.
+	resolvedCreatedDir = "# nextdns: created directory"
+	// resolvedDefaultRoute prefixes the name of a link on which DefaultRoute
+	// was disabled, so it is enabled back on reset.
+	resolvedDefaultRoute = "# nextdns: default-route "
+)
+
+// resolvedManaged returns true if systemd-resolved is running with
+// /etc/resolv.conf pointing to its stub resolver.
+func resolvedManaged() bool {
+	if _, err := os.Stat(resolvedRunDir); err != nil {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(resolvedResolv)
+	if err != nil {
+		return false
+	}
+	if !contains(resolvedStubs, target) {
+		// resolv.conf is not managed by resolved, or lists the upstream
+		// servers directly, bypassing the routing domains.
+		return false
+	}
+	_, err = systemctl("is-active", "--quiet", "systemd-resolved")
+	return err == nil
+}
+
+func setupResolved(dns string) error {
+	created := false
+	var links []string
+	if b, err := os.ReadFile(resolvedConfFile); err == nil {
+		// Already activated, keep the original state.
+		created = strings.Contains(string(b), resolvedCreatedDir)
+		links = resolvedLinks(b)
+	} else if _, err := os.Stat(resolvedConfDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(resolvedConfDir, 0755); err != nil {
+			return err
+		}
+		created = true
+	}
+
+	var sb strings.Builder
+	sb.WriteString("# This file is managed by nextdns.\n")
+	sb.WriteString("#\n")
+	sb.WriteString("# Run \"nextdns deactivate\" to restore previous configuration.\n")
+	if created {
+		sb.WriteString(resolvedCreatedDir + "\n")
+	}
+	defaultRoute, err := defaultRouteLinks()
+	if err != nil {
+		return err
+	}
+	for _, link := range defaultRoute {
+		if !contains(links, link) {
+			links = append(links, link)
+		}
+	}
+	for _, link := range links {
+		sb.WriteString(resolvedDefaultRoute + link + "\n")
+	}
+	// Lists are appended to the ones of resolved.conf, the empty assignments
+	// reset them first so servers set there are not used.
+	fmt.Fprintf(&sb, "\n[Resolve]\nDNS=\nDNS=%s\nDomains=\nDomains=~.\n", dns)
+	tmp := resolvedConfFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, resolvedConfFile); err != nil {
+		return err
+	}
+	if err := reloadResolved(); err != nil {
+		return err
+	}
+	// Per link settings are set after the reload, which may reset them.
+	for _, link := range defaultRoute {
+		if out, err := resolvectl("default-route", link, "no"); err != nil {
+			return fmt.Errorf("disable default route on %s: %v: %s", link, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// defaultRouteLinks returns the links with DefaultRoute enabled.
+func defaultRouteLinks() ([]string, error) {
+	out, err := resolvectl("default-route")
+	if err != nil {
+		return nil, fmt.Errorf("resolvectl default-route: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	// Lines are formatted as "Link 2 (eth0): yes".
+	var links []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "Link ") {
+			continue
+		}
+		i, j := strings.IndexByte(line, '('), strings.LastIndex(line, "):")
+		if i == -1 || j < i {
+			continue
+		}
+		if strings.TrimSpace(line[j+2:]) == "yes" {
+			links = append(links, line[i+1:j])
+		}
+	}
+	return links, nil
+}
+
+// resolvedLinks returns the links recorded in the drop-in b.
+func resolvedLinks(b []byte) []string {
+	var links []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if link, found := strings.CutPrefix(line, resolvedDefaultRoute); found {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// resetResolved removes the drop-in written by setupResolved if any.
+func resetResolved() error {
+	b, err := os.ReadFile(resolvedConfFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.Remove(resolvedConfFile); err != nil {
+		return err
+	}
+	if strings.Contains(string(b), resolvedCreatedDir) {
+		// Fails if other drop-ins were added since, which is fine.
+		_ = os.Remove(resolvedConfDir)
+	}
+	if err := reloadResolved(); err != nil {
+		return err
+	}
+	for _, link := range resolvedLinks(b) {
+		// The link may be gone or reconfigured since, which is fine.
+		_, _ = resolvectl("default-route", link, "yes")
+	}
+	return nil
+}
+
+func reloadResolved() error {
+	// Reload is only supported by recent versions of systemd-resolved.
+	if out, err := systemctl("reload-or-restart", "systemd-resolved"); err != nil {
+		return fmt.Errorf("reload systemd-resolved: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	_, _ = resolvectl("flush-caches")
+	return nil
+}
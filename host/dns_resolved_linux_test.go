@@ -0,0 +1,199 @@
+package host
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeResolved overrides the paths and commands used to manage
+// systemd-resolved and returns the recorded commands.
+func fakeResolved(t *testing.T, active bool, defaultRoute string) *[]string {
+	t.Helper()
+	dir := t.TempDir()
+	oldConfDir, oldConfFile, oldRunDir, oldResolv, oldStubs := resolvedConfDir, resolvedConfFile, resolvedRunDir, resolvedResolv, resolvedStubs
+	oldSystemctl, oldResolvectl := systemctl, resolvectl
+	t.Cleanup(func() {
+		resolvedConfDir, resolvedConfFile, resolvedRunDir, resolvedResolv, resolvedStubs = oldConfDir, oldConfFile, oldRunDir, oldResolv, oldStubs
+		systemctl, resolvectl = oldSystemctl, oldResolvectl
+	})
+	resolvedConfDir = filepath.Join(dir, "resolved.conf.d")
+	resolvedConfFile = filepath.Join(resolvedConfDir, "nextdns.conf")
+	resolvedRunDir = filepath.Join(dir, "resolve")
+	resolvedResolv = filepath.Join(dir, "resolv.conf")
+	stub := filepath.Join(resolvedRunDir, "stub-resolv.conf")
+	resolvedStubs = []string{stub}
+	if err := os.MkdirAll(resolvedRunDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stub, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var cmds []string
+	systemctl = func(args ...string) ([]byte, error) {
+		cmds = append(cmds, "systemctl "+strings.Join(args, " "))
+		if args[0] == "is-active" && !active {
+			return nil, errors.New("inactive")
+		}
+		return nil, nil
+	}
+	resolvectl = func(args ...string) ([]byte, error) {
+		cmds = append(cmds, "resolvectl "+strings.Join(args, " "))
+		if len(args) == 1 && args[0] == "default-route" {
+			return []byte(defaultRoute), nil
+		}
+		return nil, nil
+	}
+	return &cmds
+}
+
+func TestResolvedManaged(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		active bool
+		want   bool
+	}{
+		{"stub", "stub", true, true},
+		{"inactive", "stub", false, false},
+		{"upstream", "other", true, false},
+		{"missing", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeResolved(t, tt.active, "")
+			switch tt.target {
+			case "stub":
+				if err := os.Symlink(resolvedStubs[0], resolvedResolv); err != nil {
+					t.Fatal(err)
+				}
+			case "other":
+				if err := os.WriteFile(resolvedResolv, []byte("nameserver 192.168.1.1\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := resolvedManaged(); got != tt.want {
+				t.Errorf("resolvedManaged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolved_SetupReset(t *testing.T) {
+	cmds := fakeResolved(t, true, "Global: no\nLink 2 (eth0): yes\nLink 3 (wg0): no\nLink 4 (wlan0): yes\n")
+
+	if err := setupResolved("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(resolvedConfFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{resolvedCreatedDir, resolvedDefaultRoute + "eth0", resolvedDefaultRoute + "wlan0", "DNS=\nDNS=127.0.0.1\nDomains=\nDomains=~.\n"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("drop-in missing %q:\n%s", want, b)
+		}
+	}
+	if strings.Contains(string(b), "wg0") {
+		t.Errorf("drop-in records wg0:\n%s", b)
+	}
+	wantCmds := []string{
+		"resolvectl default-route",
+		"systemctl reload-or-restart systemd-resolved",
+		"resolvectl flush-caches",
+		"resolvectl default-route eth0 no",
+		"resolvectl default-route wlan0 no",
+	}
+	if got := strings.Join(*cmds, "\n"); got != strings.Join(wantCmds, "\n") {
+		t.Errorf("setup commands:\n%s\nwant:\n%s", got, strings.Join(wantCmds, "\n"))
+	}
+
+	// Activating again keeps the recorded links, now without default route.
+	*cmds = nil
+	resolvectl = func(args ...string) ([]byte, error) {
+		*cmds = append(*cmds, "resolvectl "+strings.Join(args, " "))
+		if len(args) == 1 {
+			return []byte("Link 2 (eth0): no\nLink 4 (wlan0): no\n"), nil
+		}
+		return nil, nil
+	}
+	if err := setupResolved("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if b2, _ := os.ReadFile(resolvedConfFile); string(b2) != string(b) {
+		t.Errorf("drop-in changed on second setup:\n%s\nwant:\n%s", b2, b)
+	}
+
+	*cmds = nil
+	if err := resetResolved(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(resolvedConfDir); !os.IsNotExist(err) {
+		t.Errorf("drop-in directory not removed: %v", err)
+	}
+	wantCmds = []string{
+		"systemctl reload-or-restart systemd-resolved",
+		"resolvectl flush-caches",
+		"resolvectl default-route eth0 yes",
+		"resolvectl default-route wlan0 yes",
+	}
+	if got := strings.Join(*cmds, "\n"); got != strings.Join(wantCmds, "\n") {
+		t.Errorf("reset commands:\n%s\nwant:\n%s", got, strings.Join(wantCmds, "\n"))
+	}
+
+	// Nothing to do once reset.
+	*cmds = nil
+	if err := resetResolved(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*cmds) != 0 {
+		t.Errorf("second reset ran %q", *cmds)
+	}
+}
+
+// resolvedSettings returns the [Resolve] list settings of the files parsed in
+// order, the way systemd-resolved merges resolved.conf and its drop-ins: values
+// are appended and an empty assignment resets the list.
+func resolvedSettings(t *testing.T, files ...string) map[string][]string {
+	t.Helper()
+	settings := map[string][]string{}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+			if !ok || strings.HasPrefix(k, "#") {
+				continue
+			}
+			if v == "" {
+				settings[k] = nil
+				continue
+			}
+			settings[k] = append(settings[k], strings.Fields(v)...)
+		}
+	}
+	return settings
+}
+
+func TestResolved_SetupOverridesGlobalServers(t *testing.T) {
+	fakeResolved(t, true, "")
+	conf := filepath.Join(t.TempDir(), "resolved.conf")
+	if err := os.WriteFile(conf, []byte("[Resolve]\nDNS=1.1.1.1 8.8.8.8\nDomains=corp.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupResolved("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	settings := resolvedSettings(t, conf, resolvedConfFile)
+	if got := strings.Join(settings["DNS"], " "); got != "127.0.0.1" {
+		t.Errorf("DNS = %q, want 127.0.0.1", got)
+	}
+	if got := strings.Join(settings["Domains"], " "); got != "~." {
+		t.Errorf("Domains = %q, want ~.", got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -133,6 +134,11 @@ type ConfigFileStorer struct {
 	File string
 }
 
+// ConfigFile returns the path of the configuration file.
+func (s ConfigFileStorer) ConfigFile() string {
+	return s.File
+}
+
 func (s ConfigFileStorer) SaveConfig(c map[string]ConfigEntry) error {
 	dir := filepath.Dir(s.File)
 	if st, err := os.Stat(dir); err != nil {
@@ -150,7 +156,13 @@ func (s ConfigFileStorer) SaveConfig(c map[string]ConfigEntry) error {
 	if err != nil {
 		return err
 	}
-	for name, entry := range c {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := c[name]
 		if entry, ok := entry.(ConfigListEntry); ok {
 			for _, value := range entry.Strings() {
 				fmt.Fprintf(f, "%s %s\n", name, value)
@@ -159,7 +171,7 @@ func (s ConfigFileStorer) SaveConfig(c map[string]ConfigEntry) error {
 		}
 		fmt.Fprintf(f, "%s %s\n", name, entry.String())
 	}
-	return nil
+	return f.Close()
 }
 
 func (s ConfigFileStorer) LoadConfig(c map[string]ConfigEntry) error {
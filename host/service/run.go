@@ -1,6 +1,7 @@
 package service
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,20 +13,46 @@ type Runner interface {
 	Log(msg string)
 }
 
+// Reloader is implemented by runners able to reload their configuration
+// without stopping. Reload is called on SIGHUP (or a parameter change request
+// for Windows services).
+type Reloader interface {
+	Reload() error
+}
+
+// reload calls r.Reload if r implements Reloader and returns false otherwise.
+func reload(r Runner) bool {
+	rl, ok := r.(Reloader)
+	if !ok {
+		return false
+	}
+	if err := rl.Reload(); err != nil {
+		r.Log(fmt.Sprintf("Reload failed: %v", err))
+	}
+	return true
+}
+
 func Run(name string, r Runner) error {
 	if CurrentRunMode() == RunModeNone {
-		return runForeground(r)
+		return RunForeground(r)
 	}
 	return runService(name, r)
 }
 
-func runForeground(r Runner) error {
+// RunForeground runs r until the process is interrupted or terminated,
+// without service manager integration.
+func RunForeground(r Runner) error {
 	if err := r.Start(); err != nil {
 		return err
 	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
-	<-sig
+	for s := range sig {
+		if s == syscall.SIGHUP && reload(r) {
+			continue
+		}
+		break
+	}
 	return r.Stop()
 }
@@ -11,7 +11,10 @@ type windowService struct {
 }
 
 func (s *windowService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
+	cmdsAccepted := svc.AcceptStop | svc.AcceptShutdown
+	if _, ok := s.Runner.(Reloader); ok {
+		cmdsAccepted |= svc.AcceptParamChange
+	}
 	changes <- svc.Status{State: svc.StartPending}
 	if err := s.Start(); err != nil {
 		s.lastErr = err
@@ -25,6 +28,9 @@ loop:
 		switch c.Cmd {
 		case svc.Interrogate:
 			changes <- c.CurrentStatus
+		case svc.ParamChange:
+			reload(s.Runner)
+			changes <- c.CurrentStatus
 		case svc.Stop, svc.Shutdown:
 			changes <- svc.Status{State: svc.StopPending}
 			if err := s.Stop(); err != nil {
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package host
+
+import "os"
+
+// stateDirs lists the persistent state directories of router firmwares on
+// which /var is a tmpfs, with the path identifying the firmware.
+var stateDirs = []struct {
+	marker, dir string
+}{
+	{"/jffs", "/jffs/nextdns"},                           // merlin, dd-wrt
+	{"/data/unifi", "/data/nextdns"},                     // ubios
+	{"/config/scripts/post-config.d", "/config/nextdns"}, // edgeos
+	{"/etc/openwrt_release", "/etc/nextdns"},             // openwrt
+}
+
+// StateDir returns the directory where state persisted across restarts is
+// stored.
+func StateDir() string {
+	for _, d := range stateDirs {
+		if _, err := os.Stat(d.marker); err == nil {
+			return d.dir
+		}
+	}
+	return "/var/lib/nextdns"
+}
@@ -0,0 +1,16 @@
+package host
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// StateDir returns the directory where state persisted across restarts is
+// stored.
+func StateDir() string {
+	dir := os.Getenv("ProgramData")
+	if dir == "" {
+		dir = `C:\ProgramData`
+	}
+	return filepath.Join(dir, "NextDNS")
+}
@@ -32,6 +32,8 @@ var commands = []command{
 
 	{"config", cfg, "manage configuration"},
 
+	{"router", routerCmd, "manage the router setup"},
+
 	{"activate", activation, "setup the system to use NextDNS as a resolver"},
 	{"deactivate", activation, "restore the resolver configuration"},
 
@@ -41,6 +43,14 @@ var commands = []command{
 	{"trace", ctlCmd, "display a stack trace dump"},
 	{"arp", ctlCmd, "dump the ARP table"},
 	{"ndp", ctlCmd, "dump the NDP table"},
+	{"captive-status", ctlCmd, "display captive portal detection status"},
+	{"connect-stats", ctlCmd, "display DoH connection statistics"},
+	{"forwarders", ctlCmd, "display forwarders and their endpoints health"},
+	{"split-dns", ctlCmd, "display DNS configuration learned for split DNS"},
+	{"profile", ruleCmd, "list or change profile rules of the running daemon"},
+	{"forwarder", ruleCmd, "list or change forwarder rules of the running daemon"},
+	{"dns-guard", ctlCmd, "display the state of the system DNS configuration guard"},
+	{"reload", ctlCmd, "reload the configuration of the running daemon"},
 
 	{"version", showVersion, "show current version"},
 }
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Netlink and ctnetlink constants, from linux/netlink.h and
+// linux/netfilter/nfnetlink_conntrack.h.
+const (
+	nlmsgHdrLen  = 16
+	nfgenHdrLen  = 4
+	nlmFRequest  = 0x1
+	nlmsgError   = 0x2
+	nlaFNested   = 0x8000
+	nfnlCTGet    = 1<<8 | 1 // NFNL_SUBSYS_CTNETLINK<<8 | IPCTNL_MSG_CT_GET
+	ctaTupleOrig = 1
+	ctaTupleRepl = 2
+	ctaTupleIP   = 1
+	ctaTupleProt = 2
+	ctaIPv4Src   = 1
+	ctaIPv4Dst   = 2
+	ctaIPv6Src   = 3
+	ctaIPv6Dst   = 4
+	ctaProtoNum  = 1
+	ctaProtoSrc  = 2
+	ctaProtoDst  = 3
+)
+
+// conntrackRequest returns a ctnetlink message getting the conntrack entry of
+// the connection from peer to local, looked up by its reply tuple as the
+// original destination is what we are looking for. It returns nil if peer and
+// local are not of the same family.
+func conntrackRequest(proto uint8, peer net.IP, peerPort int, local net.IP, localPort int) []byte {
+	family, src, dst := byte(10), uint16(ctaIPv6Src), uint16(ctaIPv6Dst) // AF_INET6
+	if p4, l4 := peer.To4(), local.To4(); p4 != nil && l4 != nil {
+		family, src, dst = 2, ctaIPv4Src, ctaIPv4Dst // AF_INET
+		peer, local = p4, l4
+	} else if p4 != nil || l4 != nil || peer.To16() == nil || local.To16() == nil {
+		return nil
+	}
+	port := func(p int) []byte {
+		return binary.BigEndian.AppendUint16(nil, uint16(p))
+	}
+	// The reply direction goes from local to peer.
+	tuple := nlAttr(ctaTupleRepl|nlaFNested,
+		nlAttr(ctaTupleIP|nlaFNested, nlAttr(src, local), nlAttr(dst, peer)),
+		nlAttr(ctaTupleProt|nlaFNested,
+			nlAttr(ctaProtoNum, []byte{proto}),
+			nlAttr(ctaProtoSrc, port(localPort)),
+			nlAttr(ctaProtoDst, port(peerPort))))
+	b := make([]byte, nlmsgHdrLen, nlmsgHdrLen+nfgenHdrLen+len(tuple))
+	binary.NativeEndian.PutUint32(b[0:], uint32(cap(b)))
+	binary.NativeEndian.PutUint16(b[4:], nfnlCTGet)
+	binary.NativeEndian.PutUint16(b[6:], nlmFRequest)
+	binary.NativeEndian.PutUint32(b[8:], 1) // seq
+	b = append(b, family, 0, 0, 0)          // nfgenmsg
+	return append(b, tuple...)
+}
+
+// conntrackOriginalDst returns the original destination of the conntrack
+// entry in the ctnetlink response b, nil if b is not an entry or if the
+// destination is local, meaning the connection was not redirected.
+func conntrackOriginalDst(b []byte, local net.IP) net.IP {
+	if len(b) < nlmsgHdrLen+nfgenHdrLen {
+		return nil
+	}
+	n := int(binary.NativeEndian.Uint32(b))
+	if binary.NativeEndian.Uint16(b[4:]) == nlmsgError || n < nlmsgHdrLen+nfgenHdrLen || n > len(b) {
+		return nil
+	}
+	ips := nlFind(b[nlmsgHdrLen+nfgenHdrLen:n], ctaTupleOrig, ctaTupleIP)
+	dst := nlFind(ips, ctaIPv4Dst)
+	if dst == nil {
+		dst = nlFind(ips, ctaIPv6Dst)
+	}
+	if len(dst) != net.IPv4len && len(dst) != net.IPv6len {
+		return nil
+	}
+	ip := net.IP(append([]byte{}, dst...))
+	if ip.Equal(local) {
+		return nil
+	}
+	return ip
+}
+
+// nlAttr returns a netlink attribute of type typ holding data.
+func nlAttr(typ uint16, data ...[]byte) []byte {
+	n := 4
+	for _, d := range data {
+		n += len(d)
+	}
+	b := make([]byte, 4, (n+3)&^3)
+	binary.NativeEndian.PutUint16(b[0:], uint16(n))
+	binary.NativeEndian.PutUint16(b[2:], typ)
+	for _, d := range data {
+		b = append(b, d...)
+	}
+	return b[:cap(b)]
+}
+
+// nlFind returns the data of the attribute found by walking the nested
+// attribute types of path in b, nil if not found.
+func nlFind(b []byte, path ...uint16) []byte {
+	for _, typ := range path {
+		var found []byte
+		for len(b) >= 4 {
+			n := int(binary.NativeEndian.Uint16(b))
+			if n < 4 || n > len(b) {
+				return nil
+			}
+			if binary.NativeEndian.Uint16(b[2:])&^nlaFNested == typ {
+				found = b[4:n]
+				break
+			}
+			if n = (n + 3) &^ 3; n > len(b) {
+				n = len(b)
+			}
+			b = b[n:]
+		}
+		if found == nil {
+			return nil
+		}
+		b = found
+	}
+	return b
+}
+
+// logOriginalDst returns true if the original destination of a query from
+// peer is to be looked up for the query log.
+func (p Proxy) logOriginalDst(peer net.IP, err error) bool {
+	if p.OriginalDst == nil || p.QueryLog == nil || peer.IsLoopback() {
+		// Queries from the loopback are forwarded by a local DNS server, like
+		// dnsmasq on most routers, which sends them with its own connection:
+		// the destination of the client query is not known to conntrack.
+		return false
+	}
+	return err != nil || p.OriginalDst()
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSOOriginalDst is IP6T_SO_ORIGINAL_DST from
+// linux/netfilter_ipv6/ip6_tables.h.
+const ip6tSOOriginalDst = 80
+
+// udpOriginalDst returns the original destination of a UDP query from peer to
+// local redirected by a NAT rule, nil if it was not redirected or the lookup
+// failed. The connection is looked up in the conntrack table with netlink.
+func udpOriginalDst(peer net.Addr, local net.IP, localPort int) net.IP {
+	peerIP, peerPort := addrIPPort(peer)
+	req := conntrackRequest(unix.IPPROTO_UDP, peerIP, peerPort, local, localPort)
+	if req == nil {
+		return nil
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil
+	}
+	defer unix.Close(fd)
+	tv := unix.Timeval{Usec: 100000}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return nil
+	}
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil
+	}
+	buf := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return nil
+	}
+	return conntrackOriginalDst(buf[:n], local)
+}
+
+// tcpOriginalDst returns the original destination of the TCP connection c
+// redirected by a NAT rule, nil if it was not redirected or the lookup failed.
+func tcpOriginalDst(c net.Conn) net.IP {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	local := addrIP(c.LocalAddr())
+	var dst net.IP
+	_ = rc.Control(func(fd uintptr) {
+		if local.To4() != nil {
+			// The sockaddr_in returned by SO_ORIGINAL_DST fits in an
+			// ipv6_mreq.
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err == nil && binary.NativeEndian.Uint16(mreq.Multiaddr[:]) == unix.AF_INET {
+				dst = net.IP(append([]byte{}, mreq.Multiaddr[4:8]...))
+			}
+			return
+		}
+		// Same for the sockaddr_in6 returned by IP6T_SO_ORIGINAL_DST and an
+		// ip6_mtuinfo.
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSOOriginalDst)
+		if err == nil && info.Addr.Family == unix.AF_INET6 {
+			dst = net.IP(append([]byte{}, info.Addr.Addr[:]...))
+		}
+	})
+	if dst == nil || dst.Equal(local) {
+		return nil
+	}
+	return dst
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import "net"
+
+func udpOriginalDst(peer net.Addr, local net.IP, localPort int) net.IP {
+	return nil
+}
+
+func tcpOriginalDst(c net.Conn) net.IP {
+	return nil
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+func Test_conntrackRequest(t *testing.T) {
+	peer, local := net.ParseIP("192.168.1.10"), net.ParseIP("192.168.1.1")
+	b := conntrackRequest(17, peer, 5353, local, 53)
+	if got := int(binary.NativeEndian.Uint32(b)); got != len(b) {
+		t.Fatalf("message length = %d, want %d", got, len(b))
+	}
+	if got := binary.NativeEndian.Uint16(b[4:]); got != nfnlCTGet {
+		t.Errorf("message type = %#x, want %#x", got, nfnlCTGet)
+	}
+	if got := b[nlmsgHdrLen]; got != 2 {
+		t.Errorf("family = %d, want AF_INET", got)
+	}
+	attrs := b[nlmsgHdrLen+nfgenHdrLen:]
+	if nlFind(attrs, ctaTupleOrig) != nil {
+		t.Error("request has an original tuple")
+	}
+	tests := []struct {
+		path []uint16
+		want []byte
+	}{
+		{[]uint16{ctaTupleRepl, ctaTupleIP, ctaIPv4Src}, local.To4()},
+		{[]uint16{ctaTupleRepl, ctaTupleIP, ctaIPv4Dst}, peer.To4()},
+		{[]uint16{ctaTupleRepl, ctaTupleProt, ctaProtoNum}, []byte{17}},
+		{[]uint16{ctaTupleRepl, ctaTupleProt, ctaProtoSrc}, []byte{0, 53}},
+		{[]uint16{ctaTupleRepl, ctaTupleProt, ctaProtoDst}, []byte{0x14, 0xe9}},
+	}
+	for _, tt := range tests {
+		if got := nlFind(attrs, tt.path...); string(got) != string(tt.want) {
+			t.Errorf("attribute %v = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	if b := conntrackRequest(17, net.ParseIP("fd00::a"), 5353, net.ParseIP("fd00::1"), 53); b == nil || b[nlmsgHdrLen] != 10 {
+		t.Error("IPv6 request family is not AF_INET6")
+	}
+	if b := conntrackRequest(17, net.ParseIP("fd00::a"), 5353, local, 53); b != nil {
+		t.Error("request with mixed families is not nil")
+	}
+}
+
+// conntrackResponse returns a ctnetlink entry for a connection from peer to
+// dst, redirected to local.
+func conntrackResponse(peer, dst, local net.IP) []byte {
+	src, dstType := uint16(ctaIPv4Src), uint16(ctaIPv4Dst)
+	if peer.To4() == nil {
+		src, dstType = ctaIPv6Src, ctaIPv6Dst
+	} else {
+		peer, dst, local = peer.To4(), dst.To4(), local.To4()
+	}
+	proto := nlAttr(ctaTupleProt|nlaFNested, nlAttr(ctaProtoNum, []byte{17}))
+	attrs := append(
+		nlAttr(ctaTupleOrig|nlaFNested, nlAttr(ctaTupleIP|nlaFNested, nlAttr(src, peer), nlAttr(dstType, dst)), proto),
+		nlAttr(ctaTupleRepl|nlaFNested, nlAttr(ctaTupleIP|nlaFNested, nlAttr(src, local), nlAttr(dstType, peer)), proto)...)
+	b := make([]byte, nlmsgHdrLen+nfgenHdrLen, nlmsgHdrLen+nfgenHdrLen+len(attrs))
+	binary.NativeEndian.PutUint32(b, uint32(cap(b)))
+	return append(b, attrs...)
+}
+
+func Test_conntrackOriginalDst(t *testing.T) {
+	local := net.ParseIP("192.168.1.1")
+	errMsg := make([]byte, 36)
+	binary.NativeEndian.PutUint32(errMsg, 36)
+	binary.NativeEndian.PutUint16(errMsg[4:], nlmsgError)
+	tests := []struct {
+		name  string
+		msg   []byte
+		local net.IP
+		want  net.IP
+	}{
+		{"redirected", conntrackResponse(net.ParseIP("192.168.1.10"), net.ParseIP("8.8.8.8"), local), local, net.ParseIP("8.8.8.8")},
+		{"not redirected", conntrackResponse(net.ParseIP("192.168.1.10"), local, local), local, nil},
+		{"redirected ipv6", conntrackResponse(net.ParseIP("fd00::a"), net.ParseIP("2001:4860:4860::8888"), net.ParseIP("fd00::1")), net.ParseIP("fd00::1"), net.ParseIP("2001:4860:4860::8888")},
+		{"not found", errMsg, local, nil},
+		{"truncated", conntrackResponse(net.ParseIP("192.168.1.10"), net.ParseIP("8.8.8.8"), local)[:30], local, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := conntrackOriginalDst(tt.msg, tt.local); !got.Equal(tt.want) {
+				t.Errorf("conntrackOriginalDst() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxy_logOriginalDst(t *testing.T) {
+	var logged bool
+	p := Proxy{
+		OriginalDst: func() bool { return logged },
+		QueryLog:    func(QueryInfo) {},
+	}
+	lan, lo := net.ParseIP("192.168.1.10"), net.ParseIP("127.0.0.1")
+	if p.logOriginalDst(lan, nil) {
+		t.Error("looked up while queries are not logged")
+	}
+	if !p.logOriginalDst(lan, errors.New("failed")) {
+		t.Error("not looked up for a failed query")
+	}
+	logged = true
+	if !p.logOriginalDst(lan, nil) {
+		t.Error("not looked up while queries are logged")
+	}
+	if p.logOriginalDst(lo, nil) {
+		t.Error("looked up for a loopback peer")
+	}
+	p.OriginalDst = nil
+	if p.logOriginalDst(lan, nil) {
+		t.Error("looked up without OriginalDst")
+	}
+}
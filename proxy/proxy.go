@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nextdns/nextdns/hosts"
@@ -19,6 +20,7 @@ type QueryInfo struct {
 	Protocol          string
 	Profile           string
 	PeerIP            net.IP
+	DestIP            net.IP // original destination of a redirected query
 	Type              string
 	Name              string
 	QuerySize         int
@@ -34,24 +36,72 @@ type HostResolver interface {
 	LookupHost(addr string) []string
 }
 
+// SwappableResolver holds a HostResolver which can be replaced while the proxy
+// is running. A nil or empty SwappableResolver resolves nothing.
+type SwappableResolver struct {
+	r atomic.Pointer[hostResolver]
+}
+
+type hostResolver struct {
+	HostResolver
+}
+
+// NewSwappableResolver returns a SwappableResolver holding r.
+func NewSwappableResolver(r HostResolver) *SwappableResolver {
+	s := &SwappableResolver{}
+	s.Store(r)
+	return s
+}
+
+// Store replaces the held resolver with r, which may be nil.
+func (s *SwappableResolver) Store(r HostResolver) {
+	if r == nil {
+		s.r.Store(nil)
+		return
+	}
+	s.r.Store(&hostResolver{r})
+}
+
+// Load returns the held resolver, nil if none.
+func (s *SwappableResolver) Load() HostResolver {
+	if s == nil {
+		return nil
+	}
+	if r := s.r.Load(); r != nil {
+		return r.HostResolver
+	}
+	return nil
+}
+
 // Proxy is a DNS53 to DNS over anything proxy.
 type Proxy struct {
 	// Addrs specifies the TCP/UDP address to listen to, :53 if empty.
 	Addrs []string
 
 	// LocalResolver is called before the upstream to resolve local hostnames or
-	// IPs.
-	LocalResolver HostResolver
+	// IPs. It can be replaced while the proxy is running.
+	LocalResolver *SwappableResolver
 
 	// Upstream specifies the resolver used for incoming queries.
 	Upstream resolver.Resolver
 
 	// DiscoveryResolver is called after the upstream if no result was found.
-	DiscoveryResolver HostResolver
+	// It can be replaced while the proxy is running.
+	DiscoveryResolver *SwappableResolver
 
 	// BogusPriv specifies that reverse lookup on private subnets are answerd
-	// with NXDOMAIN.
-	BogusPriv bool
+	// with NXDOMAIN. It can be changed while the proxy is running.
+	BogusPriv *atomic.Bool
+
+	// DoHCanary specifies that the Firefox use-application-dns.net canary
+	// domain is answered with NXDOMAIN, so Firefox does not enable its own DNS
+	// over HTTPS by default.
+	DoHCanary bool
+
+	// BlockPrivateRelay specifies that the iCloud Private Relay domains are
+	// answered with NXDOMAIN, signaling Apple devices that Private Relay is not
+	// allowed on the network.
+	BlockPrivateRelay bool
 
 	// Timeout defines the maximum allowed time allowed for a request before
 	// being cancelled.
@@ -61,6 +111,15 @@ type Proxy struct {
 	// not be answered.
 	MaxInflightRequests uint
 
+	// OriginalDst, if set, reports whether the original destination of
+	// queries redirected to the proxy by a NAT rule is looked up, to be
+	// reported in QueryInfo.DestIP. It is called for each query, so the lookup
+	// can be limited to the queries actually logged. Failed queries are
+	// always looked up. Queries from the loopback, forwarded by a local DNS
+	// server like dnsmasq, are never looked up as their original destination
+	// is this server. It is only supported on Linux.
+	OriginalDst func() bool
+
 	// QueryLog specifies an optional log function called for each received query.
 	QueryLog func(QueryInfo)
 
@@ -118,7 +177,7 @@ func (p Proxy) ListenAndServe(ctx context.Context) error {
 				closeAllMu.Lock()
 				closeAll = append(closeAll, udp.Close)
 				closeAllMu.Unlock()
-				err = p.serveUDP(udp, inflightRequests)
+				err = p.serveUDP(udp, addr, inflightRequests)
 			}
 			cancel()
 			if err != nil {
@@ -135,7 +194,7 @@ func (p Proxy) ListenAndServe(ctx context.Context) error {
 				closeAllMu.Lock()
 				closeAll = append(closeAll, tcp.Close)
 				closeAllMu.Unlock()
-				err = p.serveTCP(tcp, inflightRequests)
+				err = p.serveTCP(tcp, addr, inflightRequests)
 			}
 			cancel()
 			if err != nil {
@@ -165,25 +224,31 @@ func (p Proxy) ListenAndServe(ctx context.Context) error {
 }
 
 func (p Proxy) Resolve(ctx context.Context, q query.Query, buf []byte) (n int, i resolver.ResolveInfo, err error) {
-	if p.LocalResolver != nil {
-		if _n, _i, _err := hostsResolve(p.LocalResolver, q, buf); _err == nil {
+	if p.isBypassSignal(q.Name) {
+		n = replyRCode(dnsmessage.RCodeNameError, q, buf)
+		return n, i, nil
+	}
+
+	if r := p.LocalResolver.Load(); r != nil {
+		if _n, _i, _err := hostsResolve(r, q, buf); _err == nil {
 			return _n, _i, nil
 		}
 	}
 
 	priv := q.Type == query.TypePTR && isPrivateReverse(q.Name)
+	bogusPriv := p.BogusPriv != nil && p.BogusPriv.Load()
 
-	if !p.BogusPriv || !priv {
+	if !bogusPriv || !priv {
 		n, i, err = p.Upstream.Resolve(ctx, q, buf)
 	}
 
-	if q.RecursionDesired && p.DiscoveryResolver != nil && (n <= 0 || isNXDomain(buf[:n])) {
-		if _n, _i, _err := hostsResolve(p.DiscoveryResolver, q, buf); _err == nil {
+	if r := p.DiscoveryResolver.Load(); q.RecursionDesired && r != nil && (n <= 0 || isNXDomain(buf[:n])) {
+		if _n, _i, _err := hostsResolve(r, q, buf); _err == nil {
 			return _n, _i, nil
 		}
 	}
 
-	if p.BogusPriv && priv {
+	if bogusPriv && priv {
 		n = replyRCode(dnsmessage.RCodeNameError, q, buf)
 		return n, i, nil
 	}
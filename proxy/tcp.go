@@ -18,7 +18,7 @@ import (
 
 const maxTCPSize = 65535
 
-func (p Proxy) serveTCP(l net.Listener, inflightRequests chan struct{}) error {
+func (p Proxy) serveTCP(l net.Listener, listener string, inflightRequests chan struct{}) error {
 	bpool := NewTieredBufferPool()
 
 	for {
@@ -30,7 +30,7 @@ func (p Proxy) serveTCP(l net.Listener, inflightRequests chan struct{}) error {
 			return err
 		}
 		go func() {
-			if err := p.serveTCPConn(c, inflightRequests, bpool); err != nil {
+			if err := p.serveTCPConn(c, listener, inflightRequests, bpool); err != nil {
 				if p.ErrorLog != nil {
 					p.ErrorLog(err)
 				}
@@ -39,7 +39,7 @@ func (p Proxy) serveTCP(l net.Listener, inflightRequests chan struct{}) error {
 	}
 }
 
-func (p Proxy) serveTCPConn(c net.Conn, inflightRequests chan struct{}, bpool *TieredBufferPool) error {
+func (p Proxy) serveTCPConn(c net.Conn, listener string, inflightRequests chan struct{}, bpool *TieredBufferPool) error {
 	var wg sync.WaitGroup
 	defer func() {
 		// Wait for all query processing goroutines to complete before closing
@@ -77,6 +77,7 @@ func (p Proxy) serveTCPConn(c net.Conn, inflightRequests chan struct{}, bpool *T
 			if err != nil {
 				p.logErr(err)
 			}
+			q.Listener = listener
 			rbuf := *bpool.GetLarge()
 			defer func() {
 				if r := recover(); r != nil {
@@ -87,8 +88,13 @@ func (p Proxy) serveTCPConn(c net.Conn, inflightRequests chan struct{}, bpool *T
 				bpool.Put(&buf)
 				bpool.Put(&rbuf)
 				<-inflightRequests
+				var destIP net.IP
+				if p.logOriginalDst(q.PeerIP, err) {
+					destIP = tcpOriginalDst(c)
+				}
 				p.logQuery(QueryInfo{
 					PeerIP:            q.PeerIP,
+					DestIP:            destIP,
 					Protocol:          "TCP",
 					Type:              q.Type.String(),
 					Name:              q.Name,
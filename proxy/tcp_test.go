@@ -75,7 +75,7 @@ func TestTCPConn_WaitsForInflightQueries(t *testing.T) {
 		}
 		inflightRequests := make(chan struct{}, 10)
 		bpool := NewTieredBufferPool()
-		_ = p.serveTCPConn(conn, inflightRequests, bpool)
+		_ = p.serveTCPConn(conn, "", inflightRequests, bpool)
 	}()
 
 	// Give server time to start
@@ -167,7 +167,7 @@ func TestTCPConn_MultipleInflightQueries(t *testing.T) {
 		}
 		inflightRequests := make(chan struct{}, 10)
 		bpool := NewTieredBufferPool()
-		_ = p.serveTCPConn(conn, inflightRequests, bpool)
+		_ = p.serveTCPConn(conn, "", inflightRequests, bpool)
 	}()
 
 	time.Sleep(50 * time.Millisecond)
@@ -244,7 +244,7 @@ func TestTCPConn_GracefulShutdown(t *testing.T) {
 		}
 		inflightRequests := make(chan struct{}, 10)
 		bpool := NewTieredBufferPool()
-		_ = p.serveTCPConn(conn, inflightRequests, bpool)
+		_ = p.serveTCPConn(conn, "", inflightRequests, bpool)
 		close(serverDone)
 	}()
 
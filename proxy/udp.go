@@ -37,7 +37,7 @@ var udpOOBSize = func() int {
 	return len(oob6)
 }()
 
-func (p Proxy) serveUDP(l net.PacketConn, inflightRequests chan struct{}) error {
+func (p Proxy) serveUDP(l net.PacketConn, listener string, inflightRequests chan struct{}) error {
 	// Use the same buffer size as for TCP and truncate later. UDP and
 	// TCP share the cache, and we want to avoid storing truncated
 	// response for UDP that would be reused when the client falls back
@@ -78,6 +78,7 @@ func (p Proxy) serveUDP(l net.PacketConn, inflightRequests chan struct{}) error
 			if err != nil {
 				p.logErr(err)
 			}
+			q.Listener = listener
 			rbuf := *bpool.GetLarge()
 			defer func() {
 				if r := recover(); r != nil {
@@ -88,8 +89,14 @@ func (p Proxy) serveUDP(l net.PacketConn, inflightRequests chan struct{}) error
 				bpool.Put(&buf)
 				bpool.Put(&rbuf)
 				<-inflightRequests
+				var destIP net.IP
+				if p.logOriginalDst(q.PeerIP, err) {
+					_, port := addrIPPort(l.LocalAddr())
+					destIP = udpOriginalDst(raddr, lip, port)
+				}
 				p.logQuery(QueryInfo{
 					PeerIP:            q.PeerIP,
+					DestIP:            destIP,
 					Protocol:          "UDP",
 					Type:              q.Type.String(),
 					Name:              q.Name,
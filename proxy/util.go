@@ -123,6 +123,19 @@ func hostsResolve(r HostResolver, q query.Query, buf []byte) (n int, i resolver.
 	return len(buf), i, err
 }
 
+// isBypassSignal returns true if qname is a domain used by clients to check
+// whether the network allows them to bypass its DNS, and p is set to deny it.
+func (p Proxy) isBypassSignal(qname string) bool {
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+	switch qname {
+	case "use-application-dns.net":
+		return p.DoHCanary
+	case "mask.icloud.com", "mask-h2.icloud.com":
+		return p.BlockPrivateRelay
+	}
+	return false
+}
+
 func isPrivateReverse(qname string) bool {
 	if ip := ptrIP(qname); ip != nil {
 		if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
@@ -205,3 +218,15 @@ func addrIP(addr net.Addr) (ip net.IP) {
 	}
 	return
 }
+
+func addrIPPort(addr net.Addr) (ip net.IP, port int) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	}
+	host, sport, _ := net.SplitHostPort(addr.String())
+	port, _ = strconv.Atoi(sport)
+	return net.ParseIP(host), port
+}
@@ -65,3 +65,26 @@ func Test_isPrivateReverse(t *testing.T) {
 		})
 	}
 }
+
+func TestProxy_isBypassSignal(t *testing.T) {
+	tests := []struct {
+		qname string
+		p     Proxy
+		want  bool
+	}{
+		{"use-application-dns.net.", Proxy{DoHCanary: true}, true},
+		{"USE-APPLICATION-DNS.NET", Proxy{DoHCanary: true}, true},
+		{"use-application-dns.net.", Proxy{}, false},
+		{"mask.icloud.com.", Proxy{BlockPrivateRelay: true}, true},
+		{"mask-h2.icloud.com.", Proxy{BlockPrivateRelay: true}, true},
+		{"mask.icloud.com.", Proxy{DoHCanary: true}, false},
+		{"www.icloud.com.", Proxy{DoHCanary: true, BlockPrivateRelay: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			if got := tt.p.isBypassSignal(tt.qname); got != tt.want {
+				t.Errorf("isBypassSignal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
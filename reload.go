@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/host"
+)
+
+// reloadResult reports the outcome of a configuration reload.
+type reloadResult struct {
+	// Changed lists the settings with a new value.
+	Changed []string `json:"changed"`
+
+	// Applied lists the settings applied to the running daemon.
+	Applied []string `json:"applied,omitempty"`
+
+	// Restarted is true when the listeners had to be restarted to apply some
+	// settings. The cache and upstream connections are kept.
+	Restarted bool `json:"restarted,omitempty"`
+
+	// RestartRequired lists the settings only applied after a restart of the
+	// service.
+	RestartRequired []string `json:"restart_required,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+func (r reloadResult) String() string {
+	if r.Error != "" {
+		return "reload failed: " + r.Error
+	}
+	s := "no change"
+	if len(r.Applied) > 0 {
+		s = "applied: " + strings.Join(r.Applied, ", ")
+	}
+	if r.Restarted {
+		s += " (listeners restarted)"
+	}
+	if len(r.RestartRequired) > 0 {
+		s += "; restart required for: " + strings.Join(r.RestartRequired, ", ")
+	}
+	return s
+}
+
+// Settings applied in place by the reloader.
+var hotSettings = map[string]bool{
+	"profile":            true,
+	"forwarder":          true,
+	"log-queries":        true,
+	"max-ttl":            true,
+	"cache-max-age":      true,
+	"bogus-priv":         true,
+	"use-hosts":          true,
+	"report-client-info": true,
+	"discovery-dns":      true,
+	"mdns":               true,
+}
+
+// Settings applied by restarting the listeners, as they are copied by the
+// proxy when it starts listening.
+var listenerSettings = map[string]bool{
+	"listen":                true,
+	"timeout":               true,
+	"max-inflight-requests": true,
+}
+
+// reloader re-parses the configuration of the running daemon and applies the
+// changed settings that can be changed without restarting the service.
+type reloader struct {
+	p          *proxySvc
+	log        host.Logger
+	cmd        string
+	args       []string
+	useStorage bool
+
+	profiles   *config.ProfileSelector
+	rules      *ruleManager
+	logQueries *atomic.Bool
+	clients    *clientDiscovery
+
+	mu   sync.Mutex
+	conf config.Config
+
+	// pending lists the settings changed since the service started that
+	// require a restart.
+	pending map[string]bool
+}
+
+// Reload reloads the configuration and logs the result.
+func (r *reloader) Reload() reloadResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := reloadResult{Changed: []string{}}
+	var nc config.Config
+	if err := nc.Load("nextdns "+r.cmd, append([]string{}, r.args...), r.useStorage); err != nil {
+		res.Error = err.Error()
+		r.log.Errorf("Reload: %v", err)
+		return res
+	}
+
+	// Rules can be changed at runtime, compare with the live ones so a
+	// reload restores the configured rules.
+	cur := r.configLocked()
+
+	res.Changed = cur.Changes(&nc)
+	var restart bool
+	for _, name := range res.Changed {
+		switch {
+		case hotSettings[name]:
+			if err := r.apply(name, nc); err != nil {
+				res.Error = err.Error()
+				r.log.Errorf("Reload: %s: %v", name, err)
+				return res
+			}
+			res.Applied = append(res.Applied, name)
+		case listenerSettings[name] && r.canRestartListeners(name, nc):
+			restart = true
+			res.Applied = append(res.Applied, name)
+		default:
+			if r.pending == nil {
+				r.pending = map[string]bool{}
+			}
+			r.pending[name] = true
+		}
+	}
+	for name := range r.pending {
+		res.RestartRequired = append(res.RestartRequired, name)
+	}
+	sort.Strings(res.RestartRequired)
+	if restart {
+		if err := r.p.restartWith(func() { r.applyListenerSettings(nc) }); err != nil {
+			res.Error = err.Error()
+			r.log.Errorf("Reload: restart: %v", err)
+			return res
+		}
+		res.Restarted = true
+	}
+	r.conf = nc
+	r.log.Infof("Configuration reloaded: %s", res)
+	return res
+}
+
+// Config returns the effective configuration of the running daemon, including
+// the rules changed at runtime.
+func (r *reloader) Config() config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.configLocked()
+}
+
+func (r *reloader) configLocked() config.Config {
+	c := r.conf
+	c.Profile = r.profiles.Profiles()
+	c.Forwarders = r.rules.fwd.Forwarders()
+	return c
+}
+
+func (r *reloader) apply(name string, c config.Config) error {
+	switch name {
+	case "profile":
+		r.profiles.SetProfiles(c.Profile)
+	case "forwarder":
+		return r.rules.SetForwarders(c.Forwarders)
+	case "log-queries":
+		r.logQueries.Store(c.LogQueries)
+	case "max-ttl", "cache-max-age":
+		r.p.resolver.SetTTLLimits(uint32(c.CacheMaxAge/time.Second), uint32(c.MaxTTL/time.Second))
+	case "bogus-priv":
+		r.p.BogusPriv.Store(c.BogusPriv)
+	case "use-hosts", "report-client-info", "discovery-dns", "mdns":
+		r.clients.Configure(c)
+	default:
+		return errors.New("not reloadable")
+	}
+	return nil
+}
+
+// canRestartListeners returns false when the listen addresses are managed by
+// the router setup or when the change switches between localhost and LAN
+// mode, which changes the features setup on start.
+func (r *reloader) canRestartListeners(name string, c config.Config) bool {
+	if name != "listen" {
+		return true
+	}
+	return !r.conf.SetupRouter && !c.SetupRouter && isLocalhostMode(&r.conf) == isLocalhostMode(&c)
+}
+
+// applyListenerSettings updates the proxy settings read by the listeners. It
+// must only be called while the proxy is stopped.
+func (r *reloader) applyListenerSettings(c config.Config) {
+	p := &r.p.Proxy
+	p.Addrs = c.Listens
+	p.Timeout = c.Timeout
+	p.MaxInflightRequests = c.MaxInflightRequests
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/discovery"
+	"github.com/nextdns/nextdns/host"
+)
+
+func TestReloader_Reload(t *testing.T) {
+	var c config.Config
+	if err := c.Load("nextdns run", []string{"-profile", "abcdef"}, false); err != nil {
+		t.Fatal(err)
+	}
+	fwd, err := config.NewForwarderTable(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logQueries atomic.Bool
+	r := &reloader{
+		log:        host.NewConsoleLogger("test"),
+		cmd:        "run",
+		args:       []string{"-profile", "123456", "-log-queries", "-forwarder", "lan=192.168.1.1", "-cache-size", "1MB"},
+		profiles:   config.NewProfileSelector(c.Profile),
+		rules:      &ruleManager{fwd: fwd},
+		logQueries: &logQueries,
+		conf:       c,
+	}
+	res := r.Reload()
+	if res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	if want := []string{"cache-size", "forwarder", "log-queries", "profile"}; !reflect.DeepEqual(res.Changed, want) {
+		t.Errorf("Changed = %v, want %v", res.Changed, want)
+	}
+	if want := []string{"forwarder", "log-queries", "profile"}; !reflect.DeepEqual(res.Applied, want) {
+		t.Errorf("Applied = %v, want %v", res.Applied, want)
+	}
+	if want := []string{"cache-size"}; !reflect.DeepEqual(res.RestartRequired, want) {
+		t.Errorf("RestartRequired = %v, want %v", res.RestartRequired, want)
+	}
+	ps := r.profiles.Profiles()
+	if got := ps.Strings(); !reflect.DeepEqual(got, []string{"123456"}) {
+		t.Errorf("profiles = %v, want [123456]", got)
+	}
+	if !logQueries.Load() || len(fwd.Forwarders()) != 1 {
+		t.Errorf("log-queries = %v, forwarders = %v", logQueries.Load(), fwd.Forwarders())
+	}
+
+	// A second reload has nothing to apply but still reports the pending
+	// restart.
+	res = r.Reload()
+	if len(res.Changed) != 0 || !reflect.DeepEqual(res.RestartRequired, []string{"cache-size"}) {
+		t.Errorf("second reload = %+v", res)
+	}
+}
+
+func TestReloader_ReloadInPlace(t *testing.T) {
+	base := []string{"-setup-router", "-report-client-info", "-use-hosts", "-bogus-priv"}
+	var c config.Config
+	if err := c.Load("nextdns run", append([]string{}, base...), false); err != nil {
+		t.Fatal(err)
+	}
+	log := host.NewConsoleLogger("test")
+	p := &proxySvc{}
+	p.BogusPriv = &atomic.Bool{}
+	p.BogusPriv.Store(c.BogusPriv)
+	clients := newClientDiscovery(log)
+	clients.Configure(c)
+	if !clients.Enabled() || clients.local.Load() == nil || !clients.ReportClientInfo() {
+		t.Fatal("discovery not enabled")
+	}
+	r := &reloader{
+		p:        p,
+		log:      log,
+		cmd:      "run",
+		args:     []string{"-setup-router", "-report-client-info=false", "-use-hosts=false", "-bogus-priv=false", "-discovery-dns", "192.168.1.1", "-mdns", "disabled"},
+		profiles: config.NewProfileSelector(c.Profile),
+		clients:  clients,
+		conf:     c,
+	}
+	r.rules = &ruleManager{}
+	r.rules.fwd, _ = config.NewForwarderTable(nil, nil)
+	res := r.Reload()
+	if res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	want := []string{"bogus-priv", "discovery-dns", "mdns", "report-client-info", "use-hosts"}
+	if !reflect.DeepEqual(res.Applied, want) {
+		t.Errorf("Applied = %v, want %v", res.Applied, want)
+	}
+	if res.Restarted || len(res.RestartRequired) > 0 {
+		t.Errorf("Restarted = %v, RestartRequired = %v, want none", res.Restarted, res.RestartRequired)
+	}
+	if p.BogusPriv.Load() {
+		t.Error("bogus-priv not disabled")
+	}
+	if clients.Enabled() || clients.local.Load() != nil || clients.ReportClientInfo() {
+		t.Error("discovery not disabled")
+	}
+	if d, ok := clients.lookup.Load().(*discovery.DNS); !ok || d.Upstream != "192.168.1.1" {
+		t.Errorf("discovery resolver = %#v, want discovery DNS", clients.lookup.Load())
+	}
+}
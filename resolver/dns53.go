@@ -4,13 +4,17 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
+	"github.com/nextdns/nextdns/resolver/endpoint"
 	"github.com/nextdns/nextdns/resolver/query"
 )
 
 // DNS53 is a DNS53 implementation of the Resolver interface.
 type DNS53 struct {
+	// Dialer is used to contact DNS servers. If nil, the egress settings
+	// defined with endpoint.SetEgress are used.
 	Dialer *net.Dialer
 
 	// Cache defines the cache storage implementation for DNS response cache. If
@@ -28,9 +32,7 @@ type DNS53 struct {
 	MaxTTL uint32
 }
 
-var defaultDialer = &net.Dialer{}
-
-func (r DNS53) resolve(ctx context.Context, q query.Query, buf []byte, addr string) (n int, i ResolveInfo, err error) {
+func (r *DNS53) resolve(ctx context.Context, q query.Query, buf []byte, addr string) (n int, i ResolveInfo, err error) {
 	i.Transport = "UDP"
 	var now time.Time
 	n = 0
@@ -40,7 +42,7 @@ func (r DNS53) resolve(ctx context.Context, q query.Query, buf []byte, addr stri
 		if v, found := r.Cache.Get(cacheKey{"", q.Class, q.Type, q.Name}); found {
 			if v, ok := v.(*cacheValue); ok {
 				var minTTL uint32
-				n, minTTL = v.AdjustedResponse(buf, q.ID, r.CacheMaxAge, r.MaxTTL, now)
+				n, minTTL = v.AdjustedResponse(buf, q.ID, atomic.LoadUint32(&r.CacheMaxAge), atomic.LoadUint32(&r.MaxTTL), now)
 				i.FromCache = true
 				if minTTL > 0 {
 					return n, i, nil
@@ -48,11 +50,11 @@ func (r DNS53) resolve(ctx context.Context, q query.Query, buf []byte, addr stri
 			}
 		}
 	}
-	d := r.Dialer
-	if d == nil {
-		d = defaultDialer
+	dial := endpoint.DialContext
+	if r.Dialer != nil {
+		dial = r.Dialer.DialContext
 	}
-	c, err := d.DialContext(ctx, "udp", addr)
+	c, err := dial(ctx, "udp", addr)
 	if err != nil {
 		return n, i, fmt.Errorf("dial: %v", err)
 	}
@@ -96,8 +98,8 @@ func (r DNS53) resolve(ctx context.Context, q query.Query, buf []byte, addr stri
 		copy(v.msg, buf[:n])
 		r.Cache.Add(cacheKey{"", q.Class, q.Type, q.Name}, v)
 	}
-	if r.MaxTTL > 0 {
-		updateTTL(buf[:n], 0, 0, r.MaxTTL)
+	if maxTTL := atomic.LoadUint32(&r.MaxTTL); maxTTL > 0 {
+		updateTTL(buf[:n], 0, 0, maxTTL)
 	}
 	return n, i, nil
 }
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nextdns/nextdns/resolver/query"
@@ -74,7 +75,7 @@ func (r *DOH) resolve(ctx context.Context, q query.Query, buf []byte, rt http.Ro
 		if v, found := r.Cache.Get(cacheKey{url, q.Class, q.Type, q.Name}); found {
 			if v, ok := v.(*cacheValue); ok {
 				var minTTL uint32
-				n, minTTL = v.AdjustedResponse(buf, q.ID, r.CacheMaxAge, r.MaxTTL, now)
+				n, minTTL = v.AdjustedResponse(buf, q.ID, atomic.LoadUint32(&r.CacheMaxAge), atomic.LoadUint32(&r.MaxTTL), now)
 				i.Transport = v.trans
 				i.FromCache = true
 				// Use cached entry if TTL is in the future and isn't older than
@@ -131,8 +132,8 @@ func (r *DOH) resolve(ctx context.Context, q query.Query, buf []byte, rt http.Ro
 		r.Cache.Add(cacheKey{url, q.Class, q.Type, q.Name}, v)
 		r.updateLastMod(url, res.Header.Get("X-Conf-Last-Modified"))
 	}
-	if r.MaxTTL > 0 && n > 0 {
-		updateTTL(buf[:n], 0, 0, r.MaxTTL)
+	if maxTTL := atomic.LoadUint32(&r.MaxTTL); maxTTL > 0 && n > 0 {
+		updateTTL(buf[:n], 0, 0, maxTTL)
 	}
 	return n, i, err
 }
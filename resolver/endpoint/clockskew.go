@@ -0,0 +1,244 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultClockSkewWindow defines the default value for ClockSkew Window.
+	DefaultClockSkewWindow = time.Hour
+
+	// DefaultClockSkewMaxDuration defines the default value for ClockSkew
+	// MaxDuration.
+	DefaultClockSkewMaxDuration = 24 * time.Hour
+)
+
+// ClockSkew allows DoH to work when the local clock is wrong, typically on
+// routers before NTP could sync the time, when NTP itself depends on DNS.
+//
+// When certificate verification fails because of validity dates, the HTTP Date
+// header of the server is fetched and the certificate chain is verified against
+// this time instead. The detected offset is then trusted for Window, after
+// which a new detection is required. Detections stop succeeding once offsets
+// have been in use for MaxDuration, until the local clock allows a successful
+// verification again, which also discards the offset.
+//
+// Beware that the Date header is not authenticated: an attacker in possession
+// of the private key of an expired certificate could use it for up to
+// MaxDuration.
+type ClockSkew struct {
+	// Window is the maximum duration a detected offset is trusted. If zero,
+	// DefaultClockSkewWindow is used.
+	Window time.Duration
+
+	// MaxDuration is the maximum total duration offsets are trusted, across
+	// windows, since the first detection. If zero,
+	// DefaultClockSkewMaxDuration is used.
+	MaxDuration time.Duration
+
+	// OnChange is called when an offset is detected or discarded. The offset
+	// is zero when discarded.
+	OnChange func(offset time.Duration)
+
+	mu     sync.Mutex
+	offset time.Duration
+	until  time.Time
+	// since is the time of the first detection since the offset was last
+	// discarded.
+	since time.Time
+	// detection is the detection in progress, if any.
+	detection *clockSkewDetection
+}
+
+// clockSkewDetection is the result of a detection, set once done is closed.
+type clockSkewDetection struct {
+	done   chan struct{}
+	offset time.Duration
+	err    error
+}
+
+// Offset returns the current clock offset and true if one is in effect.
+func (s *ClockSkew) Offset() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.until.IsZero() || time.Now().After(s.until) {
+		return 0, false
+	}
+	return s.offset, true
+}
+
+func (s *ClockSkew) set(offset time.Duration) {
+	window := s.Window
+	if window == 0 {
+		window = DefaultClockSkewWindow
+	}
+	now := time.Now()
+	s.mu.Lock()
+	s.offset = offset
+	s.until = now.Add(window)
+	if s.since.IsZero() {
+		s.since = now
+	}
+	s.mu.Unlock()
+	if s.OnChange != nil {
+		s.OnChange(offset)
+	}
+}
+
+func (s *ClockSkew) reset() {
+	s.mu.Lock()
+	wasSet := !s.until.IsZero()
+	s.offset = 0
+	s.until = time.Time{}
+	s.since = time.Time{}
+	s.mu.Unlock()
+	if wasSet && s.OnChange != nil {
+		s.OnChange(0)
+	}
+}
+
+// verifyConnection verifies cs against the local time, or the corrected time
+// if the certificates are not valid at local time. If no offset is in effect,
+// one is detected using addrs.
+func (s *ClockSkew) verifyConnection(cs tls.ConnectionState, roots *x509.CertPool, addrs []string) error {
+	err := verifyChain(cs, roots, time.Time{})
+	if err == nil {
+		s.reset()
+		return nil
+	}
+	if !isCertExpiredErr(err) {
+		return err
+	}
+	if offset, ok := s.Offset(); ok {
+		if err := verifyChain(cs, roots, time.Now().Add(offset)); err == nil {
+			return nil
+		}
+	}
+	if offset, derr := s.detect(cs.ServerName, roots, addrs); derr == nil {
+		if verifyChain(cs, roots, time.Now().Add(offset)) == nil {
+			return nil
+		}
+	} else {
+		err = fmt.Errorf("%w (clock skew detection: %v)", err, derr)
+	}
+	return err
+}
+
+// detect fetches the Date header from one of addrs and returns the offset with
+// the local clock if the certificate chain of the server validates at this
+// date. Concurrent calls wait for the detection in progress and share its
+// result.
+func (s *ClockSkew) detect(serverName string, roots *x509.CertPool, addrs []string) (time.Duration, error) {
+	maxDuration := s.MaxDuration
+	if maxDuration == 0 {
+		maxDuration = DefaultClockSkewMaxDuration
+	}
+	s.mu.Lock()
+	if d := s.detection; d != nil {
+		s.mu.Unlock()
+		<-d.done
+		return d.offset, d.err
+	}
+	if !s.since.IsZero() && time.Since(s.since) > maxDuration {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("clock skew tolerated for more than %v", maxDuration)
+	}
+	d := &clockSkewDetection{done: make(chan struct{})}
+	s.detection = d
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.detection = nil
+		s.mu.Unlock()
+		close(d.done)
+	}()
+
+	for _, addr := range addrs {
+		if d.offset, d.err = fetchDateOffset(serverName, roots, addr); d.err == nil {
+			s.set(d.offset)
+			return d.offset, nil
+		}
+	}
+	d.offset = 0
+	if d.err == nil {
+		d.err = errors.New("no address")
+	}
+	return 0, d.err
+}
+
+func fetchDateOffset(serverName string, roots *x509.CertPool, addr string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	nc, err := dialUpstream(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	c := tls.Client(nc, &tls.Config{
+		ServerName: serverName,
+		// The chain is verified below once the server time is known.
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1"},
+	})
+	defer c.Close()
+	if t, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(t)
+	}
+	if err := c.HandshakeContext(ctx); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	req, _ := http.NewRequest("HEAD", "https://"+serverName+"/", nil)
+	req.Close = true
+	if err := req.Write(c); err != nil {
+		return 0, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("date header: %v", err)
+	}
+	// The Date header has a second resolution, use the middle of the request
+	// as local reference.
+	now := start.Add(time.Since(start) / 2)
+	cs := c.ConnectionState()
+	if err := verifyChain(cs, roots, date); err != nil {
+		return 0, fmt.Errorf("verify at %v: %v", date, err)
+	}
+	return date.Sub(now), nil
+}
+
+// verifyChain performs the verification normally done by crypto/tls at
+// currentTime. A zero currentTime means now.
+func verifyChain(cs tls.ConnectionState, roots *x509.CertPool, currentTime time.Time) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		CurrentTime:   currentTime,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func isCertExpiredErr(err error) bool {
+	var certErr x509.CertificateInvalidError
+	return errors.As(err, &certErr) && certErr.Reason == x509.Expired
+}
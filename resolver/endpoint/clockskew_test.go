@@ -0,0 +1,171 @@
+package endpoint
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newSkewedServer returns a TLS server with a certificate only valid in the
+// future, and reporting a Date header at serverTime.
+func newSkewedServer(t *testing.T, serverTime time.Time) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "doh.example"},
+		DNSNames:              []string{"doh.example"},
+		NotBefore:             serverTime.Add(-24 * time.Hour),
+		NotAfter:              serverTime.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", serverTime.UTC().Format(http.TimeFormat))
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	srv.StartTLS()
+	return srv, roots
+}
+
+// dialSkewed performs a TLS handshake with addr, verifying the certificate
+// with s if not nil.
+func dialSkewed(addr string, roots *x509.CertPool, s *ClockSkew) error {
+	conf := &tls.Config{
+		ServerName:         "doh.example",
+		RootCAs:            roots,
+		InsecureSkipVerify: s != nil,
+	}
+	if s != nil {
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			return s.verifyConnection(cs, roots, []string{addr})
+		}
+	}
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, conf)
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+func TestClockSkew_verifyConnection(t *testing.T) {
+	serverTime := time.Now().Add(30 * 24 * time.Hour)
+	srv, roots := newSkewedServer(t, serverTime)
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	var changes []time.Duration
+	skew := &ClockSkew{
+		OnChange: func(offset time.Duration) {
+			changes = append(changes, offset)
+		},
+	}
+	dial := func(s *ClockSkew) error {
+		return dialSkewed(addr, roots, s)
+	}
+
+	if err := dial(nil); err == nil {
+		t.Fatal("standard verification succeeded, want expired error")
+	}
+	if err := dial(skew); err != nil {
+		t.Fatalf("verification with skew detection: %v", err)
+	}
+	offset, ok := skew.Offset()
+	if !ok {
+		t.Fatal("Offset() not set")
+	}
+	if d := offset - 30*24*time.Hour; d < -5*time.Second || d > 5*time.Second {
+		t.Errorf("Offset() = %v, want ~720h", offset)
+	}
+	// Reuse the detected offset.
+	if err := dial(skew); err != nil {
+		t.Fatalf("verification with known offset: %v", err)
+	}
+	if len(changes) != 1 {
+		t.Errorf("OnChange called %d times, want 1", len(changes))
+	}
+}
+
+func TestClockSkew_ConcurrentDetection(t *testing.T) {
+	srv, roots := newSkewedServer(t, time.Now().Add(30*24*time.Hour))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	var changes int32
+	skew := &ClockSkew{
+		OnChange: func(offset time.Duration) {
+			atomic.AddInt32(&changes, 1)
+		},
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- dialSkewed(addr, roots, skew)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent handshake: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&changes); n == 0 {
+		t.Error("OnChange not called")
+	}
+}
+
+func TestClockSkew_MaxDuration(t *testing.T) {
+	srv, roots := newSkewedServer(t, time.Now().Add(30*24*time.Hour))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	skew := &ClockSkew{MaxDuration: time.Hour}
+	if err := dialSkewed(addr, roots, skew); err != nil {
+		t.Fatalf("verification with skew detection: %v", err)
+	}
+	// Expire the window after offsets have been in use for too long.
+	skew.mu.Lock()
+	skew.until = time.Now().Add(-time.Second)
+	skew.since = time.Now().Add(-2 * time.Hour)
+	skew.mu.Unlock()
+	if err := dialSkewed(addr, roots, skew); err == nil {
+		t.Fatal("verification succeeded after MaxDuration")
+	}
+	// Offsets are tolerated again once the local clock was found valid.
+	skew.reset()
+	if err := dialSkewed(addr, roots, skew); err != nil {
+		t.Fatalf("verification after reset: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package endpoint
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// countedConn keeps n incremented while the connection is open.
+type countedConn struct {
+	net.Conn
+	n    *atomic.Int32
+	once sync.Once
+}
+
+func newCountedConn(c net.Conn, n *atomic.Int32) *countedConn {
+	n.Add(1)
+	return &countedConn{Conn: c, n: n}
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.n.Add(-1) })
+	return c.Conn.Close()
+}
@@ -5,13 +5,13 @@ import (
 	"net"
 )
 
-type parallelDialer struct {
-	net.Dialer
-}
+// parallelDialer races connections to several addresses. Connections are
+// established using the egress settings defined with SetEgress.
+type parallelDialer struct{}
 
 func (d *parallelDialer) DialParallel(ctx context.Context, network string, addrs []string) (net.Conn, error) {
 	if len(addrs) == 1 {
-		return d.DialContext(ctx, network, addrs[0])
+		return dialUpstream(ctx, network, addrs[0])
 	}
 	returned := make(chan struct{})
 	defer close(returned)
@@ -23,7 +23,7 @@ func (d *parallelDialer) DialParallel(ctx context.Context, network string, addrs
 	results := make(chan dialResult)
 
 	racer := func(addr string) {
-		c, err := d.DialContext(ctx, network, addr)
+		c, err := dialUpstream(ctx, network, addr)
 		select {
 		case results <- dialResult{Conn: c, error: err}:
 		case <-returned:
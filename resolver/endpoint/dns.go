@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
-	"net"
 )
 
 type DNSEndpoint struct {
@@ -28,8 +27,7 @@ func (e *DNSEndpoint) String() string {
 }
 
 func (e *DNSEndpoint) Exchange(ctx context.Context, payload, buf []byte) (n int, err error) {
-	d := &net.Dialer{}
-	c, err := d.DialContext(ctx, "udp", e.Addr)
+	c, err := DialContext(ctx, "udp", e.Addr)
 	if err != nil {
 		return 0, fmt.Errorf("dial: %v", err)
 	}
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ClientInfo struct {
@@ -38,9 +40,19 @@ type DOHEndpoint struct {
 	// through HTTPSSVC or Alt-Svc. If missing, h2 is assumed.
 	ALPN []string
 
-	once      sync.Once
-	transport http.RoundTripper
-	onConnect func(*ConnectInfo)
+	// TLS defines custom TLS settings for this endpoint. If nil, the settings
+	// set on the Manager, if any, are used.
+	TLS *TLSOptions `json:",omitempty"`
+
+	once       sync.Once
+	defaultTLS *TLSOptions
+	transport  http.RoundTripper
+	onConnect  func(*ConnectInfo)
+	clockSkew  *ClockSkew
+	keepalive  time.Duration
+
+	// conns is the number of open connections to the endpoint.
+	conns atomic.Int32
 }
 
 func (e *DOHEndpoint) Protocol() Protocol {
@@ -49,7 +61,8 @@ func (e *DOHEndpoint) Protocol() Protocol {
 
 func (e *DOHEndpoint) Equal(e2 Endpoint) bool {
 	if e2, ok := e2.(*DOHEndpoint); ok {
-		if e.Hostname != e2.Hostname || e.Path != e2.Path || len(e.Bootstrap) != len(e2.Bootstrap) {
+		if e.Hostname != e2.Hostname || e.Path != e2.Path || len(e.Bootstrap) != len(e2.Bootstrap) ||
+			!e.TLS.Equal(e2.TLS) {
 			return false
 		}
 		for i := range e.Bootstrap {
@@ -63,12 +76,32 @@ func (e *DOHEndpoint) Equal(e2 Endpoint) bool {
 }
 
 func (e *DOHEndpoint) String() string {
+	var frag []string
 	if len(e.Bootstrap) != 0 {
-		return fmt.Sprintf("https://%s%s#%s", e.Hostname, e.Path, strings.Join(e.Bootstrap, ","))
+		frag = append(frag, strings.Join(e.Bootstrap, ","))
+	}
+	if opts := e.TLS.String(); opts != "" {
+		frag = append(frag, opts)
+	}
+	if len(frag) != 0 {
+		return fmt.Sprintf("https://%s%s#%s", e.Hostname, e.Path, strings.Join(frag, "&"))
 	}
 	return fmt.Sprintf("https://%s%s", e.Hostname, e.Path)
 }
 
+// connected returns true if e currently holds an open connection.
+func (e *DOHEndpoint) connected() bool {
+	return e.conns.Load() > 0
+}
+
+// tlsOptions returns the TLS options in effect for e.
+func (e *DOHEndpoint) tlsOptions() *TLSOptions {
+	if e.TLS != nil {
+		return e.TLS
+	}
+	return e.defaultTLS
+}
+
 func (e *DOHEndpoint) Exchange(ctx context.Context, payload, buf []byte) (n int, err error) {
 	req, _ := http.NewRequest("POST", "https://nowhere"+e.Path, bytes.NewReader(payload))
 	req.Header.Set("Content-Type", "application/dns-message")
@@ -0,0 +1,206 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Egress defines how connections to upstream servers are established.
+type Egress struct {
+	// Interface is the name of the network interface upstream sockets are
+	// bound to. On Linux, SO_BINDTODEVICE is used so policy routing can't
+	// override it. On other platforms, an address of the interface is used as
+	// source address.
+	Interface string
+
+	// Source is the source address of upstream sockets. It is only used for
+	// destinations of the same address family.
+	Source net.IP
+
+	// Mark is the firewall mark (SO_MARK) set on upstream sockets. Only
+	// supported on Linux.
+	Mark int
+
+	// Proxy is the URL of a SOCKS5 (socks5://) or HTTP CONNECT (http://)
+	// proxy through which DoH connections are established. Plain DNS is never
+	// proxied.
+	Proxy *url.URL
+}
+
+var egress atomic.Pointer[Egress]
+
+// SetEgress defines the settings used for all upstream connections made by
+// endpoints, the DNS53 resolver and endpoint tests. A nil e restores the
+// default routing.
+func SetEgress(e *Egress) error {
+	if e != nil {
+		if err := e.validate(); err != nil {
+			return err
+		}
+	}
+	egress.Store(e)
+	return nil
+}
+
+// DialContext connects to addr using the egress settings defined with
+// SetEgress. The proxy, if any, is not used.
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return egress.Load().dialer(network, addr).DialContext(ctx, network, addr)
+}
+
+func (e *Egress) validate() error {
+	if e.Mark != 0 && !markSupported {
+		return errors.New("mark: not supported on this platform")
+	}
+	if e.Interface != "" {
+		if _, err := net.InterfaceByName(e.Interface); err != nil {
+			return fmt.Errorf("interface: %v", err)
+		}
+	}
+	if e.Proxy != nil {
+		switch e.Proxy.Scheme {
+		case "socks5", "socks5h", "http":
+		default:
+			return fmt.Errorf("proxy: %s: unsupported scheme", e.Proxy.Scheme)
+		}
+	}
+	return nil
+}
+
+// dialer returns a dialer configured to reach addr over network. The e
+// receiver can be nil.
+func (e *Egress) dialer(network, addr string) *net.Dialer {
+	d := &net.Dialer{}
+	if e == nil {
+		return d
+	}
+	d.Control = egressControl(e.Interface, e.Mark)
+	var dst net.IP
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		dst = net.ParseIP(host)
+	}
+	src := e.Source
+	if src == nil && e.Interface != "" && !bindToDeviceSupported {
+		src = interfaceAddr(e.Interface, dst)
+	}
+	// Use the source only for destinations of the same family.
+	if src != nil && (dst == nil || (dst.To4() == nil) == (src.To4() == nil)) {
+		switch network {
+		case "udp", "udp4", "udp6":
+			d.LocalAddr = &net.UDPAddr{IP: src}
+		default:
+			d.LocalAddr = &net.TCPAddr{IP: src}
+		}
+	}
+	return d
+}
+
+// dialUpstream connects to addr using the egress settings, going through the
+// proxy if any. Only TCP can be proxied.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	e := egress.Load()
+	if e == nil || e.Proxy == nil {
+		d := e.dialer(network, addr)
+		d.FallbackDelay = -1 // disable happy eyeball, we do our own
+		return d.DialContext(ctx, network, addr)
+	}
+	switch e.Proxy.Scheme {
+	case "http":
+		return e.dialHTTPConnect(ctx, addr)
+	default:
+		var auth *proxy.Auth
+		if u := e.Proxy.User; u != nil {
+			auth = &proxy.Auth{User: u.Username()}
+			auth.Password, _ = u.Password()
+		}
+		px, err := proxy.SOCKS5("tcp", e.Proxy.Host, auth, e.dialer("tcp", e.Proxy.Host))
+		if err != nil {
+			return nil, err
+		}
+		return px.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+}
+
+func (e *Egress) dialHTTPConnect(ctx context.Context, addr string) (net.Conn, error) {
+	c, err := e.dialer("tcp", e.Proxy.Host).DialContext(ctx, "tcp", e.Proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(t)
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := e.Proxy.User; u != nil {
+		p, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+p)))
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("proxy: %s", res.Status)
+	}
+	_ = c.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+// bufferedConn is a net.Conn with data already read from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// interfaceAddr returns an address of the iface interface of the same family
+// as dst, or nil if none is found.
+func interfaceAddr(iface string, dst net.IP) net.IP {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if dst == nil || (dst.To4() == nil) == (ipn.IP.To4() == nil) {
+			return ipn.IP
+		}
+	}
+	return nil
+}
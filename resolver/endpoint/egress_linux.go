@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package endpoint
+
+import (
+	"syscall"
+)
+
+const (
+	markSupported         = true
+	bindToDeviceSupported = true
+)
+
+func egressControl(iface string, mark int) func(network, address string, c syscall.RawConn) error {
+	if iface == "" && mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if iface != "" {
+				if serr = syscall.BindToDevice(int(fd), iface); serr != nil {
+					return
+				}
+			}
+			if mark != 0 {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
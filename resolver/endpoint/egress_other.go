@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package endpoint
+
+import (
+	"syscall"
+)
+
+const (
+	markSupported         = false
+	bindToDeviceSupported = false
+)
+
+func egressControl(iface string, mark int) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
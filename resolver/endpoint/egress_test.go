@@ -0,0 +1,87 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestEgress_HTTPConnect(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = c.Write([]byte("hello"))
+	}()
+
+	px, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer px.Close()
+	connected := make(chan string, 1)
+	go func() {
+		c, err := px.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		connected <- req.Method + " " + req.Host
+		tc, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+		defer tc.Close()
+		_, _ = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		_, _ = io.Copy(c, tc)
+	}()
+
+	if err := SetEgress(&Egress{Proxy: &url.URL{Scheme: "http", Host: px.Addr().String()}}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = SetEgress(nil) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := (&parallelDialer{}).DialParallel(ctx, "tcp", []string{target.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	b, _ := io.ReadAll(c)
+	if string(b) != "hello" {
+		t.Errorf("read %q, want hello", b)
+	}
+	if got, want := <-connected, "CONNECT "+target.Addr().String(); got != want {
+		t.Errorf("proxy request %q, want %q", got, want)
+	}
+}
+
+func TestEgress_dialer(t *testing.T) {
+	e := &Egress{Source: net.ParseIP("127.0.0.1")}
+	if d := e.dialer("udp", "127.0.0.2:53"); d.LocalAddr.String() != "127.0.0.1:0" {
+		t.Errorf("udp LocalAddr = %v, want 127.0.0.1:0", d.LocalAddr)
+	}
+	if d := e.dialer("tcp", "[::1]:443"); d.LocalAddr != nil {
+		t.Errorf("tcp6 LocalAddr = %v, want nil", d.LocalAddr)
+	}
+	if err := (&Egress{Proxy: &url.URL{Scheme: "ftp"}}).validate(); err == nil {
+		t.Error("validate() with ftp proxy succeeded, want error")
+	}
+}
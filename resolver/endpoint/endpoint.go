@@ -52,8 +52,16 @@ type Endpoint interface {
 //
 //   - DoH:   https://doh.server.com/path
 //   - DoH:   https://doh.server.com/path#1.2.3.4 // with bootstrap
+//   - DoH:   https://doh.server.com/path#1.2.3.4&pin=sha256/xxx // with TLS options
 //   - DNS53: 1.2.3.4
 //   - DNS53: 1.2.3.4:5353
+//
+// TLS options are separated by & in the URL fragment and can be:
+//
+//   - ca=/path/to/ca.pem: extra CA bundle to trust
+//   - pin=sha256/<base64>: SPKI pin, can be repeated
+//   - sni=name: server name override for SNI and certificate verification
+//   - min-tls=1.2|1.3: minimum TLS version
 func New(server string) (Endpoint, error) {
 	if strings.HasPrefix(server, "https://") {
 		u, err := url.Parse(server)
@@ -64,8 +72,26 @@ func New(server string) (Endpoint, error) {
 			Hostname: u.Host,
 			Path:     u.Path,
 		}
-		if u.Fragment != "" {
-			e.Bootstrap = strings.Split(u.Fragment, ",")
+		for i, opt := range strings.Split(u.Fragment, "&") {
+			if opt == "" {
+				continue
+			}
+			key, value, found := strings.Cut(opt, "=")
+			if !found {
+				if i != 0 {
+					return nil, fmt.Errorf("%s: invalid option", opt)
+				}
+				e.Bootstrap = strings.Split(opt, ",")
+				continue
+			}
+			if e.TLS == nil {
+				e.TLS = &TLSOptions{}
+			}
+			if ok, err := e.TLS.parseOption(key, value); err != nil {
+				return nil, err
+			} else if !ok {
+				return nil, fmt.Errorf("%s: unsupported option", key)
+			}
 		}
 		return e, nil
 	}
@@ -83,6 +109,12 @@ func New(server string) (Endpoint, error) {
 	}, nil
 }
 
+// Test sends an A query for domain to e and returns an error if no response is
+// received.
+func Test(ctx context.Context, e Endpoint, domain string) error {
+	return endpointTester(e)(ctx, domain)
+}
+
 func endpointTester(e Endpoint) func(ctx context.Context, testDomain string) error {
 	return func(ctx context.Context, testDomain string) error {
 		payload := make([]byte, 0, 514)
@@ -14,6 +14,11 @@ import (
 
 var TestDomain = "probe-test.dns.nextdns.io."
 
+// ErrNotSent is returned, possibly wrapped, by Do actions which did not send
+// the query to the endpoint, like when a policy refused it. Such errors do not
+// count toward ErrorThreshold.
+var ErrNotSent = errors.New("query not sent")
+
 const (
 	// DefaultErrorThreshold defines the default value for Manager ErrorThreshold.
 	DefaultErrorThreshold = 10
@@ -71,18 +76,44 @@ type Manager struct {
 	// OnProviderError is called when a provider returns an error.
 	OnProviderError func(p Provider, err error)
 
+	// TLS defines the TLS settings used by DoH endpoints not defining their
+	// own. Certificate pin mismatches are reported through OnError.
+	TLS *TLSOptions
+
+	// Keepalive defines the interval at which HTTP/2 PING frames are sent on
+	// idle DoH connections. If zero, no keepalive is performed and idle
+	// connections are closed after 90 seconds.
+	Keepalive time.Duration
+
+	// ClockSkew, if set, allows DoH endpoints to establish TLS sessions when
+	// the local clock is wrong. See ClockSkew for details.
+	ClockSkew *ClockSkew
+
 	// DebugLog is getting verbose logs if set.
 	DebugLog func(msg string)
 
 	mu             sync.RWMutex
 	activeEndpoint *activeEnpoint
 
+	// standbyEndpoint is the endpoint that would be selected if the active
+	// one failed.
+	standbyEndpoint Endpoint
+
+	statsMu      sync.Mutex
+	connectStats ConnectStats
+
 	testNewTransport func(e *DOHEndpoint) http.RoundTripper
 	testNow          func() time.Time
 }
 
 type Tester func(ctx context.Context, testDomain string) error
 
+// rttRecorder is implemented by providers recording the RTT measured when
+// testing their endpoints.
+type rttRecorder interface {
+	recordRTT(e Endpoint, rtt time.Duration)
+}
+
 // Test forces a test of the endpoints returned by the providers and call
 // OnChange with the newly selected endpoint if different.
 func (m *Manager) Test(ctx context.Context) error {
@@ -131,23 +162,15 @@ func (m *Manager) findBestEndpointLocked(ctx context.Context) (*activeEnpoint, e
 			}
 			continue
 		}
-		for _, e := range endpoints {
+		for i, e := range endpoints {
 			m.debugf("Testing endpoint %s", e)
 			if firstEndpoint == nil {
 				firstEndpoint = e
 			}
 			ae := m.newActiveEndpointLocked(e)
 			testCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-			var tester func(ctx context.Context, testDomain string) error
-			if m.EndpointTester != nil {
-				if t := m.EndpointTester(e); t != nil {
-					tester = t
-				}
-			}
-			if tester == nil {
-				tester = endpointTester(e)
-			}
-			if err = tester(testCtx, TestDomain); err != nil {
+			start := time.Now()
+			if err = m.tester(e)(testCtx, TestDomain); err != nil {
 				cancel()
 				m.debugf("Endpoint err %s", err)
 				if isErrNetUnreachable(err) {
@@ -160,7 +183,15 @@ func (m *Manager) findBestEndpointLocked(ctx context.Context) (*activeEnpoint, e
 				continue
 			}
 			cancel()
+			if r, ok := p.(rttRecorder); ok {
+				r.recordRTT(e, time.Since(start))
+			}
 			m.debugf("Endpoint selected %s", e)
+			m.standbyEndpoint = nil
+			if i+1 < len(endpoints) {
+				m.standbyEndpoint = endpoints[i+1]
+				m.setupEndpointLocked(m.standbyEndpoint)
+			}
 			return ae, nil
 		}
 	}
@@ -171,6 +202,16 @@ func (m *Manager) findBestEndpointLocked(ctx context.Context) (*activeEnpoint, e
 	return ae, nil
 }
 
+// tester returns the Tester to use for e.
+func (m *Manager) tester(e Endpoint) Tester {
+	if m.EndpointTester != nil {
+		if t := m.EndpointTester(e); t != nil {
+			return t
+		}
+	}
+	return endpointTester(e)
+}
+
 func isErrNetUnreachable(err error) bool {
 	for ; err != nil; err = errors.Unwrap(err) {
 		if sysErr, ok := err.(*os.SyscallError); ok {
@@ -202,14 +243,90 @@ func (m *Manager) newActiveEndpointLocked(e Endpoint) (ae *activeEnpoint) {
 	if m.testNow != nil {
 		ae.lastTest = m.testNow()
 	}
+	m.setupEndpointLocked(e)
+	return ae
+}
+
+// setupEndpointLocked applies the manager settings to e.
+func (m *Manager) setupEndpointLocked(e Endpoint) {
 	if doh, ok := e.(*DOHEndpoint); ok {
 		if m.testNewTransport != nil {
 			// Used in unit test to provide fake transport.
 			doh.transport = m.testNewTransport(doh)
 		}
-		doh.onConnect = m.OnConnect
+		doh.onConnect = m.onConnect
+		doh.clockSkew = m.ClockSkew
+		doh.keepalive = m.Keepalive
+		doh.defaultTLS = m.TLS
+	}
+}
+
+func (m *Manager) onConnect(ci *ConnectInfo) {
+	m.statsMu.Lock()
+	m.connectStats.add(ci)
+	m.statsMu.Unlock()
+	if m.OnConnect != nil {
+		m.OnConnect(ci)
+	}
+}
+
+// ConnectStats returns statistics about connections established to DoH
+// endpoints, and whether the active and standby endpoints currently hold an
+// open connection.
+func (m *Manager) ConnectStats() ConnectStats {
+	m.statsMu.Lock()
+	s := m.connectStats
+	m.statsMu.Unlock()
+	m.mu.RLock()
+	if m.activeEndpoint != nil {
+		s.ActiveWarm = isWarm(m.activeEndpoint.Endpoint)
+	}
+	s.StandbyWarm = isWarm(m.standbyEndpoint)
+	m.mu.RUnlock()
+	return s
+}
+
+// isWarm returns true if e is a DoH endpoint with an open connection.
+func isWarm(e Endpoint) bool {
+	doh, ok := e.(*DOHEndpoint)
+	return ok && doh.connected()
+}
+
+// KeepWarm sends a test query to the active endpoint when it has been idle for
+// interval, and to the standby endpoint every interval, so a connection is
+// always ready to be used. Only DoH endpoints are pre-warmed. KeepWarm returns
+// when ctx is done.
+func (m *Manager) KeepWarm(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		m.mu.RLock()
+		ae := m.activeEndpoint
+		standby := m.standbyEndpoint
+		m.mu.RUnlock()
+		if ae != nil && ae.idleSince() >= interval {
+			m.prewarm(ctx, ae.Endpoint)
+		}
+		if standby != nil {
+			m.prewarm(ctx, standby)
+		}
+	}
+}
+
+func (m *Manager) prewarm(ctx context.Context, e Endpoint) {
+	if e.Protocol() != ProtocolDOH {
+		return
+	}
+	ctx, cancel := context.WithTimeout(withPrewarm(ctx), 5*time.Second)
+	defer cancel()
+	if err := m.tester(e)(ctx, TestDomain); err != nil {
+		m.debugf("Prewarm %s: %v", e, err)
 	}
-	return ae
 }
 
 func (m *Manager) getActiveEndpoint() (*activeEnpoint, error) {
@@ -276,6 +393,12 @@ type activeEnpoint struct {
 	testing      bool
 
 	consecutiveErrors uint32
+	lastUsed          int64 // unix nano
+}
+
+// idleSince returns the time since e was last used for a query.
+func (e *activeEnpoint) idleSince() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&e.lastUsed)))
 }
 
 func (e *activeEnpoint) shouldTest() bool {
@@ -338,11 +461,15 @@ func (e *activeEnpoint) test() {
 }
 
 func (e *activeEnpoint) do(action func(e Endpoint) error) error {
+	atomic.StoreInt64(&e.lastUsed, time.Now().UnixNano())
 	if e.shouldTest() {
 		// Perform an opportunistic test.
 		e.test()
 	}
 	if err := action(e.Endpoint); err != nil {
+		if errors.Is(err, ErrNotSent) {
+			return err
+		}
 		errThreshold := e.manager.ErrorThreshold
 		if errThreshold == 0 {
 			errThreshold = DefaultErrorThreshold
@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"reflect"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -147,6 +149,17 @@ func TestManager_SteadyState(t *testing.T) {
 	m.wantErrors(t, []string{})
 }
 
+func TestManager_Standby(t *testing.T) {
+	m := newTestManager(t)
+
+	_ = m.Test(context.Background())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.standbyEndpoint == nil || m.standbyEndpoint.String() != "https://b" {
+		t.Errorf("standby %v, want https://b", m.standbyEndpoint)
+	}
+}
+
 func TestManager_ProviderError(t *testing.T) {
 	m := newTestManager(t)
 	m.errProvider.err = errors.New("cannot load endpoints")
@@ -194,6 +207,24 @@ func TestManager_AutoRecover(t *testing.T) {
 	}
 }
 
+func TestManager_NotSentErrors(t *testing.T) {
+	m := newTestManager(t)
+	m.ErrorThreshold = 2
+
+	_ = m.Test(context.Background())
+	m.transports["https://a"].errs = []error{errors.New("a failed")} // would fail a recovery test
+	for i := 0; i < 5; i++ {
+		_ = m.Do(context.Background(), func(e Endpoint) error {
+			return fmt.Errorf("refused: %w", ErrNotSent)
+		})
+	}
+	runtime.Gosched()
+	m.wantElected(t, "https://a")
+	if n := atomic.LoadUint32(&m.activeEndpoint.consecutiveErrors); n != 0 {
+		t.Errorf("consecutiveErrors = %d, want 0", n)
+	}
+}
+
 func TestManager_OpportunisticTest(t *testing.T) {
 	t.SkipNow()
 	// Start with first endpoint failed, then recover it to ensure the client eventually goes back to it.
@@ -212,3 +243,42 @@ func TestManager_OpportunisticTest(t *testing.T) {
 		})
 	}
 }
+
+func TestManager_ConnectStatsWarm(t *testing.T) {
+	m := newTestManager(t)
+
+	_ = m.Test(context.Background())
+	if s := m.ConnectStats(); s.ActiveWarm || s.StandbyWarm {
+		t.Errorf("warm = %v/%v, want false/false", s.ActiveWarm, s.StandbyWarm)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	standby := m.standbyEndpoint.(*DOHEndpoint)
+	c := newCountedConn(c1, &standby.conns)
+	if s := m.ConnectStats(); s.ActiveWarm || !s.StandbyWarm {
+		t.Errorf("warm = %v/%v, want false/true", s.ActiveWarm, s.StandbyWarm)
+	}
+	_ = c.Close()
+	_ = c.Close()
+	if s := m.ConnectStats(); s.StandbyWarm {
+		t.Errorf("standby warm after close")
+	}
+	if n := standby.conns.Load(); n != 0 {
+		t.Errorf("conns = %d, want 0", n)
+	}
+}
+
+func TestManager_PrewarmEndpointTester(t *testing.T) {
+	m := newTestManager(t)
+	var tested int32
+	m.EndpointTester = func(e Endpoint) Tester {
+		return func(ctx context.Context, testDomain string) error {
+			atomic.AddInt32(&tested, 1)
+			return nil
+		}
+	}
+	m.prewarm(context.Background(), &DOHEndpoint{Hostname: "a"})
+	if n := atomic.LoadInt32(&tested); n != 1 {
+		t.Errorf("EndpointTester called %d times, want 1", n)
+	}
+}
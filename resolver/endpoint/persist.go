@@ -0,0 +1,263 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PersistentProvider wraps a Provider and persists its last successful result
+// to a state file. On first call, the persisted endpoints are returned right
+// away while Provider is refreshed in the background, so a cold start does not
+// have to wait for Provider to answer.
+//
+// Only DoH endpoints are persisted, with their hostname, bootstrap IPs, ALPN
+// and last measured RTT, reported by the Manager after testing an endpoint.
+// Persisted endpoints are returned by increasing RTT, endpoints with an unknown
+// RTT last, so a cold start tries the fastest endpoint first.
+//
+// The state file is only written when the endpoints or their RTT order change,
+// or when it gets older than half MaxAge, to limit writes on the flash storage
+// of routers.
+type PersistentProvider struct {
+	Provider Provider
+
+	// File is the path to the state file.
+	File string
+
+	// MaxAge is the maximum age of the state file for it to be used. If zero,
+	// the state file is always used.
+	MaxAge time.Duration
+
+	// OnError is called when the background refresh or the state file write
+	// fails.
+	OnError func(err error)
+
+	mu     sync.Mutex
+	loaded bool
+	served bool
+	state  *persistedState
+	saved  persistedState // last state written to or read from File
+}
+
+type persistedState struct {
+	Provider  string              `json:"provider"`
+	Updated   time.Time           `json:"updated"`
+	Endpoints []persistedEndpoint `json:"endpoints"`
+}
+
+type persistedEndpoint struct {
+	*DOHEndpoint
+	// RTT is the duration of the last successful test of the endpoint, zero if
+	// unknown.
+	RTT time.Duration `json:"rtt,omitempty"`
+}
+
+func (p *PersistentProvider) String() string {
+	return fmt.Sprintf("PersistentProvider(%s)", p.Provider)
+}
+
+// Endpoints returns the persisted endpoints if any.
+func (p *PersistentProvider) Endpoints() []Endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loadLocked()
+	return p.endpointsLocked()
+}
+
+// GetEndpoints implements the Provider interface.
+func (p *PersistentProvider) GetEndpoints(ctx context.Context) ([]Endpoint, error) {
+	p.mu.Lock()
+	firstCall := !p.served
+	p.served = true
+	p.loadLocked()
+	if firstCall && p.state != nil {
+		endpoints := p.endpointsLocked()
+		p.mu.Unlock()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if _, err := p.refresh(ctx); err != nil && p.OnError != nil {
+				p.OnError(err)
+			}
+		}()
+		return endpoints, nil
+	}
+	p.mu.Unlock()
+	return p.refresh(ctx)
+}
+
+func (p *PersistentProvider) refresh(ctx context.Context) ([]Endpoint, error) {
+	endpoints, err := p.Provider.GetEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st := &persistedState{
+		Provider: p.Provider.String(),
+		Updated:  time.Now(),
+	}
+	for _, e := range endpoints {
+		if doh, ok := e.(*DOHEndpoint); ok {
+			st.Endpoints = append(st.Endpoints, persistedEndpoint{DOHEndpoint: doh})
+		}
+	}
+	p.mu.Lock()
+	// Reuse previous endpoints when identical so we keep our conn pools warm,
+	// and keep their RTT.
+	if p.state != nil {
+		for i, e := range endpoints {
+			for _, pe := range p.state.Endpoints {
+				if e.Equal(pe.DOHEndpoint) {
+					endpoints[i] = pe.DOHEndpoint
+				}
+			}
+		}
+		for i, e := range st.Endpoints {
+			for _, pe := range p.state.Endpoints {
+				if e.Equal(pe.DOHEndpoint) {
+					st.Endpoints[i] = pe
+				}
+			}
+		}
+	}
+	save := false
+	if len(st.Endpoints) > 0 {
+		p.state = st
+		save = p.changedLocked(st)
+	}
+	p.mu.Unlock()
+	if save {
+		if err := p.save(st); err != nil && p.OnError != nil {
+			p.OnError(fmt.Errorf("save %s: %v", p.File, err))
+		}
+	}
+	return endpoints, nil
+}
+
+// recordRTT records the RTT measured for e, saving the state if the order of
+// the endpoints changed.
+func (p *PersistentProvider) recordRTT(e Endpoint, rtt time.Duration) {
+	p.mu.Lock()
+	if p.state == nil {
+		p.mu.Unlock()
+		return
+	}
+	st := *p.state
+	st.Endpoints = append([]persistedEndpoint(nil), st.Endpoints...)
+	found := false
+	for i, pe := range st.Endpoints {
+		if pe.Equal(e) {
+			st.Endpoints[i].RTT = rtt
+			found = true
+		}
+	}
+	save := false
+	if found {
+		p.state = &st
+		save = p.changedLocked(&st)
+	}
+	p.mu.Unlock()
+	if save {
+		if err := p.save(&st); err != nil && p.OnError != nil {
+			p.OnError(fmt.Errorf("save %s: %v", p.File, err))
+		}
+	}
+}
+
+// changedLocked returns true if st needs to be written to File, and records it
+// as saved if so. RTT changes only matter when they change the order of the
+// endpoints.
+func (p *PersistentProvider) changedLocked(st *persistedState) bool {
+	if p.saved.Provider == st.Provider && endpointsKey(p.saved.Endpoints) == endpointsKey(st.Endpoints) &&
+		(p.MaxAge == 0 || st.Updated.Sub(p.saved.Updated) < p.MaxAge/2) {
+		return false
+	}
+	p.saved = *st
+	return true
+}
+
+// endpointsKey returns a key changing when the endpoints, their order by RTT
+// or the endpoints with a known RTT change.
+func endpointsKey(endpoints []persistedEndpoint) string {
+	var b bytes.Buffer
+	for _, e := range sortByRTT(endpoints) {
+		j, _ := json.Marshal(e.DOHEndpoint)
+		b.Write(j)
+		if e.RTT > 0 {
+			b.WriteByte('+')
+		}
+	}
+	return b.String()
+}
+
+// sortByRTT returns a copy of endpoints sorted by increasing RTT, endpoints
+// with an unknown RTT last in their original order.
+func sortByRTT(endpoints []persistedEndpoint) []persistedEndpoint {
+	sorted := append([]persistedEndpoint(nil), endpoints...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ri, rj := sorted[i].RTT, sorted[j].RTT
+		return ri > 0 && (rj == 0 || ri < rj)
+	})
+	return sorted
+}
+
+func (p *PersistentProvider) endpointsLocked() []Endpoint {
+	if p.state == nil {
+		return nil
+	}
+	endpoints := make([]Endpoint, 0, len(p.state.Endpoints))
+	for _, e := range sortByRTT(p.state.Endpoints) {
+		endpoints = append(endpoints, e.DOHEndpoint)
+	}
+	return endpoints
+}
+
+func (p *PersistentProvider) loadLocked() {
+	if p.loaded {
+		return
+	}
+	p.loaded = true
+	b, err := os.ReadFile(p.File)
+	if err != nil {
+		return
+	}
+	var st persistedState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return
+	}
+	for _, e := range st.Endpoints {
+		if e.DOHEndpoint == nil {
+			return
+		}
+	}
+	if st.Provider != p.Provider.String() || len(st.Endpoints) == 0 {
+		// Provider configuration changed, ignore the state.
+		return
+	}
+	if p.MaxAge > 0 && time.Since(st.Updated) > p.MaxAge {
+		return
+	}
+	p.state = &st
+	p.saved = st
+}
+
+func (p *PersistentProvider) save(st *persistedState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.File), 0755); err != nil {
+		return err
+	}
+	tmp := p.File + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.File)
+}
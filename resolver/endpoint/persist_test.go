@@ -0,0 +1,153 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type countProvider struct {
+	endpoints []Endpoint
+	err       error
+	calls     chan struct{}
+}
+
+func (p *countProvider) String() string {
+	return "countProvider"
+}
+
+func (p *countProvider) GetEndpoints(ctx context.Context) ([]Endpoint, error) {
+	defer func() { p.calls <- struct{}{} }()
+	return p.endpoints, p.err
+}
+
+func TestPersistentProvider(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "endpoints.json")
+	src := &countProvider{
+		endpoints: []Endpoint{&DOHEndpoint{Hostname: "a", Bootstrap: []string{"1.2.3.4"}, ALPN: []string{"h3"}}},
+		calls:     make(chan struct{}, 10),
+	}
+
+	// Cold start without state: the provider is called synchronously.
+	p := &PersistentProvider{Provider: src, File: file}
+	if e := p.Endpoints(); len(e) != 0 {
+		t.Fatalf("Endpoints() = %v, want none", e)
+	}
+	got, err := p.GetEndpoints(context.Background())
+	if err != nil || len(got) != 1 {
+		t.Fatalf("GetEndpoints() = %v, %v", got, err)
+	}
+	<-src.calls
+
+	// Start with state: persisted endpoints are returned and the provider is
+	// refreshed in the background.
+	src.err = errors.New("unreachable")
+	p = &PersistentProvider{Provider: src, File: file}
+	if e := p.Endpoints(); len(e) != 1 || e[0].String() != "https://a#1.2.3.4" {
+		t.Fatalf("Endpoints() = %v, want https://a#1.2.3.4", e)
+	}
+	got, err = p.GetEndpoints(context.Background())
+	if err != nil || len(got) != 1 || got[0].String() != "https://a#1.2.3.4" {
+		t.Fatalf("GetEndpoints() = %v, %v", got, err)
+	}
+	if alpn := got[0].(*DOHEndpoint).ALPN; len(alpn) != 1 || alpn[0] != "h3" {
+		t.Errorf("persisted ALPN = %v, want [h3]", alpn)
+	}
+	select {
+	case <-src.calls:
+	case <-time.After(time.Second):
+		t.Fatal("background refresh not performed")
+	}
+	// Next calls go to the provider.
+	if _, err = p.GetEndpoints(context.Background()); err == nil {
+		t.Errorf("GetEndpoints() err = nil, want provider error")
+	}
+
+	// State from another provider configuration is ignored.
+	p = &PersistentProvider{Provider: StaticProvider(nil), File: file}
+	if e := p.Endpoints(); len(e) != 0 {
+		t.Errorf("Endpoints() = %v, want none", e)
+	}
+}
+
+func TestPersistentProvider_WriteOnChange(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "endpoints.json")
+	src := &countProvider{
+		endpoints: []Endpoint{&DOHEndpoint{Hostname: "a", Bootstrap: []string{"1.2.3.4"}}},
+		calls:     make(chan struct{}, 10),
+	}
+	p := &PersistentProvider{Provider: src, File: file, MaxAge: time.Hour}
+	if _, err := p.GetEndpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("state not written: %v", err)
+	}
+
+	// Same endpoints: the state file is not rewritten.
+	_ = os.Remove(file)
+	if _, err := p.GetEndpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("state rewritten with unchanged endpoints")
+	}
+
+	// Changed endpoints: the state file is written.
+	src.endpoints = []Endpoint{&DOHEndpoint{Hostname: "a", Bootstrap: []string{"5.6.7.8"}}}
+	if _, err := p.GetEndpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("state not written with changed endpoints: %v", err)
+	}
+}
+
+func TestPersistentProvider_RTT(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "endpoints.json")
+	a := &DOHEndpoint{Hostname: "a", Bootstrap: []string{"1.2.3.4"}}
+	b := &DOHEndpoint{Hostname: "b", Bootstrap: []string{"5.6.7.8"}}
+	c := &DOHEndpoint{Hostname: "c", Bootstrap: []string{"9.9.9.9"}}
+	src := &countProvider{endpoints: []Endpoint{a, b, c}, calls: make(chan struct{}, 10)}
+	p := &PersistentProvider{Provider: src, File: file}
+
+	// RTTs are recorded by the manager when testing endpoints.
+	m := &Manager{
+		Providers:      []Provider{p},
+		EndpointTester: func(e Endpoint) Tester { return func(ctx context.Context, testDomain string) error { return nil } },
+	}
+	if err := m.Test(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p.state.Endpoints[0].RTT <= 0 {
+		t.Errorf("RTT of tested endpoint not recorded: %+v", p.state.Endpoints[0])
+	}
+
+	p.recordRTT(b, 10*time.Millisecond)
+	p.recordRTT(a, 50*time.Millisecond)
+	p = &PersistentProvider{Provider: src, File: file}
+	var got []string
+	for _, e := range p.Endpoints() {
+		got = append(got, e.(*DOHEndpoint).Hostname)
+	}
+	if want := "b a c"; strings.Join(got, " ") != want {
+		t.Errorf("Endpoints() order = %v, want %s", got, want)
+	}
+
+	// RTT changes keeping the order are not written.
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	p.recordRTT(b, 20*time.Millisecond)
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("state written without order change: %v", err)
+	}
+	p.recordRTT(b, 60*time.Millisecond)
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("state not written on order change: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package endpoint
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrPinMismatch is returned when none of the certificates presented by a DoH
+// server matches the configured SPKI pins.
+var ErrPinMismatch = errors.New("certificate pin mismatch")
+
+// TLSOptions defines custom TLS settings for a DoH endpoint.
+type TLSOptions struct {
+	// CAFile is the path to a PEM bundle of certificates trusted in addition
+	// to the default root CAs.
+	CAFile string `json:"ca,omitempty"`
+
+	// Pins is a set of SPKI fingerprints in the sha256/<base64> format. When
+	// not empty, at least one certificate of the chain presented by the
+	// server must match one of the pins.
+	Pins []string `json:"pins,omitempty"`
+
+	// ServerName overrides the name sent as SNI and used to verify the
+	// server certificate. The Host header is left untouched.
+	ServerName string `json:"sni,omitempty"`
+
+	// MinVersion is the minimum TLS version accepted (tls.VersionTLS12 or
+	// tls.VersionTLS13). If zero, the crypto/tls default is used.
+	MinVersion uint16 `json:"min_tls,omitempty"`
+}
+
+// ParseTLSOptions parses options in the endpoint URL fragment format, i.e.
+// key=value pairs separated by &.
+func ParseTLSOptions(s string) (*TLSOptions, error) {
+	o := &TLSOptions{}
+	for _, opt := range strings.Split(s, "&") {
+		if opt == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(opt, "=")
+		if ok, err := o.parseOption(key, value); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("%s: unsupported TLS option", key)
+		}
+	}
+	return o, nil
+}
+
+// parseOption parses a key=value endpoint option into o. It returns false if
+// key is not a TLS option.
+func (o *TLSOptions) parseOption(key, value string) (bool, error) {
+	switch key {
+	case "ca":
+		// Load the bundle now so an invalid file is reported at parse time
+		// instead of failing every query.
+		if _, err := readCAFile(value); err != nil {
+			return true, err
+		}
+		o.CAFile = value
+	case "pin":
+		if _, err := parsePin(value); err != nil {
+			return true, err
+		}
+		o.Pins = append(o.Pins, value)
+	case "sni":
+		o.ServerName = value
+	case "min-tls":
+		switch value {
+		case "1.2":
+			o.MinVersion = tls.VersionTLS12
+		case "1.3":
+			o.MinVersion = tls.VersionTLS13
+		default:
+			return true, fmt.Errorf("%s: unsupported TLS version", value)
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// String returns the options in the endpoint URL fragment format.
+func (o *TLSOptions) String() string {
+	if o == nil {
+		return ""
+	}
+	var opts []string
+	if o.CAFile != "" {
+		opts = append(opts, "ca="+o.CAFile)
+	}
+	for _, pin := range o.Pins {
+		opts = append(opts, "pin="+pin)
+	}
+	if o.ServerName != "" {
+		opts = append(opts, "sni="+o.ServerName)
+	}
+	switch o.MinVersion {
+	case tls.VersionTLS12:
+		opts = append(opts, "min-tls=1.2")
+	case tls.VersionTLS13:
+		opts = append(opts, "min-tls=1.3")
+	}
+	return strings.Join(opts, "&")
+}
+
+// Equal returns true if o and o2 define the same settings.
+func (o *TLSOptions) Equal(o2 *TLSOptions) bool {
+	return o.String() == o2.String()
+}
+
+// apply updates conf with the options. The returned verify function, if not
+// nil, must be run once the certificate chain has been verified.
+func (o *TLSOptions) apply(conf *tls.Config) (verify func(cs tls.ConnectionState) error, err error) {
+	if o == nil {
+		return nil, nil
+	}
+	if o.CAFile != "" {
+		pem, err := readCAFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		var roots *x509.CertPool
+		if conf.RootCAs != nil {
+			roots = conf.RootCAs.Clone()
+		} else if roots, _ = x509.SystemCertPool(); roots == nil {
+			roots = x509.NewCertPool()
+		}
+		roots.AppendCertsFromPEM(pem)
+		conf.RootCAs = roots
+	}
+	if o.ServerName != "" {
+		conf.ServerName = o.ServerName
+	}
+	if o.MinVersion != 0 {
+		conf.MinVersion = o.MinVersion
+	}
+	if len(o.Pins) > 0 {
+		pins := map[[sha256.Size]byte]bool{}
+		for _, pin := range o.Pins {
+			h, err := parsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins[h] = true
+		}
+		verify = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+			return fmt.Errorf("%w for %s", ErrPinMismatch, cs.ServerName)
+		}
+	}
+	return verify, nil
+}
+
+// readCAFile reads the PEM bundle at path, failing if it does not contain any
+// certificate.
+func readCAFile(path string) ([]byte, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificate found", path)
+	}
+	return pem, nil
+}
+
+// SPKIPin returns the pin of cert in the format expected by TLSOptions.Pins.
+func SPKIPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(h[:])
+}
+
+func parsePin(pin string) (h [sha256.Size]byte, err error) {
+	b64 := strings.TrimPrefix(pin, "sha256/")
+	if b64 == pin {
+		return h, fmt.Errorf("%s: pin must start with sha256/", pin)
+	}
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(b) != sha256.Size {
+		return h, fmt.Errorf("%s: invalid pin", pin)
+	}
+	copy(h[:], b)
+	return h, nil
+}
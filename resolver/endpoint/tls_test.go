@@ -0,0 +1,90 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNew_TLSOptions(t *testing.T) {
+	const pin = "sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	srv.Close()
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		server  string
+		want    string
+		wantErr bool
+	}{
+		{"https://doh.example/dns-query#10.0.0.1,10.0.0.2", "https://doh.example/dns-query#10.0.0.1,10.0.0.2", false},
+		{"https://doh.example#10.0.0.1&pin=" + pin + "&min-tls=1.3", "https://doh.example#10.0.0.1&pin=" + pin + "&min-tls=1.3", false},
+		{"https://doh.example#sni=other.example&ca=" + ca, "https://doh.example#ca=" + ca + "&sni=other.example", false},
+		{"https://doh.example#ca=" + invalid, "", true},
+		{"https://doh.example#ca=" + filepath.Join(dir, "missing.pem"), "", true},
+		{"https://doh.example#pin=md5/abc", "", true},
+		{"https://doh.example#min-tls=1.0", "", true},
+		{"https://doh.example#foo=bar", "", true},
+		{"https://doh.example#sni=a&10.0.0.1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			e, err := New(tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := e.String(); got != tt.want {
+				t.Errorf("New().String() = %v, want %v", got, tt.want)
+			}
+			e2, _ := New(e.String())
+			if !e.Equal(e2) {
+				t.Errorf("New(%v) not equal to itself", e)
+			}
+		})
+	}
+}
+
+func TestTLSOptions_Pins(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	cert := srv.Certificate()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	dial := func(pins ...string) error {
+		conf := &tls.Config{ServerName: "example.com", RootCAs: roots}
+		verify, err := (&TLSOptions{Pins: pins}).apply(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.VerifyConnection = verify
+		c, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", srv.Listener.Addr().String(), conf)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+
+	if err := dial(SPKIPin(cert)); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+	if err := dial("sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="); !errors.Is(err, ErrPinMismatch) {
+		t.Errorf("mismatching pin: err = %v, want %v", err, ErrPinMismatch)
+	}
+}
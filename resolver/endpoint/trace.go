@@ -17,6 +17,28 @@ type ConnectInfo struct {
 	Protocol     string
 	TLSTime      time.Duration
 	TLSVersion   string
+
+	// Prewarm is true when the connection was established ahead of time by
+	// the Manager to keep a warm connection, and not by a query.
+	Prewarm bool
+}
+
+// Latency returns the time spent to establish the connection, including the
+// TLS handshake.
+func (ci *ConnectInfo) Latency() time.Duration {
+	return ci.ConnectTimes[ci.ServerAddr] + ci.TLSTime
+}
+
+type prewarmKey struct{}
+
+// withPrewarm marks ctx as being used to pre-warm a connection.
+func withPrewarm(ctx context.Context) context.Context {
+	return context.WithValue(ctx, prewarmKey{}, true)
+}
+
+func isPrewarm(ctx context.Context) bool {
+	prewarm, _ := ctx.Value(prewarmKey{}).(bool)
+	return prewarm
 }
 
 type timer struct {
@@ -29,7 +51,7 @@ func (t *timer) done() {
 }
 
 func withConnectInfo(ctx context.Context) (context.Context, *ConnectInfo) {
-	ci := &ConnectInfo{Protocol: "TCP"}
+	ci := &ConnectInfo{Protocol: "TCP", Prewarm: isPrewarm(ctx)}
 	mu := &sync.Mutex{}
 	connectTimes := map[string]*timer{}
 	var tlsStart time.Time
@@ -99,3 +121,27 @@ func (rt roundTripperConnectTracer) RoundTrip(req *http.Request) (resp *http.Res
 	}
 	return resp, err
 }
+
+// ConnectStats aggregates connection establishment information.
+type ConnectStats struct {
+	Connects     uint64        `json:"connects"`
+	Prewarms     uint64        `json:"prewarms"`
+	LastLatency  time.Duration `json:"last_latency"`
+	TotalLatency time.Duration `json:"total_latency"`
+	LastConnect  time.Time     `json:"last_connect"`
+
+	// ActiveWarm and StandbyWarm are true when the active and standby
+	// endpoints hold an open connection.
+	ActiveWarm  bool `json:"active_warm"`
+	StandbyWarm bool `json:"standby_warm"`
+}
+
+func (s *ConnectStats) add(ci *ConnectInfo) {
+	s.Connects++
+	if ci.Prewarm {
+		s.Prewarms++
+	}
+	s.LastLatency = ci.Latency()
+	s.TotalLatency += s.LastLatency
+	s.LastConnect = time.Now()
+}
@@ -3,6 +3,7 @@ package endpoint
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"time"
@@ -17,25 +18,48 @@ type transport struct {
 
 func newTransportH2(e *DOHEndpoint, addrs []string) http.RoundTripper {
 	d := &parallelDialer{}
-	d.FallbackDelay = -1 // disable happy eyeball, we do our own
-	var t http.RoundTripper = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			ServerName:         e.Hostname,
-			RootCAs:            getRootCAs(),
-			ClientSessionCache: tls.NewLRUClientSessionCache(0),
-			// Exclude post-quantum hybrid key exchanges (SecP256r1MLKEM768,
-			// SecP384r1MLKEM1024) enabled by default in Go 1.26. These add
-			// ~1KB to TLS handshakes which is problematic on constrained
-			// router platforms (MIPS, ARM).
-			CurvePreferences: []tls.CurveID{
-				tls.X25519,
-				tls.CurveP256,
-				tls.CurveP384,
-			},
+	tlsConfig := &tls.Config{
+		ServerName:         e.Hostname,
+		RootCAs:            getRootCAs(),
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		// Exclude post-quantum hybrid key exchanges (SecP256r1MLKEM768,
+		// SecP384r1MLKEM1024) enabled by default in Go 1.26. These add
+		// ~1KB to TLS handshakes which is problematic on constrained
+		// router platforms (MIPS, ARM).
+		CurvePreferences: []tls.CurveID{
+			tls.X25519,
+			tls.CurveP256,
+			tls.CurveP384,
 		},
+	}
+	verifyPins, err := e.tlsOptions().apply(tlsConfig)
+	if err != nil {
+		return errRoundTripper{fmt.Errorf("tls options: %v", err)}
+	}
+	if skew := e.clockSkew; skew != nil {
+		// Verify the chain ourselves so we can use a corrected time when the
+		// local clock is wrong.
+		roots := tlsConfig.RootCAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := skew.verifyConnection(cs, roots, addrs); err != nil {
+				return err
+			}
+			if verifyPins != nil {
+				return verifyPins(cs)
+			}
+			return nil
+		}
+	} else if verifyPins != nil {
+		// Called after the standard chain verification.
+		tlsConfig.VerifyConnection = verifyPins
+	}
+	ht := &http.Transport{
+		TLSClientConfig: tlsConfig,
 		DialContext: func(ctx context.Context, network, _ string) (c net.Conn, err error) {
 			c, err = d.DialParallel(ctx, network, addrs)
 			if c != nil {
+				c = newCountedConn(c, &e.conns)
 				// Try to workaround the bug describe in this issue:
 				// https://github.com/golang/go/issues/23559
 				//
@@ -55,6 +79,16 @@ func newTransportH2(e *DOHEndpoint, addrs []string) http.RoundTripper {
 		ForceAttemptHTTP2: true,
 		IdleConnTimeout:   90 * time.Second,
 	}
+	if e.keepalive > 0 {
+		// Send PING frames on idle connections so middleboxes do not drop
+		// them, and dead connections are detected before the next query.
+		// Idle connections are then kept open indefinitely.
+		ht.HTTP2 = &http.HTTP2Config{
+			SendPingTimeout: e.keepalive,
+		}
+		ht.IdleConnTimeout = 0
+	}
+	var t http.RoundTripper = ht
 	if e.onConnect != nil {
 		t = roundTripperConnectTracer{
 			RoundTripper: t,
@@ -64,6 +98,15 @@ func newTransportH2(e *DOHEndpoint, addrs []string) http.RoundTripper {
 	return t
 }
 
+// errRoundTripper fails all requests with err.
+type errRoundTripper struct {
+	err error
+}
+
+func (t errRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
 func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.URL.Host = t.addr
 	req.Host = t.hostname
@@ -0,0 +1,378 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"github.com/nextdns/nextdns/resolver/query"
+)
+
+// Strategy defines how a Group distributes queries over its endpoints.
+type Strategy int
+
+const (
+	// StrategyFailover sends queries to the first healthy endpoint in order.
+	StrategyFailover Strategy = iota
+
+	// StrategyRoundRobin rotates queries over healthy endpoints.
+	StrategyRoundRobin
+
+	// StrategyRandom sends queries to a random healthy endpoint.
+	StrategyRandom
+
+	// StrategyFastest sends queries to the healthy endpoint with the lowest
+	// average response time.
+	StrategyFastest
+
+	// StrategyRace sends queries to all healthy endpoints in parallel and
+	// returns the first successful response.
+	StrategyRace
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case StrategyRoundRobin:
+		return "round-robin"
+	case StrategyRandom:
+		return "random"
+	case StrategyFastest:
+		return "fastest"
+	case StrategyRace:
+		return "parallel-race"
+	default:
+		return "failover"
+	}
+}
+
+func (s Strategy) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ParseStrategy returns the Strategy named s.
+func ParseStrategy(s string) (Strategy, error) {
+	for _, st := range []Strategy{StrategyFailover, StrategyRoundRobin, StrategyRandom, StrategyFastest, StrategyRace} {
+		if st.String() == s {
+			return st, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: unsupported strategy", s)
+}
+
+const (
+	// DefaultMaxFails defines the default value for Group MaxFails.
+	DefaultMaxFails = 3
+
+	// groupRetryDelay is the duration after which an endpoint marked down is
+	// tried again when no health check is configured.
+	groupRetryDelay = 30 * time.Second
+)
+
+// Group is a Resolver distributing queries over a set of endpoints following
+// a Strategy. Endpoints are marked down after MaxFails consecutive errors and
+// are brought back up by health checks (see Run) or after a retry delay.
+type Group struct {
+	DOH   DOH
+	DNS53 DNS53
+
+	Endpoints []endpoint.Endpoint
+
+	Strategy Strategy
+
+	// ProbeName is the domain queried by health checks. If empty,
+	// endpoint.TestDomain is used.
+	ProbeName string
+
+	// HealthInterval defines the interval between two health checks. If zero,
+	// Run does not perform any check.
+	HealthInterval time.Duration
+
+	// MaxFails is the number of consecutive errors after which an endpoint is
+	// marked down. If zero, DefaultMaxFails is used.
+	MaxFails int
+
+	once    sync.Once
+	members []*groupMember
+	next    uint32
+}
+
+type groupMember struct {
+	endpoint.Endpoint
+
+	fails     int32
+	downUntil int64 // unix nano, 0 when up
+	rtt       int64 // EWMA in nanoseconds
+	queries   uint64
+	errors    uint64
+
+	mu        sync.Mutex
+	lastError string
+	lastCheck time.Time
+}
+
+// MemberStatus describes the state of a Group endpoint.
+type MemberStatus struct {
+	Endpoint  string        `json:"endpoint"`
+	Healthy   bool          `json:"healthy"`
+	RTT       time.Duration `json:"rtt"`
+	Queries   uint64        `json:"queries"`
+	Errors    uint64        `json:"errors"`
+	LastError string        `json:"last_error,omitempty"`
+	LastCheck time.Time     `json:"last_check,omitempty"`
+}
+
+func (g *Group) init() {
+	g.once.Do(func() {
+		for _, e := range g.Endpoints {
+			g.members = append(g.members, &groupMember{Endpoint: e})
+		}
+	})
+}
+
+func (g *Group) String() string {
+	return fmt.Sprintf("Group(%s, %v)", g.Strategy, g.Endpoints)
+}
+
+// Status returns the status of each endpoint of the group.
+func (g *Group) Status() []MemberStatus {
+	g.init()
+	st := make([]MemberStatus, 0, len(g.members))
+	for _, m := range g.members {
+		m.mu.Lock()
+		st = append(st, MemberStatus{
+			Endpoint:  m.Endpoint.String(),
+			Healthy:   m.healthy(time.Now()),
+			RTT:       time.Duration(atomic.LoadInt64(&m.rtt)),
+			Queries:   atomic.LoadUint64(&m.queries),
+			Errors:    atomic.LoadUint64(&m.errors),
+			LastError: m.lastError,
+			LastCheck: m.lastCheck,
+		})
+		m.mu.Unlock()
+	}
+	return st
+}
+
+// Run performs health checks every HealthInterval until ctx is done.
+func (g *Group) Run(ctx context.Context) {
+	g.init()
+	if g.HealthInterval <= 0 {
+		return
+	}
+	tick := time.NewTicker(g.HealthInterval)
+	defer tick.Stop()
+	for {
+		g.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (g *Group) check(ctx context.Context) {
+	probe := g.ProbeName
+	if probe == "" {
+		probe = endpoint.TestDomain
+	} else if !strings.HasSuffix(probe, ".") {
+		probe += "."
+	}
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func(m *groupMember) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			start := time.Now()
+			err := endpoint.Test(ctx, m.Endpoint, probe)
+			m.mu.Lock()
+			m.lastCheck = start
+			m.mu.Unlock()
+			if err != nil {
+				// Probe failures count toward MaxFails like query failures.
+				// Once down, m stays down until the next successful check.
+				m.fail(err, g.maxFails(), 0)
+				return
+			}
+			m.success(time.Since(start))
+		}(m)
+	}
+	wg.Wait()
+}
+
+// Resolve implements Resolver interface.
+func (g *Group) Resolve(ctx context.Context, q query.Query, buf []byte) (n int, i ResolveInfo, err error) {
+	g.init()
+	members := g.candidates()
+	if len(members) == 0 {
+		return 0, i, errors.New("no endpoint")
+	}
+	if g.Strategy == StrategyRace && len(members) > 1 {
+		return g.race(ctx, q, buf, members)
+	}
+	for _, m := range members {
+		if n, i, err = g.resolveMember(ctx, q, buf, m); err == nil {
+			return n, i, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return n, i, err
+}
+
+// candidates returns the members to try in order of preference.
+func (g *Group) candidates() []*groupMember {
+	now := time.Now()
+	members := make([]*groupMember, 0, len(g.members))
+	for _, m := range g.members {
+		if m.healthy(now) {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		// All endpoints are down, try them all in order.
+		return append(members, g.members...)
+	}
+	switch g.Strategy {
+	case StrategyRoundRobin:
+		n := int(atomic.AddUint32(&g.next, 1)-1) % len(members)
+		members = append(members[n:], members[:n]...)
+	case StrategyRandom:
+		rand.Shuffle(len(members), func(i, j int) {
+			members[i], members[j] = members[j], members[i]
+		})
+	case StrategyFastest:
+		// Endpoints with no RTT yet are tried first so they get measured.
+		sort.SliceStable(members, func(i, j int) bool {
+			return atomic.LoadInt64(&members[i].rtt) < atomic.LoadInt64(&members[j].rtt)
+		})
+	}
+	return members
+}
+
+func (g *Group) race(ctx context.Context, q query.Query, buf []byte, members []*groupMember) (n int, i ResolveInfo, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		n   int
+		i   ResolveInfo
+		err error
+		buf []byte
+	}
+	results := make(chan result, len(members))
+	for _, m := range members {
+		go func(m *groupMember) {
+			b := make([]byte, len(buf))
+			n, i, err := g.resolveMember(ctx, q, b, m)
+			results <- result{n, i, err, b}
+		}(m)
+	}
+	for range members {
+		r := <-results
+		if r.err == nil {
+			return copy(buf, r.buf[:r.n]), r.i, nil
+		}
+		err = r.err
+	}
+	return 0, i, err
+}
+
+func (g *Group) resolveMember(ctx context.Context, q query.Query, buf []byte, m *groupMember) (n int, i ResolveInfo, err error) {
+	atomic.AddUint64(&m.queries, 1)
+	start := time.Now()
+	switch e := m.Endpoint.(type) {
+	case *endpoint.DOHEndpoint:
+		if n, i, err = g.DOH.resolve(ctx, q, buf, e); err != nil {
+			err = fmt.Errorf("doh resolve: %v", err)
+		}
+	case *endpoint.DNSEndpoint:
+		if n, i, err = g.DNS53.resolve(ctx, q, buf, e.Addr); err != nil {
+			err = fmt.Errorf("dns resolve: %v", err)
+		}
+	default:
+		err = fmt.Errorf("dns resolve: unsupported type: %T", e)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			// Do not penalize endpoints for cancelled queries (lost races).
+			atomic.AddUint64(&m.errors, 1)
+			m.fail(err, g.maxFails(), g.retryDelay())
+		}
+		return n, i, err
+	}
+	if !i.FromCache {
+		m.success(time.Since(start))
+	}
+	return n, i, nil
+}
+
+func (g *Group) maxFails() int {
+	if g.MaxFails > 0 {
+		return g.MaxFails
+	}
+	return DefaultMaxFails
+}
+
+func (g *Group) retryDelay() time.Duration {
+	if g.HealthInterval > 0 {
+		// Health checks bring the endpoint back.
+		return 0
+	}
+	return groupRetryDelay
+}
+
+func (m *groupMember) healthy(now time.Time) bool {
+	until := atomic.LoadInt64(&m.downUntil)
+	if until == 0 {
+		return true
+	}
+	return until > 0 && now.UnixNano() > until
+}
+
+func (m *groupMember) fail(err error, maxFails int, retryDelay time.Duration) {
+	if int(atomic.AddInt32(&m.fails, 1)) >= maxFails {
+		m.markDown(err, retryDelay)
+		return
+	}
+	m.mu.Lock()
+	m.lastError = err.Error()
+	m.mu.Unlock()
+}
+
+// markDown marks m as down for retryDelay. If retryDelay is zero, m stays down
+// until the next successful health check.
+func (m *groupMember) markDown(err error, retryDelay time.Duration) {
+	until := int64(-1)
+	if retryDelay > 0 {
+		until = time.Now().Add(retryDelay).UnixNano()
+	}
+	atomic.StoreInt64(&m.downUntil, until)
+	m.mu.Lock()
+	m.lastError = err.Error()
+	m.mu.Unlock()
+}
+
+func (m *groupMember) success(rtt time.Duration) {
+	atomic.StoreInt32(&m.fails, 0)
+	atomic.StoreInt64(&m.downUntil, 0)
+	for {
+		old := atomic.LoadInt64(&m.rtt)
+		v := int64(rtt)
+		if old != 0 {
+			v = (old*7 + v) / 8
+		}
+		if atomic.CompareAndSwapInt64(&m.rtt, old, v) {
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nextdns/nextdns/internal/testutil"
+	"github.com/nextdns/nextdns/resolver/endpoint"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestGroupServer(t *testing.T) (*testutil.MockDNSServer, *testutil.CountingHandler) {
+	t.Helper()
+	counter := testutil.NewCountingHandler(testutil.SimpleDNSHandler(net.ParseIP("1.2.3.4")))
+	server, err := testutil.NewMockDNSServer(counter.Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, counter
+}
+
+func TestGroup_RoundRobin(t *testing.T) {
+	s1, c1 := newTestGroupServer(t)
+	defer s1.Close()
+	s2, c2 := newTestGroupServer(t)
+	defer s2.Close()
+
+	g, err := NewGroup(s1.Addr + "," + s2.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Strategy = StrategyRoundRobin
+	q := makeTestQuery(t, "example.com.", dnsmessage.TypeA)
+	for i := 0; i < 4; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if _, _, err := g.Resolve(ctx, q, make([]byte, 512)); err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		cancel()
+	}
+	if c1.Count() != 2 || c2.Count() != 2 {
+		t.Errorf("queries = %d/%d, want 2/2", c1.Count(), c2.Count())
+	}
+}
+
+func TestGroup_FailoverMarkDown(t *testing.T) {
+	dead, _ := newTestGroupServer(t)
+	deadAddr := dead.Addr
+	dead.Close()
+	s, c := newTestGroupServer(t)
+	defer s.Close()
+
+	g := &Group{
+		Endpoints: []endpoint.Endpoint{
+			&endpoint.DNSEndpoint{Addr: deadAddr},
+			&endpoint.DNSEndpoint{Addr: s.Addr},
+		},
+		MaxFails: 1,
+	}
+	q := makeTestQuery(t, "example.com.", dnsmessage.TypeA)
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		_, _, err := g.Resolve(ctx, q, make([]byte, 512))
+		cancel()
+		if err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+	}
+	if c.Count() != 3 {
+		t.Errorf("queries = %d, want 3", c.Count())
+	}
+	st := g.Status()
+	if st[0].Healthy || !st[1].Healthy {
+		t.Errorf("healthy = %v/%v, want false/true", st[0].Healthy, st[1].Healthy)
+	}
+	if st[0].Queries != 1 {
+		t.Errorf("dead endpoint queries = %d, want 1", st[0].Queries)
+	}
+}
+
+func TestGroup_CheckMaxFails(t *testing.T) {
+	dead, _ := newTestGroupServer(t)
+	deadAddr := dead.Addr
+	dead.Close()
+
+	g := &Group{
+		Endpoints: []endpoint.Endpoint{&endpoint.DNSEndpoint{Addr: deadAddr}},
+		MaxFails:  3,
+	}
+	g.init()
+	for i := 1; i <= 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		g.check(ctx)
+		cancel()
+		if healthy, want := g.Status()[0].Healthy, i < 3; healthy != want {
+			t.Fatalf("check %d: healthy = %v, want %v", i, healthy, want)
+		}
+	}
+}
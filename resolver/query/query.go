@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/nextdns/nextdns/arp"
 	"github.com/nextdns/nextdns/internal/dnsmessage"
@@ -20,6 +21,7 @@ type Query struct {
 	LocalIP          net.IP
 	PeerIP           net.IP
 	MAC              net.HardwareAddr
+	Listener         string // address of the proxy listener receiving the query
 	Payload          []byte
 }
 
@@ -101,6 +103,23 @@ func (t Type) String() string {
 	return s
 }
 
+// ParseType returns the Type named s (e.g. AAAA) or with the numeric value s.
+func ParseType(s string) (Type, error) {
+	for t, name := range typeNames {
+		if strings.EqualFold(name, s) {
+			return t, nil
+		}
+	}
+	if strings.HasPrefix(strings.ToUpper(s), "TYPE") {
+		s = s[4:]
+	}
+	v, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%s: unknown query type", s)
+	}
+	return Type(v), nil
+}
+
 const (
 	EDNS0_SUBNET = 0x8
 	EDNS0_MAC    = 0xfde9 // as defined by dnsmasq --add-mac feature
@@ -35,12 +35,32 @@ type CacheStats struct {
 }
 
 type DNS struct {
-	DOH        DOH
-	DNS53      DNS53
-	Manager    *endpoint.Manager
+	DOH     DOH
+	DNS53   DNS53
+	Manager *endpoint.Manager
+
+	// AllowPlainDNS is called before q is sent to a plain DNS endpoint. If
+	// defined and false is returned, q is not sent and ErrPlainDNSRefused is
+	// returned instead.
+	AllowPlainDNS func(q query.Query) bool
+
 	cacheStats CacheStats
 }
 
+// SetTTLLimits updates the CacheMaxAge and MaxTTL of both the DoH and DNS53
+// resolvers. It is safe to call while queries are being resolved.
+func (r *DNS) SetTTLLimits(cacheMaxAge, maxTTL uint32) {
+	atomic.StoreUint32(&r.DOH.CacheMaxAge, cacheMaxAge)
+	atomic.StoreUint32(&r.DOH.MaxTTL, maxTTL)
+	atomic.StoreUint32(&r.DNS53.CacheMaxAge, cacheMaxAge)
+	atomic.StoreUint32(&r.DNS53.MaxTTL, maxTTL)
+}
+
+// ErrPlainDNSRefused is returned, wrapped with endpoint.ErrNotSent, when a
+// query is not allowed to be sent over plain DNS. Refused queries are not
+// endpoint errors and do not trigger endpoint tests.
+var ErrPlainDNSRefused = errors.New("refused over plain DNS")
+
 type ResolveInfo struct {
 	Transport string
 	Profile   string
@@ -75,6 +95,23 @@ func New(servers string) (Resolver, error) {
 	}, nil
 }
 
+// NewGroup returns a Group for the comma separated list of servers, using the
+// same format as New. The returned group uses the failover strategy.
+func NewGroup(servers string) (*Group, error) {
+	g := &Group{}
+	for _, addr := range strings.Split(servers, ",") {
+		e, err := endpoint.New(strings.TrimSpace(addr))
+		if err != nil {
+			return nil, fmt.Errorf("%s: unsupported resolver address: %v", addr, err)
+		}
+		g.Endpoints = append(g.Endpoints, e)
+	}
+	if len(g.Endpoints) == 0 {
+		return nil, errors.New("empty server list")
+	}
+	return g, nil
+}
+
 // Resolve implements Resolver interface.
 func (r *DNS) Resolve(ctx context.Context, q query.Query, buf []byte) (n int, i ResolveInfo, err error) {
 	err = r.Manager.Do(ctx, func(e endpoint.Endpoint) error {
@@ -85,6 +122,9 @@ func (r *DNS) Resolve(ctx context.Context, q query.Query, buf []byte) (n int, i
 				return fmt.Errorf("doh resolve: %v", err2)
 			}
 		case *endpoint.DNSEndpoint:
+			if r.AllowPlainDNS != nil && !r.AllowPlainDNS(q) {
+				return fmt.Errorf("%w: %w", ErrPlainDNSRefused, endpoint.ErrNotSent)
+			}
 			if n, i, err2 = r.DNS53.resolve(ctx, q, buf, e.Addr); err2 != nil {
 				return fmt.Errorf("dns resolve: %v", err2)
 			}
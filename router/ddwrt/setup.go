@@ -14,8 +14,10 @@ import (
 type Router struct {
 	ListenPort      string
 	ClientReporting bool
+	Firewall        internal.Firewall
 	CacheEnabled    bool
-	savedParams     []string
+
+	journal *internal.Journal
 }
 
 func New() (*Router, bool) {
@@ -25,6 +27,8 @@ func New() (*Router, bool) {
 	}
 	return &Router{
 		ListenPort: "5342",
+		Firewall:   internal.Firewall{LANInterfaces: []string{"br0"}},
+		journal:    internal.NewJournal("/jffs/etc/nextdns.router-journal"),
 	}, true
 }
 
@@ -35,6 +39,7 @@ func (r *Router) String() string {
 func (r *Router) Configure(c *config.Config) error {
 	c.Listens = []string{"127.0.0.1:" + r.ListenPort}
 	r.ClientReporting = c.ReportClientInfo
+	r.Firewall.Configure(c)
 	if cs, _ := config.ParseBytes(c.CacheSize); cs > 0 {
 		r.CacheEnabled = true
 		c.Listens = []string{":53"}
@@ -45,9 +50,30 @@ func (r *Router) Configure(c *config.Config) error {
 
 func (r *Router) Setup() error {
 	if !r.CacheEnabled {
-		return r.setupDNSMasq()
+		if err := r.setupDNSMasq(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return r.journal.SetupFirewall(r.Firewall)
+}
+
+// Plan returns the changes Configure and Setup would make with c, without
+// making them.
+func (r *Router) Plan(c *config.Config) ([]internal.Change, error) {
+	dry := *r
+	dry.journal = r.journal.DryRun()
+	return internal.Plan(dry.journal, c, dry.Configure, dry.Setup)
+}
+
+// Status returns the changes made by Setup which are not in place.
+func (r *Router) Status(c *config.Config) ([]internal.Change, error) {
+	changes, err := r.Plan(c)
+	return internal.Drift(changes), err
+}
+
+// RestorePending returns true if the setup of a previous run was not restored.
+func (r *Router) RestorePending() bool {
+	return r.journal.Pending()
 }
 
 func (r *Router) setupDNSMasq() error {
@@ -61,15 +87,11 @@ func (r *Router) setupDNSMasq() error {
 		return err
 	}
 
-	// Save nvram values so we can restore them.
-	if r.savedParams, err = internal.NVRAM(
-		"dns_dnsmasq",
-		"dnsmasq_options",
-		"dns_crypt",
-		"dnssec",
-		"dnsmasq_no_dns_rebind",
-		"dnsmasq_add_mac"); err != nil {
-		return err
+	// Restart dnsmasq after the nvram values are restored.
+	for _, args := range [][]string{{"startservice", "dnsmasq"}, {"stopservice", "dnsmasq"}} {
+		if err := r.journal.Record(internal.JournalEntry{Op: internal.UndoExec, Args: args}); err != nil {
+			return err
+		}
 	}
 
 	// Configure the firmware:
@@ -81,7 +103,7 @@ func (r *Router) setupDNSMasq() error {
 	//   the validation will fail as blocking alters the response. NextDNS takes care
 	//   of DNS validation for non blocked queries.
 	// * DNS over TLS is disabled so stubby does not run for nothing.
-	if err := internal.SetNVRAM(
+	if err := r.journal.SetNVRAM(
 		"dns_dnsmasq=1",
 		"dnsmasq_options="+buf.String(),
 		"dns_crypt=0",
@@ -92,23 +114,20 @@ func (r *Router) setupDNSMasq() error {
 	}
 
 	// Restart dnsmasq service to apply changes.
-	return restartDNSMasq()
+	return r.restartDNSMasq()
 }
 
+// Restore undoes the changes recorded by Setup, including the ones of a
+// previous run.
 func (r *Router) Restore() error {
-	// Restore previous settings.
-	if err := internal.SetNVRAM(r.savedParams...); err != nil {
-		return err
-	}
-	// Restart dnsmasq service to apply changes.
-	return restartDNSMasq()
+	return r.journal.Rollback()
 }
 
-func restartDNSMasq() error {
-	if err := exec.Command("stopservice", "dnsmasq").Run(); err != nil {
+func (r *Router) restartDNSMasq() error {
+	if err := r.journal.Exec("stopservice", "dnsmasq"); err != nil {
 		return fmt.Errorf("stopservice dnsmasq: %v", err)
 	}
-	if err := exec.Command("startservice", "dnsmasq").Run(); err != nil {
+	if err := r.journal.Exec("startservice", "dnsmasq"); err != nil {
 		return fmt.Errorf("startservice dnsmasq: %v", err)
 	}
 	return nil
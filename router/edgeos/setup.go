@@ -3,7 +3,6 @@ package edgeos
 import (
 	"fmt"
 	"os"
-	"os/exec"
 
 	"github.com/nextdns/nextdns/config"
 	"github.com/nextdns/nextdns/router/internal"
@@ -13,7 +12,10 @@ type Router struct {
 	DNSMasqPath     string
 	ListenPort      string
 	ClientReporting bool
+	Firewall        internal.Firewall
 	CacheEnabled    bool
+
+	journal *internal.Journal
 }
 
 func New() (*Router, bool) {
@@ -25,6 +27,7 @@ func New() (*Router, bool) {
 	return &Router{
 		DNSMasqPath: "/etc/dnsmasq.d/nextdns.conf",
 		ListenPort:  "5342",
+		journal:     internal.NewJournal("/config/nextdns.router-journal"),
 	}, true
 }
 
@@ -35,6 +38,7 @@ func (r *Router) String() string {
 func (r *Router) Configure(c *config.Config) error {
 	c.Listens = []string{"127.0.0.1:" + r.ListenPort}
 	r.ClientReporting = c.ReportClientInfo
+	r.Firewall.Configure(c)
 	if cs, _ := config.ParseBytes(c.CacheSize); cs > 0 {
 		r.CacheEnabled = true
 		c.Listens = []string{":53"}
@@ -45,28 +49,51 @@ func (r *Router) Configure(c *config.Config) error {
 
 func (r *Router) Setup() error {
 	if !r.CacheEnabled {
-		return r.setupDNSMasq()
+		if err := r.setupDNSMasq(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return r.journal.SetupFirewall(r.Firewall)
+}
+
+// Plan returns the changes Configure and Setup would make with c, without
+// making them.
+func (r *Router) Plan(c *config.Config) ([]internal.Change, error) {
+	dry := *r
+	dry.journal = r.journal.DryRun()
+	return internal.Plan(dry.journal, c, dry.Configure, dry.Setup)
+}
+
+// Status returns the changes made by Setup which are not in place.
+func (r *Router) Status(c *config.Config) ([]internal.Change, error) {
+	changes, err := r.Plan(c)
+	return internal.Drift(changes), err
+}
+
+// RestorePending returns true if the setup of a previous run was not restored.
+func (r *Router) RestorePending() bool {
+	return r.journal.Pending()
 }
 
 func (r *Router) setupDNSMasq() error {
-	if err := internal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0644); err != nil {
+	if err := r.journal.Record(internal.JournalEntry{Op: internal.UndoExec, Args: []string{"sudo", "/etc/init.d/dnsmasq", "restart"}}); err != nil {
+		return err
+	}
+	if err := r.journal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0644); err != nil {
 		return err
 	}
 
-	return restartDNSMasq()
+	return r.restartDNSMasq()
 }
 
+// Restore undoes the changes recorded by Setup, including the ones of a
+// previous run.
 func (r *Router) Restore() error {
-	if err := os.Remove(r.DNSMasqPath); err != nil {
-		return err
-	}
-	return restartDNSMasq()
+	return r.journal.Rollback()
 }
 
-func restartDNSMasq() error {
-	if err := exec.Command("sudo", "/etc/init.d/dnsmasq", "restart").Run(); err != nil {
+func (r *Router) restartDNSMasq() error {
+	if err := r.journal.Exec("sudo", "/etc/init.d/dnsmasq", "restart"); err != nil {
 		return fmt.Errorf("dnsmasq restart: %v", err)
 	}
 	return nil
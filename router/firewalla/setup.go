@@ -3,7 +3,6 @@ package firewalla
 import (
 	"net"
 	"os"
-	"os/exec"
 
 	"github.com/nextdns/nextdns/config"
 	"github.com/nextdns/nextdns/router/internal"
@@ -13,6 +12,9 @@ type Router struct {
 	DNSMasqPath     string
 	ListenPort      string
 	ClientReporting bool
+	Firewall        internal.Firewall
+
+	journal *internal.Journal
 }
 
 func New() (*Router, bool) {
@@ -22,12 +24,14 @@ func New() (*Router, bool) {
 	return &Router{
 		DNSMasqPath: "/home/pi/.firewalla/config/dnsmasq_local/nextdns.conf",
 		ListenPort:  "5342",
+		journal:     internal.NewJournal("/home/pi/.firewalla/config/nextdns.router-journal"),
 	}, true
 }
 
 func (r *Router) Configure(c *config.Config) error {
 	c.Listens = []string{net.JoinHostPort("localhost", r.ListenPort)}
 	r.ClientReporting = c.ReportClientInfo
+	r.Firewall.Configure(c)
 	if c.CacheSize == "0" || c.CacheSize == "" {
 		// Make sure we setup a non-0 cache as we disable dnsmasq cache
 		c.CacheSize = "10MB"
@@ -36,25 +40,49 @@ func (r *Router) Configure(c *config.Config) error {
 }
 
 func (r *Router) Setup() error {
-	return r.setupDNSMasq()
+	if err := r.setupDNSMasq(); err != nil {
+		return err
+	}
+	return r.journal.SetupFirewall(r.Firewall)
 }
 
+// Restore undoes the changes recorded by Setup, including the ones of a
+// previous run.
 func (r *Router) Restore() error {
-	if err := os.Remove(r.DNSMasqPath); err != nil {
-		return err
-	}
-	return restartDNSMasq()
+	return r.journal.Rollback()
+}
+
+// Plan returns the changes Configure and Setup would make with c, without
+// making them.
+func (r *Router) Plan(c *config.Config) ([]internal.Change, error) {
+	dry := *r
+	dry.journal = r.journal.DryRun()
+	return internal.Plan(dry.journal, c, dry.Configure, dry.Setup)
+}
+
+// Status returns the changes made by Setup which are not in place.
+func (r *Router) Status(c *config.Config) ([]internal.Change, error) {
+	changes, err := r.Plan(c)
+	return internal.Drift(changes), err
+}
+
+// RestorePending returns true if the setup of a previous run was not restored.
+func (r *Router) RestorePending() bool {
+	return r.journal.Pending()
 }
 
 func (r *Router) setupDNSMasq() error {
-	if err := internal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0644); err != nil {
+	if err := r.journal.Record(internal.JournalEntry{Op: internal.UndoExec, Args: []string{"systemctl", "restart", "firerouter_dns.service"}}); err != nil {
+		return err
+	}
+	if err := r.journal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0644); err != nil {
 		return err
 	}
-	return restartDNSMasq()
+	return r.restartDNSMasq()
 }
 
-func restartDNSMasq() error {
-	return exec.Command("systemctl", "restart", "firerouter_dns.service").Run()
+func (r *Router) restartDNSMasq() error {
+	return r.journal.Exec("systemctl", "restart", "firerouter_dns.service")
 }
 
 var tmpl = `# Configuration generated by NextDNS
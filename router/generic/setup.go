@@ -2,13 +2,19 @@ package generic
 
 import (
 	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/router/internal"
 )
 
 type Router struct {
+	Firewall internal.Firewall
+
+	journal *internal.Journal
 }
 
 func New() *Router {
-	return &Router{}
+	return &Router{
+		journal: internal.NewJournal("/etc/nextdns.router-journal"),
+	}
 }
 
 func (r *Router) String() string {
@@ -17,13 +23,35 @@ func (r *Router) String() string {
 
 func (r *Router) Configure(c *config.Config) error {
 	c.Listens = []string{":53"}
+	r.Firewall.Configure(c)
 	return nil
 }
 
 func (r *Router) Setup() error {
-	return nil
+	return r.journal.SetupFirewall(r.Firewall)
 }
 
+// Plan returns the changes Configure and Setup would make with c, without
+// making them.
+func (r *Router) Plan(c *config.Config) ([]internal.Change, error) {
+	dry := *r
+	dry.journal = r.journal.DryRun()
+	return internal.Plan(dry.journal, c, dry.Configure, dry.Setup)
+}
+
+// Status returns the changes made by Setup which are not in place.
+func (r *Router) Status(c *config.Config) ([]internal.Change, error) {
+	changes, err := r.Plan(c)
+	return internal.Drift(changes), err
+}
+
+// RestorePending returns true if the setup of a previous run was not restored.
+func (r *Router) RestorePending() bool {
+	return r.journal.Pending()
+}
+
+// Restore undoes the changes recorded by Setup, including the ones of a
+// previous run.
 func (r *Router) Restore() error {
-	return nil
+	return r.journal.Rollback()
 }
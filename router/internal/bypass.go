@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// encryptedDNSServers lists the IPs of public DNS over HTTPS resolvers. Those
+// addresses only serve DNS, so blocking HTTPS to them does not break other
+// services. It is used when no list file is configured.
+var encryptedDNSServers = []string{
+	// Google
+	"8.8.8.8", "8.8.4.4",
+	"2001:4860:4860::8888", "2001:4860:4860::8844",
+	// Cloudflare
+	"1.1.1.1", "1.0.0.1", "1.1.1.2", "1.0.0.2", "1.1.1.3", "1.0.0.3",
+	"2606:4700:4700::1111", "2606:4700:4700::1001",
+	"2606:4700:4700::1112", "2606:4700:4700::1002",
+	"2606:4700:4700::1113", "2606:4700:4700::1003",
+	// Quad9
+	"9.9.9.9", "149.112.112.112", "9.9.9.10", "149.112.112.10", "9.9.9.11", "149.112.112.11",
+	"2620:fe::fe", "2620:fe::9", "2620:fe::10", "2620:fe::fe:10", "2620:fe::11", "2620:fe::fe:11",
+	// OpenDNS
+	"208.67.222.222", "208.67.220.220", "208.67.222.123", "208.67.220.123",
+	"2620:119:35::35", "2620:119:53::53",
+	// AdGuard
+	"94.140.14.14", "94.140.15.15", "94.140.14.15", "94.140.15.16",
+	"2a10:50c0::ad1:ff", "2a10:50c0::ad2:ff",
+	// CleanBrowsing
+	"185.228.168.9", "185.228.169.9", "185.228.168.168", "185.228.169.168",
+	"2a0d:2a00:1::2", "2a0d:2a00:2::2",
+	// Mullvad
+	"194.242.2.2", "2a07:e340::2",
+}
+
+// ReadEncryptedDNSServers reads a list of DNS over HTTPS resolver IPs from
+// file, one per line. Empty lines and lines starting with # are ignored.
+func ReadEncryptedDNSServers(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ips []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: %s: invalid IP", file, n, line)
+		}
+		ips = append(ips, ip.String())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s: no IP", file)
+	}
+	return ips, nil
+}
+
+// splitByFamily returns ips split by IP family.
+func splitByFamily(ips []string) (v4, v6 []string) {
+	for _, ip := range ips {
+		if net.ParseIP(ip).To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	return v4, v6
+}
+
+// BlockEncryptedDNS installs filter rules rejecting the DNS over TLS and DNS
+// over QUIC traffic (port 853) forwarded by the router, as well as HTTPS
+// traffic to servers, the IPs of public DNS over HTTPS resolvers, so LAN
+// clients fall back to the router DNS. The builtin list of resolvers is used
+// if servers is empty. Traffic of the router itself is not affected.
+//
+// nftables is used when available, iptables and ip6tables otherwise. The rules
+// are removed on Rollback.
+func (j *Journal) BlockEncryptedDNS(servers []string) error {
+	if len(servers) == 0 {
+		servers = encryptedDNSServers
+	}
+	v4, v6 := splitByFamily(servers)
+	if _, err := exec.LookPath("nft"); err == nil {
+		return j.blockEncryptedDNSNFT(v4, v6)
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return j.blockEncryptedDNSIPTables(v4, v6)
+	}
+	return errors.New("block-encrypted-dns: " + errNoFirewall)
+}
+
+func (j *Journal) blockEncryptedDNSNFT(v4, v6 []string) error {
+	rules := [][]string{
+		{"tcp", "dport", "853", "reject", "with", "tcp", "reset"},
+		{"udp", "dport", "853", "reject"},
+	}
+	for _, f := range []struct {
+		family string
+		ips    []string
+	}{{"ip", v4}, {"ip6", v6}} {
+		if len(f.ips) == 0 {
+			continue
+		}
+		set := "{ " + strings.Join(f.ips, ", ") + " }"
+		rules = append(rules,
+			[]string{f.family, "daddr", set, "tcp", "dport", "443", "reject", "with", "tcp", "reset"},
+			[]string{f.family, "daddr", set, "udp", "dport", "443", "reject"})
+	}
+	return j.nftChain(bypassTable, "forward", "type filter hook forward priority -10;", rules)
+}
+
+func (j *Journal) blockEncryptedDNSIPTables(v4, v6 []string) error {
+	for _, cmd := range iptablesCmds("filter") {
+		ips := v4
+		if cmd == "ip6tables" {
+			ips = v6
+		}
+		rules := [][]string{
+			{"-p", "tcp", "--dport", "853", "-j", "REJECT", "--reject-with", "tcp-reset"},
+			{"-p", "udp", "--dport", "853", "-j", "REJECT"},
+		}
+		if len(ips) > 0 {
+			rules = append(rules,
+				[]string{"-d", strings.Join(ips, ","), "-p", "tcp", "--dport", "443", "-j", "REJECT", "--reject-with", "tcp-reset"},
+				[]string{"-d", strings.Join(ips, ","), "-p", "udp", "--dport", "443", "-j", "REJECT"})
+		}
+		for _, rule := range rules {
+			if err := j.iptablesRule(cmd, "filter", "FORWARD", rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadEncryptedDNSServers(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	file := write("list", "# Google\n8.8.8.8\n\n  2001:4860:4860:0:0:0:0:8888  \n")
+	ips, err := ReadEncryptedDNSServers(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(ips, " "), "8.8.8.8 2001:4860:4860::8888"; got != want {
+		t.Errorf("ReadEncryptedDNSServers() = %q, want %q", got, want)
+	}
+	v4, v6 := splitByFamily(ips)
+	if len(v4) != 1 || len(v6) != 1 {
+		t.Errorf("splitByFamily() = %v, %v", v4, v6)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+	}{
+		{"invalid", write("invalid", "8.8.8.8\ndns.google\n"), ":2: dns.google: invalid IP"},
+		{"empty", write("empty", "# nothing\n"), ": no IP"},
+		{"missing", filepath.Join(dir, "missing"), "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadEncryptedDNSServers(tt.file); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ReadEncryptedDNSServers() err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
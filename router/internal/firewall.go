@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/nextdns/nextdns/config"
+)
+
+// nftables tables holding the firewall rules.
+const (
+	hijackTable = "nextdns"
+	bypassTable = "nextdns_bypass"
+)
+
+// Firewall is the optional firewall setup of a router, common to all
+// firmwares.
+type Firewall struct {
+	HijackDNS bool
+	// LANInterfaces are the interfaces on which DNS queries are hijacked. It
+	// is set to the LAN interfaces of the firmware, if known, and overridden
+	// by the hijack-dns-interface setting. A name ending with * matches the
+	// interfaces starting with this prefix.
+	LANInterfaces     []string
+	BlockEncryptedDNS bool
+	// EncryptedDNSList is the file listing the DNS over HTTPS resolver IPs
+	// blocked by BlockEncryptedDNS, the builtin list is used if empty.
+	EncryptedDNSList string
+}
+
+// Configure reads the firewall settings of c.
+func (f *Firewall) Configure(c *config.Config) {
+	f.HijackDNS = c.HijackDNS
+	if len(c.HijackDNSInterfaces) > 0 {
+		f.LANInterfaces = c.HijackDNSInterfaces
+	}
+	f.BlockEncryptedDNS = c.BlockEncryptedDNS
+	f.EncryptedDNSList = c.EncryptedDNSList
+}
+
+// SetupFirewall installs the rules enabled in f.
+func (j *Journal) SetupFirewall(f Firewall) error {
+	if f.HijackDNS {
+		if err := j.HijackDNS(f.LANInterfaces); err != nil {
+			return err
+		}
+	}
+	if f.BlockEncryptedDNS {
+		var servers []string
+		if f.EncryptedDNSList != "" {
+			var err error
+			if servers, err = ReadEncryptedDNSServers(f.EncryptedDNSList); err != nil {
+				return fmt.Errorf("block-encrypted-dns-list: %v", err)
+			}
+		}
+		return j.BlockEncryptedDNS(servers)
+	}
+	return nil
+}
+
+// HijackDNS installs NAT rules redirecting the DNS queries (UDP and TCP port 53)
+// received on the lan interfaces for another destination, like a client using
+// a hardcoded 8.8.8.8, to the DNS server of the router. Queries to the router
+// and to private networks, where another LAN DNS server may run, are not
+// redirected. Queries sent by the router itself are not affected as they do
+// not go through prerouting.
+//
+// nftables is used when available, iptables and ip6tables otherwise. The rules
+// are removed on Rollback. Rules already in place are not reported as changes
+// by a dry-run journal.
+func (j *Journal) HijackDNS(lan []string) error {
+	if len(lan) == 0 {
+		return errors.New("hijack-dns: LAN interface unknown, set hijack-dns-interface")
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		return j.nftChain(hijackTable, "prerouting", "type nat hook prerouting priority -100;", hijackNFTRules(lan))
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return j.hijackDNSIPTables(lan)
+	}
+	return errors.New("hijack-dns: " + errNoFirewall)
+}
+
+// Private and link-local networks, which are not hijacked.
+var (
+	privateNetworks4 = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16"}
+	privateNetworks6 = []string{"fc00::/7", "fe80::/10"}
+)
+
+func hijackNFTRules(lan []string) [][]string {
+	rules := [][]string{
+		// Queries to the router are already for us.
+		{"fib", "daddr", "type", "local", "return"},
+		{"ip", "daddr", "{ " + strings.Join(privateNetworks4, ", ") + " }", "return"},
+		{"ip6", "daddr", "{ " + strings.Join(privateNetworks6, ", ") + " }", "return"},
+	}
+	for _, iface := range lan {
+		for _, proto := range []string{"udp", "tcp"} {
+			rules = append(rules, []string{"iifname", strconv.Quote(iface), proto, "dport", "53", "redirect", "to", ":53"})
+		}
+	}
+	return rules
+}
+
+// nftChain creates an inet table with a base chain holding rules and records
+// the deletion of the table. Rules are only reported as changes by a dry-run
+// journal when the chain does not exist.
+func (j *Journal) nftChain(table, chain, chainType string, rules [][]string) error {
+	if j.dryRun && run("nft", "list", "chain", "inet", table, chain) == nil {
+		return nil
+	}
+	var diff []string
+	for _, r := range rules {
+		diff = append(diff, "+ "+strings.Join(r, " "))
+	}
+	return j.Apply(
+		Change{Kind: ChangeFirewall, Target: "nft table inet " + table, Diff: strings.Join(diff, "\n")},
+		func() error {
+			// The table is ours, recreate it so rules are not duplicated.
+			_ = run("nft", "delete", "table", "inet", table)
+			if err := run("nft", "add", "table", "inet", table); err != nil {
+				return err
+			}
+			if err := run("nft", "add", "chain", "inet", table, chain,
+				"{ "+chainType+" policy accept; }"); err != nil {
+				return err
+			}
+			for _, r := range rules {
+				if err := run("nft", append([]string{"add", "rule", "inet", table, chain}, r...)...); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		JournalEntry{Op: UndoExec, Args: []string{"nft", "delete", "table", "inet", table}},
+	)
+}
+
+// hijackChain is the iptables nat chain holding the hijack rules.
+const hijackChain = "NEXTDNS_HIJACK"
+
+// hijackIPTablesRules returns the rules of hijackChain for cmd, and the rules
+// jumping to it from PREROUTING.
+func hijackIPTablesRules(cmd string, lan []string) (rules, jumps [][]string) {
+	nets := privateNetworks4
+	if cmd == "ip6tables" {
+		nets = privateNetworks6
+	}
+	rules = [][]string{{"-m", "addrtype", "--dst-type", "LOCAL", "-j", "RETURN"}}
+	for _, n := range nets {
+		rules = append(rules, []string{"-d", n, "-j", "RETURN"})
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		rules = append(rules, []string{"-p", proto, "-j", "REDIRECT", "--to-ports", "53"})
+	}
+	for _, iface := range lan {
+		if prefix, found := strings.CutSuffix(iface, "*"); found {
+			iface = prefix + "+"
+		}
+		for _, proto := range []string{"udp", "tcp"} {
+			jumps = append(jumps, []string{"-i", iface, "-p", proto, "--dport", "53", "-j", hijackChain})
+		}
+	}
+	return rules, jumps
+}
+
+func (j *Journal) hijackDNSIPTables(lan []string) error {
+	for _, cmd := range iptablesCmds("nat") {
+		if err := j.iptablesChain(cmd, "nat", hijackChain); err != nil {
+			return err
+		}
+		rules, jumps := hijackIPTablesRules(cmd, lan)
+		// Rules are inserted at the top, in reverse order to keep their order.
+		for i := len(rules) - 1; i >= 0; i-- {
+			if err := j.iptablesRule(cmd, "nat", hijackChain, rules[i]...); err != nil {
+				return err
+			}
+		}
+		for _, rule := range jumps {
+			if err := j.iptablesRule(cmd, "nat", "PREROUTING", rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const errNoFirewall = "nft or iptables not found"
+
+// iptablesCmds returns the iptables commands to use for table. IPv6 NAT is not
+// supported by all kernels, ip6tables is skipped when the table is not
+// available.
+func iptablesCmds(table string) []string {
+	cmds := []string{"iptables"}
+	if _, err := exec.LookPath("ip6tables"); err == nil && run("ip6tables", "-t", table, "-n", "-L") == nil {
+		cmds = append(cmds, "ip6tables")
+	}
+	return cmds
+}
+
+// iptablesChain creates chain in table if it does not exist, and records its
+// deletion. The rules added to the chain must be recorded after it, so they are
+// removed before the chain.
+func (j *Journal) iptablesChain(cmd, table, chain string) error {
+	if run(cmd, "-t", table, "-n", "-L", chain) == nil {
+		return nil
+	}
+	return j.Apply(
+		Change{Kind: ChangeFirewall, Target: cmd + " " + table + " " + chain, Diff: "+ chain " + chain},
+		func() error { return run(cmd, "-t", table, "-N", chain) },
+		JournalEntry{Op: UndoExec, Args: []string{cmd, "-t", table, "-X", chain}},
+	)
+}
+
+// iptablesRule inserts the rule at the top of chain of table if not already
+// there, and records its deletion.
+func (j *Journal) iptablesRule(cmd, table, chain string, rule ...string) error {
+	args := func(op string) []string {
+		return append([]string{"-t", table, op, chain}, rule...)
+	}
+	if run(cmd, args("-C")...) == nil {
+		return nil
+	}
+	return j.Apply(
+		Change{Kind: ChangeFirewall, Target: cmd + " " + table + " " + chain, Diff: "+ " + strings.Join(rule, " ")},
+		func() error { return run(cmd, args("-I")...) },
+		JournalEntry{Op: UndoExec, Args: append([]string{cmd}, args("-D")...)},
+	)
+}
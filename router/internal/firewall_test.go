@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func join(rules [][]string) string {
+	var s []string
+	for _, r := range rules {
+		s = append(s, strings.Join(r, " "))
+	}
+	return strings.Join(s, "\n")
+}
+
+func Test_hijackNFTRules(t *testing.T) {
+	want := `fib daddr type local return
+ip daddr { 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16, 169.254.0.0/16 } return
+ip6 daddr { fc00::/7, fe80::/10 } return
+iifname "br-lan" udp dport 53 redirect to :53
+iifname "br-lan" tcp dport 53 redirect to :53
+iifname "br*" udp dport 53 redirect to :53
+iifname "br*" tcp dport 53 redirect to :53`
+	if got := join(hijackNFTRules([]string{"br-lan", "br*"})); got != want {
+		t.Errorf("hijackNFTRules() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func Test_hijackIPTablesRules(t *testing.T) {
+	rules, jumps := hijackIPTablesRules("ip6tables", []string{"br0", "br*"})
+	wantRules := `-m addrtype --dst-type LOCAL -j RETURN
+-d fc00::/7 -j RETURN
+-d fe80::/10 -j RETURN
+-p udp -j REDIRECT --to-ports 53
+-p tcp -j REDIRECT --to-ports 53`
+	if got := join(rules); got != wantRules {
+		t.Errorf("rules =\n%s\nwant:\n%s", got, wantRules)
+	}
+	wantJumps := `-i br0 -p udp --dport 53 -j NEXTDNS_HIJACK
+-i br0 -p tcp --dport 53 -j NEXTDNS_HIJACK
+-i br+ -p udp --dport 53 -j NEXTDNS_HIJACK
+-i br+ -p tcp --dport 53 -j NEXTDNS_HIJACK`
+	if got := join(jumps); got != wantJumps {
+		t.Errorf("jumps =\n%s\nwant:\n%s", got, wantJumps)
+	}
+}
+
+func TestJournal_HijackDNSWithoutLAN(t *testing.T) {
+	j := NewJournal(t.TempDir() + "/journal").DryRun()
+	if err := j.HijackDNS(nil); err == nil || !strings.Contains(err.Error(), "hijack-dns-interface") {
+		t.Errorf("HijackDNS(nil) err = %v, want missing interface error", err)
+	}
+}
@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Undo operations of journal entries.
+const (
+	// UndoFile restores Path to Data, or removes it if it did not exist.
+	UndoFile = "file"
+
+	// UndoNVRAM sets the Vars name=value nvram variables, unsetting the ones
+	// with an empty value, and commits.
+	UndoNVRAM = "nvram"
+
+	// UndoUCI runs uci with Args and commits.
+	UndoUCI = "uci"
+
+	// UndoExec runs the Args command.
+	UndoExec = "exec"
+
+	// UndoKill kills the process with the pid stored in the Path file.
+	UndoKill = "kill"
+)
+
+// JournalEntry is the undo action of a router setup step.
+type JournalEntry struct {
+	Op      string      `json:"op"`
+	Path    string      `json:"path,omitempty"`
+	Data    []byte      `json:"data,omitempty"`
+	Existed bool        `json:"existed,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Vars    []string    `json:"vars,omitempty"`
+	Args    []string    `json:"args,omitempty"`
+}
+
+// Journal records the undo action of each router setup step in a state file
+// before the step is applied. If the daemon is killed or the router loses
+// power before restoring its configuration, the journal is still there on next
+// start to bring the router back to its original state.
+//
+// Actions are undone in reverse order, so the commands applying the changes,
+// like a dnsmasq restart, should be recorded first.
+type Journal struct {
+	Path string
+
+	mu      sync.Mutex
+	entries []JournalEntry
+	loaded  bool
+	dryRun  bool
+	changes []Change
+}
+
+// NewJournal returns a journal stored in path.
+func NewJournal(path string) *Journal {
+	return &Journal{Path: path}
+}
+
+func (j *Journal) loadLocked() error {
+	if j.loaded {
+		return nil
+	}
+	b, err := os.ReadFile(j.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			j.loaded = true
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(b, &j.entries); err != nil {
+		return fmt.Errorf("%s: %v", j.Path, err)
+	}
+	j.loaded = true
+	return nil
+}
+
+func (j *Journal) saveLocked() error {
+	if len(j.entries) == 0 {
+		err := os.Remove(j.Path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	b, err := json.Marshal(j.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.Path), 0755); err != nil {
+		return err
+	}
+	tmp := j.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.Path)
+}
+
+// Pending returns true if the journal has actions to undo.
+func (j *Journal) Pending() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.loadLocked() == nil && len(j.entries) > 0
+}
+
+// Entries returns the recorded undo actions.
+func (j *Journal) Entries() ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.loadLocked(); err != nil {
+		return nil, err
+	}
+	return append([]JournalEntry{}, j.entries...), nil
+}
+
+// Record persists e. Recording an action twice is a no-op, and only the first
+// state of a file or nvram variable is recorded so the original state is
+// restored when a step is applied several times.
+func (j *Journal) Record(e JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.loadLocked(); err != nil {
+		return err
+	}
+	for _, e2 := range j.entries {
+		if e2.Op != e.Op {
+			continue
+		}
+		switch {
+		case e.Op == UndoFile && e.Path == e2.Path,
+			e.Op == UndoNVRAM && reflect.DeepEqual(nvramNames(e.Vars), nvramNames(e2.Vars)),
+			reflect.DeepEqual(e, e2):
+			return nil
+		}
+	}
+	j.entries = append(j.entries, e)
+	if j.dryRun {
+		return nil
+	}
+	return j.saveLocked()
+}
+
+// Rollback undoes the recorded actions in reverse order and clears the journal.
+// All actions are tried, their errors being returned joined.
+func (j *Journal) Rollback() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.loadLocked(); err != nil {
+		return err
+	}
+	var errs []error
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		if err := j.entries[i].undo(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	j.entries = nil
+	errs = append(errs, j.saveLocked())
+	return errors.Join(errs...)
+}
+
+func (e JournalEntry) undo() error {
+	switch e.Op {
+	case UndoFile:
+		if !e.Existed {
+			if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		return os.WriteFile(e.Path, e.Data, e.Mode)
+	case UndoNVRAM:
+		return SetNVRAM(e.Vars...)
+	case UndoUCI:
+		if err := run("uci", e.Args...); err != nil {
+			return err
+		}
+		return run("uci", "commit")
+	case UndoExec:
+		if len(e.Args) == 0 {
+			return nil
+		}
+		return run(e.Args[0], e.Args[1:]...)
+	case UndoKill:
+		b, err := os.ReadFile(e.Path)
+		if err != nil {
+			return err
+		}
+		return run("kill", string(bytes.TrimSpace(b)))
+	}
+	return fmt.Errorf("%s: unknown undo operation", e.Op)
+}
+
+func run(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func nvramNames(vars []string) []string {
+	names := make([]string, 0, len(vars))
+	for _, v := range vars {
+		name, _, _ := strings.Cut(v, "=")
+		names = append(names, name)
+	}
+	return names
+}
+
+// RecordFile records the current state of path.
+func (j *Journal) RecordFile(path string) error {
+	e := JournalEntry{Op: UndoFile, Path: path}
+	if st, err := os.Stat(path); err == nil {
+		if e.Data, err = os.ReadFile(path); err != nil {
+			return err
+		}
+		e.Existed = true
+		e.Mode = st.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return j.Record(e)
+}
+
+// WriteFile records the state of path and writes data to it.
+func (j *Journal) WriteFile(path string, data []byte, mode os.FileMode) error {
+	if j.dryRun {
+		if c, changed := fileChange(path, data); changed {
+			j.addChange(c)
+		}
+		return nil
+	}
+	if err := j.RecordFile(path); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, mode)
+}
+
+// WriteTemplate records the state of path and writes the executed template
+// to it.
+func (j *Journal) WriteTemplate(path, tmpl string, data interface{}, mode os.FileMode) error {
+	t, err := template.New("").Parse(tmpl)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return err
+	}
+	return j.WriteFile(path, buf.Bytes(), mode)
+}
+
+// SetNVRAM records the current value of the vars nvram variables and sets them.
+func (j *Journal) SetNVRAM(vars ...string) error {
+	names := nvramNames(vars)
+	current, err := NVRAM(names...)
+	if err != nil {
+		return err
+	}
+	saved := make([]string, 0, len(names))
+	for _, name := range names {
+		v := name + "=" // unset if not found
+		for _, cur := range current {
+			if strings.HasPrefix(cur, name+"=") {
+				v = cur
+				break
+			}
+		}
+		saved = append(saved, v)
+	}
+	if j.dryRun {
+		for i, v := range vars {
+			if saved[i] != v {
+				j.addChange(Change{Kind: ChangeNVRAM, Target: names[i], Diff: Diff(saved[i], v)})
+			}
+		}
+		return nil
+	}
+	if err := j.Record(JournalEntry{Op: UndoNVRAM, Vars: saved}); err != nil {
+		return err
+	}
+	return SetNVRAM(vars...)
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nextdns/nextdns/config"
+)
+
+func TestJournal_Rollback(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.conf")
+	created := filepath.Join(dir, "created.conf")
+	if err := os.WriteFile(existing, []byte("original\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	j := NewJournal(filepath.Join(dir, "journal"))
+	for i := 0; i < 2; i++ {
+		// Applying the steps twice must keep the original state.
+		if err := j.WriteFile(existing, []byte("changed\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.WriteTemplate(created, "port={{.}}\n", 0, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := j.Entries(); len(entries) != 2 {
+		t.Errorf("len(Entries()) = %d, want 2", len(entries))
+	}
+
+	// A new journal instance, like after a crash, sees the pending entries.
+	j = NewJournal(j.Path)
+	if !j.Pending() {
+		t.Fatal("Pending() = false, want true")
+	}
+	if err := j.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(existing); err != nil || string(b) != "original\n" {
+		t.Errorf("existing file = %q, %v, want original", b, err)
+	}
+	if st, err := os.Stat(existing); err != nil || st.Mode().Perm() != 0640 {
+		t.Errorf("existing file mode = %v, want 0640", st.Mode().Perm())
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("created file not removed: %v", err)
+	}
+	if _, err := os.Stat(j.Path); !os.IsNotExist(err) {
+		t.Errorf("journal not removed: %v", err)
+	}
+	if j.Pending() {
+		t.Error("Pending() = true after Rollback")
+	}
+}
+
+func TestJournal_DryRun(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dnsmasq.conf")
+	if err := os.WriteFile(file, []byte("no-resolv\nserver=1.1.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := NewJournal(filepath.Join(dir, "journal")).DryRun()
+	if err := j.WriteFile(file, []byte("no-resolv\nserver=127.0.0.1#5342\nadd-mac\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.WriteFile(filepath.Join(dir, "new.conf"), []byte("port=0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Exec("/etc/init.d/dnsmasq", "restart"); err != nil {
+		t.Fatal(err)
+	}
+	changes := j.Changes()
+	want := []Change{
+		{Kind: ChangeFile, Target: file, Diff: "  no-resolv\n- server=1.1.1.1\n+ server=127.0.0.1#5342\n+ add-mac"},
+		{Kind: ChangeFile, Target: filepath.Join(dir, "new.conf"), Diff: "+ port=0"},
+		{Kind: ChangeService, Target: "/etc/init.d/dnsmasq restart"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("Changes() = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("Changes()[%d] = %q, want %q", i, changes[i], want[i])
+		}
+	}
+	if got := Drift(changes); len(got) != 2 {
+		t.Errorf("Drift() = %v, want the 2 file changes", got)
+	}
+	if b, _ := os.ReadFile(file); string(b) != "no-resolv\nserver=1.1.1.1\n" {
+		t.Errorf("dry run changed the file: %q", b)
+	}
+	if _, err := os.Stat(j.Path); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote the journal: %v", err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "nextdns.conf")
+	c := &config.Config{Listens: []string{":53"}}
+	j := NewJournal(filepath.Join(dir, "journal")).DryRun()
+	configure := func(c *config.Config) error {
+		c.Listens = []string{"127.0.0.1:5342"}
+		return nil
+	}
+	setup := func() error {
+		return j.WriteFile(file, []byte("server=127.0.0.1#5342\n"), 0644)
+	}
+	changes, err := Plan(j, c, configure, setup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Target != file {
+		t.Errorf("Plan() = %v, want a change of %s", changes, file)
+	}
+	if c.Listens[0] != ":53" {
+		t.Errorf("Plan() changed the config: %v", c.Listens)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("Plan() wrote the file: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nextdns/nextdns/config"
+)
+
+// Kinds of changes.
+const (
+	ChangeFile     = "file"
+	ChangeNVRAM    = "nvram"
+	ChangeUCI      = "uci"
+	ChangeFirewall = "firewall"
+	ChangeService  = "service"
+)
+
+// Change describes a change of the router configuration made by Setup.
+type Change struct {
+	// Kind is the kind of the changed item, like file or nvram.
+	Kind string `json:"kind"`
+
+	// Target identifies the changed item: file path, nvram variable, UCI
+	// option, firewall rule or service command.
+	Target string `json:"target"`
+
+	// Diff shows the change, lines being prefixed with - when removed and +
+	// when added.
+	Diff string `json:"diff,omitempty"`
+}
+
+func (c Change) String() string {
+	s := c.Kind + " " + c.Target
+	if c.Diff != "" {
+		s += "\n" + c.Diff
+	}
+	return s
+}
+
+// DryRun returns a journal recording the changes of the setup steps in place
+// of applying them.
+func (j *Journal) DryRun() *Journal {
+	return &Journal{Path: j.Path, dryRun: true, loaded: true}
+}
+
+// Changes returns the changes recorded by a dry-run journal.
+func (j *Journal) Changes() []Change {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]Change{}, j.changes...)
+}
+
+func (j *Journal) addChange(c Change) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.changes = append(j.changes, c)
+}
+
+// Apply records the undo actions and calls apply, or only records c if j is a
+// dry-run journal.
+func (j *Journal) Apply(c Change, apply func() error, undo ...JournalEntry) error {
+	if j.dryRun {
+		j.addChange(c)
+		return nil
+	}
+	for _, e := range undo {
+		if err := j.Record(e); err != nil {
+			return err
+		}
+	}
+	return apply()
+}
+
+// Exec runs a command applying the changes, like a service restart.
+func (j *Journal) Exec(name string, args ...string) error {
+	if j.dryRun {
+		j.addChange(Change{Kind: ChangeService, Target: strings.TrimSpace(name + " " + strings.Join(args, " "))})
+		return nil
+	}
+	return run(name, args...)
+}
+
+// Plan calls configure with a copy of c and setup, and returns the changes
+// they recorded in the dry-run journal dry. They are meant to be the Configure
+// and Setup methods of a copy of the router using dry as its journal.
+func Plan(dry *Journal, c *config.Config, configure func(*config.Config) error, setup func() error) ([]Change, error) {
+	cc := *c
+	if err := configure(&cc); err != nil {
+		return nil, err
+	}
+	if err := setup(); err != nil {
+		return nil, err
+	}
+	return dry.Changes(), nil
+}
+
+// Drift returns the changes of a plan that are not service commands, i.e. the
+// ones that would not be there if the setup was still in place.
+func Drift(changes []Change) []Change {
+	var drift []Change
+	for _, c := range changes {
+		if c.Kind != ChangeService {
+			drift = append(drift, c)
+		}
+	}
+	return drift
+}
+
+func fileChange(path string, data []byte) (Change, bool) {
+	cur, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return Change{Kind: ChangeFile, Target: path, Diff: fmt.Sprintf("! %v", err)}, true
+	}
+	if err == nil && bytes.Equal(cur, data) {
+		return Change{}, false
+	}
+	return Change{Kind: ChangeFile, Target: path, Diff: Diff(string(cur), string(data))}, true
+}
+
+// Diff returns a line diff between a and b, removed lines being prefixed with
+// "-", added ones with "+" and unchanged ones with a space.
+func Diff(a, b string) string {
+	al, bl := splitLines(a), splitLines(b)
+	// Longest common subsequence table, files are small.
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for k := len(bl) - 1; k >= 0; k-- {
+			if al[i] == bl[k] {
+				lcs[i][k] = lcs[i+1][k+1] + 1
+			} else {
+				lcs[i][k] = max(lcs[i+1][k], lcs[i][k+1])
+			}
+		}
+	}
+	var sb strings.Builder
+	i, k := 0, 0
+	for i < len(al) || k < len(bl) {
+		switch {
+		case i < len(al) && k < len(bl) && al[i] == bl[k]:
+			sb.WriteString("  " + al[i] + "\n")
+			i++
+			k++
+		case i < len(al) && (k == len(bl) || lcs[i+1][k] >= lcs[i][k+1]):
+			sb.WriteString("- " + al[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+ " + bl[k] + "\n")
+			k++
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
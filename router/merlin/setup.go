@@ -16,9 +16,12 @@ type Router struct {
 	DNSMasqPath     string
 	ListenPort      string
 	ClientReporting bool
+	Firewall        internal.Firewall
 	CacheEnabled    bool
 	CurrentPostConf string
 	johnFork        bool
+
+	journal *internal.Journal
 }
 
 func New() (*Router, bool) {
@@ -32,6 +35,8 @@ func New() (*Router, bool) {
 		CurrentPostConf: readPostConf(postConfPath),
 		ListenPort:      "5342",
 		johnFork:        strings.HasPrefix(string(b), "ASUSWRT-Merlin-LTS"),
+		Firewall:        internal.Firewall{LANInterfaces: []string{"br0"}},
+		journal:         internal.NewJournal("/jffs/nextdns.router-journal"),
 	}, true
 }
 
@@ -42,6 +47,7 @@ func (r *Router) String() string {
 func (r *Router) Configure(c *config.Config) error {
 	c.Listens = []string{"127.0.0.1:" + r.ListenPort}
 	r.ClientReporting = c.ReportClientInfo
+	r.Firewall.Configure(c)
 	if cs, _ := config.ParseBytes(c.CacheSize); cs > 0 {
 		r.CacheEnabled = true
 	}
@@ -70,37 +76,43 @@ func readPostConf(path string) string {
 	return string(buf)
 }
 
+// Plan returns the changes Configure and Setup would make with c, without
+// making them.
+func (r *Router) Plan(c *config.Config) ([]internal.Change, error) {
+	dry := *r
+	dry.journal = r.journal.DryRun()
+	return internal.Plan(dry.journal, c, dry.Configure, dry.Setup)
+}
+
+// Status returns the changes made by Setup which are not in place.
+func (r *Router) Status(c *config.Config) ([]internal.Change, error) {
+	changes, err := r.Plan(c)
+	return internal.Drift(changes), err
+}
+
+// RestorePending returns true if the setup of a previous run was not restored.
+func (r *Router) RestorePending() bool {
+	return r.journal.Pending()
+}
+
 func (r *Router) Setup() error {
-	if err := internal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0755); err != nil {
+	if err := r.journal.Record(internal.JournalEntry{Op: internal.UndoExec, Args: []string{"service", "restart_dnsmasq"}}); err != nil {
+		return err
+	}
+	if err := r.journal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0755); err != nil {
 		return err
 	}
 	// Restart dnsmasq service to apply changes.
-	if err := exec.Command("service", "restart_dnsmasq").Run(); err != nil {
+	if err := r.journal.Exec("service", "restart_dnsmasq"); err != nil {
 		return fmt.Errorf("service restart_dnsmasq: %v", err)
 	}
-
-	return nil
+	return r.journal.SetupFirewall(r.Firewall)
 }
 
+// Restore undoes the changes recorded by Setup, including the ones of a
+// previous run.
 func (r *Router) Restore() error {
-	var err error
-	if r.CurrentPostConf != "" {
-		err = os.WriteFile(r.DNSMasqPath, []byte(r.CurrentPostConf), 0755)
-	} else {
-		err = os.Remove(r.DNSMasqPath)
-		if os.IsNotExist(err) {
-			err = nil
-		}
-	}
-	if err != nil {
-		return fmt.Errorf("restore %s: %v", r.DNSMasqPath, err)
-	}
-
-	// Restart dnsmasq service to apply changes.
-	if err := exec.Command("service", "restart_dnsmasq").Run(); err != nil {
-		return fmt.Errorf("service restart_dnsmasq: %v", err)
-	}
-	return nil
+	return r.journal.Rollback()
 }
 
 var tmpl = `#!/bin/sh
@@ -3,8 +3,6 @@ package openwrt
 import (
 	"errors"
 	"fmt"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -16,10 +14,11 @@ type Router struct {
 	DNSMasqPath     string
 	ListenPort      string
 	ClientReporting bool
+	Firewall        internal.Firewall
 	CacheEnabled    bool
 	SetPort0        bool
 
-	savedForwarders string
+	journal *internal.Journal
 }
 
 func New() (*Router, bool) {
@@ -29,6 +28,8 @@ func New() (*Router, bool) {
 	return &Router{
 		DNSMasqPath: filepath.Join(dnsmaskConfDir(), "nextdns.conf"),
 		ListenPort:  "5342",
+		Firewall:    internal.Firewall{LANInterfaces: []string{"br-lan"}},
+		journal:     internal.NewJournal("/etc/nextdns.router-journal"),
 	}, true
 }
 
@@ -39,6 +40,7 @@ func (r *Router) String() string {
 func (r *Router) Configure(c *config.Config) error {
 	c.Listens = []string{"127.0.0.1:" + r.ListenPort}
 	r.ClientReporting = c.ReportClientInfo
+	r.Firewall.Configure(c)
 	if cs, _ := config.ParseBytes(c.CacheSize); cs > 0 {
 		r.CacheEnabled = true
 		c.Listens = []string{":53"}
@@ -49,12 +51,37 @@ func (r *Router) Configure(c *config.Config) error {
 
 func (r *Router) Setup() (err error) {
 	if !r.CacheEnabled {
-		return r.setupDNSMasq()
+		if err := r.setupDNSMasq(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return r.journal.SetupFirewall(r.Firewall)
+}
+
+// Plan returns the changes Configure and Setup would make with c, without
+// making them.
+func (r *Router) Plan(c *config.Config) ([]internal.Change, error) {
+	dry := *r
+	dry.journal = r.journal.DryRun()
+	return internal.Plan(dry.journal, c, dry.Configure, dry.Setup)
+}
+
+// Status returns the changes made by Setup which are not in place.
+func (r *Router) Status(c *config.Config) ([]internal.Change, error) {
+	changes, err := r.Plan(c)
+	return internal.Drift(changes), err
+}
+
+// RestorePending returns true if the setup of a previous run was not restored.
+func (r *Router) RestorePending() bool {
+	return r.journal.Pending()
 }
 
 func (r *Router) setupDNSMasq() (err error) {
+	// Restart dnsmasq after all the changes are undone.
+	if err := r.journal.Record(internal.JournalEntry{Op: internal.UndoExec, Args: []string{"/etc/init.d/dnsmasq", "restart"}}); err != nil {
+		return err
+	}
 	if r.CacheEnabled {
 		// With cache enabled, we disable dns part of dnsmasq with port=0. Also,
 		// dnsmasq won't start if port is redefined. If a custom dnsmasq is
@@ -69,32 +96,38 @@ func (r *Router) setupDNSMasq() (err error) {
 		} else if port == "53" {
 			// If it is set to 53 (the default), we remove it so port=0 doesn't
 			// break.
-			if _, err = uci("delete", "dhcp.@dnsmasq[0].port"); err != nil {
-				return err
-			}
-			if _, err = uci("commit"); err != nil {
+			if err := r.journal.Apply(
+				internal.Change{Kind: internal.ChangeUCI, Target: "dhcp.@dnsmasq[0].port", Diff: "- 53"},
+				func() error { return uciCommit("delete", "dhcp.@dnsmasq[0].port") },
+				internal.JournalEntry{Op: internal.UndoUCI, Args: []string{"set", "dhcp.@dnsmasq[0].port=53"}},
+			); err != nil {
 				return err
 			}
 		}
 	} else {
 		// No need change forwarders settings, we are going to replace dnsmasq
 		// altogether.
-		r.savedForwarders, err = uci("get", "dhcp.@dnsmasq[0].server")
+		forwarders, err := uci("get", "dhcp.@dnsmasq[0].server")
 		if err != nil {
 			if !errors.Is(err, errUCIEntryNotFound) {
 				return err
 			}
 		} else {
-			if _, err = uci("delete", "dhcp.@dnsmasq[0].server"); err != nil {
-				return err
+			var undo []internal.JournalEntry
+			for _, f := range strings.Split(forwarders, " ") {
+				undo = append(undo, internal.JournalEntry{Op: internal.UndoUCI, Args: []string{"add_list", "dhcp.@dnsmasq[0].server=" + f}})
 			}
-			if _, err = uci("commit"); err != nil {
+			if err := r.journal.Apply(
+				internal.Change{Kind: internal.ChangeUCI, Target: "dhcp.@dnsmasq[0].server", Diff: internal.Diff(strings.ReplaceAll(forwarders, " ", "\n"), "")},
+				func() error { return uciCommit("delete", "dhcp.@dnsmasq[0].server") },
+				undo...,
+			); err != nil {
 				return err
 			}
 		}
 	}
 
-	if err := internal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0644); err != nil {
+	if err := r.journal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0644); err != nil {
 		return err
 	}
 
@@ -104,7 +137,7 @@ func (r *Router) setupDNSMasq() (err error) {
 	}
 
 	// Restart dnsmasq service to apply changes.
-	if err := exec.Command("/etc/init.d/dnsmasq", "restart").Run(); err != nil {
+	if err := r.journal.Exec("/etc/init.d/dnsmasq", "restart"); err != nil {
 		return fmt.Errorf("dnsmasq restart: %v", err)
 	}
 
@@ -129,50 +162,25 @@ func (r *Router) ensureDHCPOption() error {
 	}
 
 	// Set the DHCP option if it's not already set
-	if _, err := uci("add_list", "dhcp.lan.dhcp_option="+expectedOption); err != nil {
-		return fmt.Errorf("failed to set DHCP option: %v", err)
-	}
-	if _, err := uci("commit"); err != nil {
-		return fmt.Errorf("failed to commit DHCP option: %v", err)
-	}
-
-	return nil
+	return r.journal.Apply(
+		internal.Change{Kind: internal.ChangeUCI, Target: "dhcp.lan.dhcp_option", Diff: "+ " + expectedOption},
+		func() error {
+			if _, err := uci("add_list", "dhcp.lan.dhcp_option="+expectedOption); err != nil {
+				return fmt.Errorf("failed to set DHCP option: %v", err)
+			}
+			if _, err := uci("commit"); err != nil {
+				return fmt.Errorf("failed to commit DHCP option: %v", err)
+			}
+			return nil
+		},
+		internal.JournalEntry{Op: internal.UndoUCI, Args: []string{"del_list", "dhcp.lan.dhcp_option=" + expectedOption}},
+	)
 }
 
+// Restore undoes the changes recorded by Setup, including the ones of a
+// previous run.
 func (r *Router) Restore() error {
-	// Restore forwarders
-	if r.savedForwarders != "" {
-		for _, f := range strings.Split(r.savedForwarders, " ") {
-			if _, err := uci("add_list", "dhcp.@dnsmasq[0].server="+f); err != nil {
-				return err
-			}
-		}
-		if _, err := uci("commit"); err != nil {
-			return err
-		}
-	}
-
-	// Remove the custom dnsmasq config
-	_ = os.Remove(r.DNSMasqPath)
-
-	// Remove the DHCP option 6 (DNS server) if it was set
-	ip, err := getRouterIP()
-	if err != nil {
-		return err
-	}
-	expectedOption := fmt.Sprintf("6,%s", ip)
-	if _, err := uci("del_list", "dhcp.lan.dhcp_option="+expectedOption); err != nil {
-		return fmt.Errorf("failed to delete DHCP option: %v", err)
-	}
-	if _, err := uci("commit"); err != nil {
-		return fmt.Errorf("failed to commit DHCP option removal: %v", err)
-	}
-
-	// Restart dnsmasq service to apply changes.
-	if err := exec.Command("/etc/init.d/dnsmasq", "restart").Run(); err != nil {
-		return fmt.Errorf("dnsmasq restart: %v", err)
-	}
-	return nil
+	return r.journal.Rollback()
 }
 
 // getRouterIP is a helper function to get the router's IP address
@@ -24,3 +24,12 @@ func uci(args ...string) (string, error) {
 	}
 	return strings.TrimSpace(stdout.String()), nil
 }
+
+// uciCommit runs uci with args and commits the change.
+func uciCommit(args ...string) error {
+	if _, err := uci(args...); err != nil {
+		return err
+	}
+	_, err := uci("commit")
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/router/internal"
 )
 
 type Router interface {
@@ -21,10 +22,38 @@ type Router interface {
 	// Restore restores the router configuration.
 	// Ran after stop listening.
 	Restore() error
+
+	// Plan returns the changes Configure and Setup would make with c,
+	// without making them.
+	Plan(c *config.Config) ([]Change, error)
+
+	// Status returns the changes made by Setup with c which are not in place,
+	// an empty list meaning the integration is working.
+	Status(c *config.Config) ([]Change, error)
 }
 
+// Change describes a change of the router configuration made by Setup.
+type Change = internal.Change
+
 var ErrRouterNotSupported = errors.New("router not supported")
 
 func New() Router {
 	return detectRouter()
 }
+
+// restorer is implemented by routers journaling their setup, so it can be
+// restored by another run of the daemon.
+type restorer interface {
+	// RestorePending returns true if a setup was not restored.
+	RestorePending() bool
+}
+
+// Recover restores the router configuration left by a previous run which did
+// not restore it, because it was killed or the router lost power. It must be
+// ran before Configure. It returns true if a configuration was restored.
+func Recover(r Router) (bool, error) {
+	if rs, ok := r.(restorer); !ok || !rs.RestorePending() {
+		return false, nil
+	}
+	return true, r.Restore()
+}
@@ -15,9 +15,11 @@ type Router struct {
 	DNSMasqPath     string
 	ListenPort      string
 	ClientReporting bool
+	Firewall        internal.Firewall
 	CacheEnabled    bool
 
 	disabled bool
+	journal  *internal.Journal
 }
 
 func New() (*Router, bool) {
@@ -28,6 +30,7 @@ func New() (*Router, bool) {
 	return &Router{
 		DNSMasqPath: "/etc/dhcpd/dhcpd-vendor-nextdns.conf", // SRM requires two dashes
 		ListenPort:  "5342",
+		journal:     internal.NewJournal("/usr/local/etc/nextdns.router-journal"),
 	}, true
 }
 
@@ -36,6 +39,7 @@ func (r *Router) String() string {
 }
 
 func (r *Router) Configure(c *config.Config) error {
+	r.Firewall.Configure(c)
 	if b, err := os.ReadFile("/etc/dhcpd/dhcpd.info"); err != nil || !bytes.HasPrefix(b, []byte(`enable="yes"`)) {
 		// DHCP is disabled, listen on 53 directly
 		c.Listens = []string{":53"}
@@ -53,37 +57,56 @@ func (r *Router) Configure(c *config.Config) error {
 }
 
 func (r *Router) Setup() error {
-	if r.disabled || r.CacheEnabled {
-		return nil
+	if !r.disabled && !r.CacheEnabled {
+		if err := r.setupDNSMasq(); err != nil {
+			return err
+		}
 	}
-	return r.setupDNSMasq()
+	return r.journal.SetupFirewall(r.Firewall)
+}
+
+// Plan returns the changes Configure and Setup would make with c, without
+// making them.
+func (r *Router) Plan(c *config.Config) ([]internal.Change, error) {
+	dry := *r
+	dry.journal = r.journal.DryRun()
+	return internal.Plan(dry.journal, c, dry.Configure, dry.Setup)
+}
+
+// Status returns the changes made by Setup which are not in place.
+func (r *Router) Status(c *config.Config) ([]internal.Change, error) {
+	changes, err := r.Plan(c)
+	return internal.Drift(changes), err
+}
+
+// RestorePending returns true if the setup of a previous run was not restored.
+func (r *Router) RestorePending() bool {
+	return r.journal.Pending()
 }
 
 func (r *Router) setupDNSMasq() error {
-	if err := internal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0644); err != nil {
+	if err := r.journal.Record(internal.JournalEntry{Op: internal.UndoExec, Args: []string{"/etc/rc.network", "nat-restart-dhcp"}}); err != nil {
+		return err
+	}
+	if err := r.journal.WriteTemplate(r.DNSMasqPath, tmpl, r, 0644); err != nil {
 		return err
 	}
 	infoFile := strings.Replace(r.DNSMasqPath, ".conf", ".info", 1)
-	if err := os.WriteFile(infoFile, []byte(`enable="yes"`), 0644); err != nil {
+	if err := r.journal.WriteFile(infoFile, []byte(`enable="yes"`), 0644); err != nil {
 		return err
 	}
-	return restartDNSMasq()
+	return r.restartDNSMasq()
 }
 
+// Restore undoes the changes recorded by Setup, including the ones of a
+// previous run.
 func (r *Router) Restore() error {
-	if r.disabled {
-		return nil
-	}
-	_ = os.Remove(r.DNSMasqPath)
-	if err := restartDNSMasq(); err != nil {
-		return fmt.Errorf("service restart_dnsmasq: %v", err)
-	}
-	return nil
+	return r.journal.Rollback()
 }
 
-func restartDNSMasq() error {
+func (r *Router) restartDNSMasq() error {
 	// Restart dnsmasq.
-	if err := exec.Command("/etc/rc.network", "nat-restart-dhcp").Run(); err != nil {
+	if err := r.journal.Exec("/etc/rc.network", "nat-restart-dhcp"); err != nil {
 		return fmt.Errorf("/etc/rc.network nat-restart-dhcp: %v", err)
 	}
 	return nil
@@ -17,6 +17,9 @@ type Router struct {
 	DNSMasqPidPath  string
 	ListenPort      string
 	ClientReporting bool
+	Firewall        internal.Firewall
+
+	journal *internal.Journal
 }
 
 func isUnifi() bool {
@@ -58,6 +61,8 @@ func New() (*Router, bool) {
 		DNSMasqConfPath: filepath.Join(dirs.ConfDPath, "nextdns.conf"),
 		DNSMasqPidPath:  dirs.PidPath,
 		ListenPort:      "5342",
+		Firewall:        internal.Firewall{LANInterfaces: []string{"br*"}},
+		journal:         internal.NewJournal("/data/nextdns.router-journal"),
 	}, true
 }
 
@@ -71,6 +76,7 @@ func (r *Router) Configure(c *config.Config) error {
 	}
 	c.Listens = []string{net.JoinHostPort("localhost", r.ListenPort)}
 	r.ClientReporting = c.ReportClientInfo
+	r.Firewall.Configure(c)
 	if c.CacheSize == "0" || c.CacheSize == "" {
 		// Make sure we setup a non-0 cache as we disable dnsmasq cache
 		c.CacheSize = "10MB"
@@ -79,21 +85,46 @@ func (r *Router) Configure(c *config.Config) error {
 }
 
 func (r *Router) Setup() error {
-	return r.setupDNSMasq()
+	if err := r.setupDNSMasq(); err != nil {
+		return err
+	}
+	return r.journal.SetupFirewall(r.Firewall)
 }
 
+// Restore undoes the changes recorded by Setup, including the ones of a
+// previous run.
 func (r *Router) Restore() error {
-	if err := os.Remove(r.DNSMasqConfPath); err != nil {
-		return err
-	}
-	return killDNSMasq(r.DNSMasqPidPath)
+	return r.journal.Rollback()
+}
+
+// Plan returns the changes Configure and Setup would make with c, without
+// making them.
+func (r *Router) Plan(c *config.Config) ([]internal.Change, error) {
+	dry := *r
+	dry.journal = r.journal.DryRun()
+	return internal.Plan(dry.journal, c, dry.Configure, dry.Setup)
+}
+
+// Status returns the changes made by Setup which are not in place.
+func (r *Router) Status(c *config.Config) ([]internal.Change, error) {
+	changes, err := r.Plan(c)
+	return internal.Drift(changes), err
+}
+
+// RestorePending returns true if the setup of a previous run was not restored.
+func (r *Router) RestorePending() bool {
+	return r.journal.Pending()
 }
 
 func (r *Router) setupDNSMasq() error {
-	if err := internal.WriteTemplate(r.DNSMasqConfPath, tmpl, r, 0644); err != nil {
+	// Killing dnsmasq makes it restart with the restored configuration.
+	if err := r.journal.Record(internal.JournalEntry{Op: internal.UndoKill, Path: r.DNSMasqPidPath}); err != nil {
+		return err
+	}
+	if err := r.journal.WriteTemplate(r.DNSMasqConfPath, tmpl, r, 0644); err != nil {
 		return err
 	}
-	return killDNSMasq(r.DNSMasqPidPath)
+	return r.killDNSMasq()
 }
 
 func dnsFilterEnabled() bool {
@@ -101,13 +132,13 @@ func dnsFilterEnabled() bool {
 	return err == nil
 }
 
-func killDNSMasq(pidFile string) error {
-	b, err := os.ReadFile(pidFile)
+func (r *Router) killDNSMasq() error {
+	b, err := os.ReadFile(r.DNSMasqPidPath)
 	if err != nil {
 		return err
 	}
 	pid := string(bytes.TrimSpace(b))
-	if err := exec.Command("kill", pid).Run(); err != nil {
+	if err := r.journal.Exec("kill", pid); err != nil {
 		return fmt.Errorf("dnsmasq kill: %v", err)
 	}
 	return nil
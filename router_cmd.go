@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/ctl"
+	"github.com/nextdns/nextdns/router"
+)
+
+func routerCmd(args []string) error {
+	usage := errors.New("usage: \n" +
+		"  router plan [options]    show the changes setup-router would make,\n" +
+		"                           using the stored configuration and options\n" +
+		"  router status [options]  check the router integration is in place\n" +
+		"  router restore           restore the router settings changed by\n" +
+		"                           setup-router and left by a daemon killed\n" +
+		"                           before restoring them")
+	if len(args) < 2 {
+		return usage
+	}
+	switch args[1] {
+	case "plan", "status":
+		var c config.Config
+		c.Parse("nextdns router "+args[1], args[2:], true)
+		r := router.New()
+		if args[1] == "plan" {
+			changes, err := r.Plan(&c)
+			if err != nil {
+				return fmt.Errorf("%s router: %v", r, err)
+			}
+			if len(changes) == 0 {
+				fmt.Printf("No change needed for %s router.\n", r)
+			}
+			for _, ch := range changes {
+				fmt.Println(ch)
+			}
+			return nil
+		}
+		missing, err := r.Status(&c)
+		if err != nil {
+			return fmt.Errorf("%s router: %v", r, err)
+		}
+		if len(missing) == 0 {
+			fmt.Printf("The %s router integration is in place.\n", r)
+			return nil
+		}
+		fmt.Printf("The %s router integration is not in place, missing changes:\n", r)
+		for _, ch := range missing {
+			fmt.Println(ch)
+		}
+		return errors.New("router integration not in place")
+	case "restore":
+		fs := flag.NewFlagSet("router restore", flag.ExitOnError)
+		control := fs.String("control", config.DefaultControl, "Address to the control socket")
+		_ = fs.Parse(args[2:])
+		if cl, err := ctl.Dial(*control); err == nil {
+			cl.Close()
+			return errors.New("the daemon is running, stop it to restore the router settings")
+		}
+		r := router.New()
+		restored, err := router.Recover(r)
+		if err != nil {
+			return fmt.Errorf("restore %s router settings: %v", r, err)
+		}
+		if !restored {
+			fmt.Println("Nothing to restore.")
+			return nil
+		}
+		fmt.Printf("Restored %s router settings.\n", r)
+		return nil
+	default:
+		return usage
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/ctl"
+	"github.com/nextdns/nextdns/resolver"
+)
+
+// ruleRequest is the data of the profile and forwarder ctl commands.
+type ruleRequest struct {
+	Op   string `json:"op"`
+	Rule string `json:"rule,omitempty"`
+	From int    `json:"from,omitempty"`
+	To   int    `json:"to,omitempty"`
+	Save bool   `json:"save,omitempty"`
+}
+
+// ruleReply is the reply of the profile and forwarder ctl commands.
+type ruleReply struct {
+	Rules []string `json:"rules"`
+	Saved bool     `json:"saved,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// ruleManager applies the profile and forwarder rule changes requested through
+// the control socket to the running daemon. Rules are atomically swapped so
+// in-flight queries, the cache and upstream connections are not affected.
+type ruleManager struct {
+	conf     *config.Config
+	profiles *config.ProfileSelector
+	fwd      *config.ForwarderTable
+
+	mu     sync.Mutex
+	ctx    context.Context
+	groups map[*resolver.Group]context.CancelFunc
+}
+
+// Run runs the health checks of the forwarder groups, including the ones added
+// at runtime, until ctx is done.
+func (m *ruleManager) Run(ctx context.Context) {
+	m.mu.Lock()
+	m.ctx = ctx
+	m.groups = map[*resolver.Group]context.CancelFunc{}
+	m.runGroupsLocked()
+	m.mu.Unlock()
+	<-ctx.Done()
+	m.mu.Lock()
+	m.ctx = nil
+	m.mu.Unlock()
+}
+
+// runGroupsLocked starts health checks for new groups and stops them for the
+// removed ones.
+func (m *ruleManager) runGroupsLocked() {
+	if m.ctx == nil {
+		return
+	}
+	active := map[*resolver.Group]bool{}
+	for _, r := range m.fwd.Forwarders() {
+		g, ok := r.Resolver.(*resolver.Group)
+		if !ok {
+			continue
+		}
+		active[g] = true
+		if m.groups[g] == nil {
+			ctx, cancel := context.WithCancel(m.ctx)
+			m.groups[g] = cancel
+			go g.Run(ctx)
+		}
+	}
+	for g, cancel := range m.groups {
+		if !active[g] {
+			cancel()
+			delete(m.groups, g)
+		}
+	}
+}
+
+// SetForwarders replaces the forwarder rules, like on configuration reload.
+func (m *ruleManager) SetForwarders(f config.Forwarders) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fwd.SetForwarders(f); err != nil {
+		return err
+	}
+	m.runGroupsLocked()
+	return nil
+}
+
+// Profile handles the profile ctl command.
+func (m *ruleManager) Profile(data interface{}) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ps := m.profiles.Profiles()
+	req, err := parseRuleRequest(data)
+	if err == nil {
+		switch req.Op {
+		case "list":
+		case "add":
+			ps, err = ps.Insert(req.To, req.Rule)
+		case "remove":
+			ps, err = ps.Remove(req.From)
+		case "move":
+			ps, err = ps.Move(req.From, req.To)
+		default:
+			err = fmt.Errorf("%s: unsupported operation", req.Op)
+		}
+	}
+	if err == nil && req.Op != "list" {
+		m.profiles.SetProfiles(ps)
+	}
+	if err != nil {
+		ps = m.profiles.Profiles()
+	}
+	return m.reply(req, ps.Strings(), err)
+}
+
+// Forwarder handles the forwarder ctl command.
+func (m *ruleManager) Forwarder(data interface{}) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.fwd.Forwarders()
+	req, err := parseRuleRequest(data)
+	if err == nil {
+		switch req.Op {
+		case "list":
+		case "add":
+			f, err = f.Insert(req.To, req.Rule)
+		case "remove":
+			f, err = f.Remove(req.From)
+		case "move":
+			f, err = f.Move(req.From, req.To)
+		default:
+			err = fmt.Errorf("%s: unsupported operation", req.Op)
+		}
+	}
+	if err == nil && req.Op != "list" {
+		if err = m.fwd.SetForwarders(f); err == nil {
+			m.runGroupsLocked()
+		}
+	}
+	if err != nil {
+		f = m.fwd.Forwarders()
+	}
+	return m.reply(req, f.Strings(), err)
+}
+
+func (m *ruleManager) reply(req ruleRequest, rules []string, err error) ruleReply {
+	r := ruleReply{Rules: rules}
+	if rules == nil {
+		r.Rules = []string{}
+	}
+	if err == nil && req.Save {
+		ps, f := m.profiles.Profiles(), m.fwd.Forwarders()
+		if err = m.conf.SaveRules(ps, f); err == nil {
+			r.Saved = true
+		}
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func parseRuleRequest(data interface{}) (req ruleRequest, err error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return req, err
+	}
+	if err = json.Unmarshal(b, &req); err != nil {
+		return req, err
+	}
+	if req.Op == "" {
+		req.Op = "list"
+	}
+	return req, nil
+}
+
+// ruleCmd implements the profile and forwarder commands, managing the rules
+// of the running daemon through the control socket.
+func ruleCmd(args []string) error {
+	cmd := args[0]
+	usage := errors.New("usage: \n" +
+		"  " + cmd + " list                        list rules with their position\n" +
+		"  " + cmd + " add [-save] [-at N] RULE    add a rule, at position N or last\n" +
+		"  " + cmd + " remove [-save] N            remove the rule at position N\n" +
+		"  " + cmd + " move [-save] N M            move the rule at position N to M\n" +
+		"\n" +
+		"Positions start at 1. With -save, the rules are also persisted to the\n" +
+		"configuration.")
+	req := ruleRequest{Op: "list"}
+	if len(args) > 1 {
+		req.Op = args[1]
+		args = args[2:]
+	} else {
+		args = nil
+	}
+	fs := flag.NewFlagSet(cmd+" "+req.Op, flag.ExitOnError)
+	control := fs.String("control", config.DefaultControl, "Address to the control socket")
+	fs.BoolVar(&req.Save, "save", false, "Persist the rules to the configuration")
+	at := fs.Int("at", 0, "Position of the added rule")
+	_ = fs.Parse(args)
+	pos := func(s string) (int, error) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("%s: invalid position", s)
+		}
+		return n - 1, nil
+	}
+	var err error
+	switch req.Op {
+	case "list":
+	case "add":
+		if fs.NArg() != 1 {
+			return usage
+		}
+		req.Rule = fs.Arg(0)
+		req.To = *at - 1
+	case "remove":
+		if fs.NArg() != 1 {
+			return usage
+		}
+		req.From, err = pos(fs.Arg(0))
+	case "move":
+		if fs.NArg() != 2 {
+			return usage
+		}
+		if req.From, err = pos(fs.Arg(0)); err == nil {
+			req.To, err = pos(fs.Arg(1))
+		}
+	default:
+		return usage
+	}
+	if err != nil {
+		return err
+	}
+
+	cl, err := ctl.Dial(*control)
+	if err != nil {
+		if os.Geteuid() != 0 {
+			return syscall.Exec("/usr/bin/sudo", append([]string{"sudo", os.Args[0]}, os.Args[1:]...), os.Environ())
+		}
+		return err
+	}
+	defer cl.Close()
+	data, err := cl.Send(ctl.Event{Name: cmd, Data: req})
+	if err != nil {
+		return err
+	}
+	var reply ruleReply
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &reply); err != nil {
+		return err
+	}
+	for i, r := range reply.Rules {
+		fmt.Printf("%d: %s\n", i+1, r)
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	if reply.Saved {
+		fmt.Println("Configuration saved.")
+	}
+	return nil
+}
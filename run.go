@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,9 +22,9 @@ import (
 	lru "github.com/hashicorp/golang-lru"
 
 	"github.com/nextdns/nextdns/arp"
+	"github.com/nextdns/nextdns/captive"
 	"github.com/nextdns/nextdns/config"
 	"github.com/nextdns/nextdns/ctl"
-	"github.com/nextdns/nextdns/discovery"
 	"github.com/nextdns/nextdns/host"
 	"github.com/nextdns/nextdns/host/service"
 	"github.com/nextdns/nextdns/hosts"
@@ -51,6 +54,9 @@ type proxySvc struct {
 
 	// OnStopped is called once the daemon is full stopped.
 	OnStopped []func()
+
+	// reloader applies configuration changes on Reload.
+	reloader *reloader
 }
 
 func (p *proxySvc) Start() (err error) {
@@ -115,8 +121,18 @@ func (p *proxySvc) start() (err error) {
 }
 
 func (p *proxySvc) Restart() error {
-	p.log.Infof("Restarting NextDNS %s/%s on %s", version, platform, strings.Join(p.Addrs, ", "))
+	return p.restartWith(nil)
+}
+
+// restartWith restarts the proxy, calling update once stopped. The proxy
+// settings must only be changed by update, as they are read by the listeners
+// while running.
+func (p *proxySvc) restartWith(update func()) error {
 	_ = p.stop()
+	if update != nil {
+		update()
+	}
+	p.log.Infof("Restarting NextDNS %s/%s on %s", version, platform, strings.Join(p.Addrs, ", "))
 	return p.start()
 }
 
@@ -145,6 +161,24 @@ func (p *proxySvc) stop() bool {
 	return true
 }
 
+// Reload implements service.Reloader interface.
+func (p *proxySvc) Reload() error {
+	if p.reloader == nil {
+		return errors.New("reload not supported")
+	}
+	if res := p.reloader.Reload(); res.Error != "" {
+		return errors.New(res.Error)
+	}
+	return nil
+}
+
+// Running returns true while the proxy is started.
+func (p *proxySvc) Running() bool {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	return p.stopFunc != nil
+}
+
 func (p *proxySvc) Log(msg string) {
 	p.log.Info(msg)
 }
@@ -156,15 +190,28 @@ func run(args []string) error {
 	// When running interactive, ignore config file unless explicitly specified.
 	useStorage := service.CurrentRunMode() == service.RunModeService
 	c.Parse("nextdns "+cmd, args, useStorage)
+	// Keep the configuration as parsed, before being altered by the router
+	// setup, to diff it on reload.
+	loaded := c
 
-	log, err := host.NewLogger("nextdns")
-	if err != nil {
+	var log host.Logger
+	var err error
+	if c.Container {
+		log = host.NewConsoleLogger("nextdns")
+	} else if log, err = host.NewLogger("nextdns"); err != nil {
 		log = host.NewConsoleLogger("nextdns")
 		log.Warningf("Service logger error (switching to console): %v", err)
 	}
 	p := &proxySvc{
 		log: log,
 	}
+	if c.Container && (c.SetupRouter || c.AutoActivate) {
+		log.Warning("setup-router and auto-activate are ignored in container mode")
+		c.SetupRouter, c.AutoActivate = false, false
+	}
+	if (c.HijackDNS || c.BlockEncryptedDNS) && !c.SetupRouter {
+		log.Warning("hijack-dns and block-encrypted-dns are ignored without setup-router")
+	}
 
 	ctl := ctl.Server{
 		Addr: c.Control,
@@ -212,6 +259,11 @@ func run(args []string) error {
 
 	if c.SetupRouter {
 		r := router.New()
+		if restored, err := router.Recover(r); err != nil {
+			log.Errorf("Restoring %s router settings left by a previous run: %v", r, err)
+		} else if restored {
+			log.Warningf("Restored %s router settings left by a previous run", r)
+		}
 		if err := r.Configure(&c); err != nil {
 			log.Errorf("Configuring %s router: %v", r, err)
 		}
@@ -229,40 +281,134 @@ func run(args []string) error {
 		})
 	}
 
-	if c.AutoActivate {
-		p.OnStarted = append(p.OnStarted, func() {
+	// The guard re-applies the configuration when resolv.conf gets
+	// overwritten, by a DHCP client for instance. It runs whenever the system
+	// is activated, by auto-activate or by a previous "nextdns activate".
+	guard := &host.DNSGuard{
+		OnRepair: func(err error) {
+			if err != nil {
+				log.Errorf("System DNS configuration changed, re-activate: %v", err)
+				return
+			}
+			log.Warning("System DNS configuration changed, re-activated")
+		},
+	}
+	var stopGuard func()
+	ctl.Command("dns-guard", func(data interface{}) interface{} {
+		return guard.State()
+	})
+	p.OnStarted = append(p.OnStarted, func() {
+		if c.AutoActivate {
 			log.Info("Activating")
 			if err := activate(c); err != nil {
 				log.Errorf("Activate: %v", err)
+				return
 			}
-		})
-		p.OnStopped = append(p.OnStopped, func() {
+		}
+		ip, err := activateIP(c)
+		if err != nil {
+			return
+		}
+		guard.DNS = ip
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		stopGuard = func() {
+			cancel()
+			<-done
+		}
+		go func() {
+			defer close(done)
+			if err := guard.Run(ctx); err != nil && !errors.Is(err, host.ErrDNSGuardNotSupported) {
+				log.Errorf("DNS guard: %v", err)
+			}
+		}()
+	})
+	p.OnStopped = append(p.OnStopped, func() {
+		if stopGuard != nil {
+			stopGuard()
+			stopGuard = nil
+		}
+		if c.AutoActivate {
 			log.Info("Deactivating")
 			if err := deactivate(); err != nil {
 				log.Errorf("Deactivate: %v", err)
 			}
-		})
+		}
+	})
+
+	if err := setupEgress(c); err != nil {
+		return err
 	}
 
+	fallback, err := fallbackProvider(c.Fallback)
+	if err != nil {
+		return err
+	}
 	startup := time.Now()
+	portal := &captive.Detector{
+		Servers: host.DNS,
+	}
+	ctl.Command("captive-status", func(data interface{}) interface{} {
+		return portal.Status()
+	})
 	p.resolver = &resolver.DNS{
 		DOH: resolver.DOH{
 			ExtraHeaders: http.Header{
 				"User-Agent": []string{fmt.Sprintf("nextdns-cli/%s (%s; %s; %s)", version, platform, runtime.GOARCH, host.InitType())},
 			},
 		},
-		Manager: nextdnsEndpointManager(log, c.Debug, func() bool {
+		Manager: nextdnsEndpointManager(log, c.Debug, fallback, func() bool {
 			// Backward compat: the captive portal is now somewhat always enabled,
 			// but for those who enabled it in the past, disable the delay after which
 			// the fallback is disabled.
 			if c.DetectCaptivePortals {
 				return true
 			}
-			// Allow fallback to plain DNS for 10 minute after startup or after
-			// a change of network configuration.
+			// Allow fallback to plain DNS while a captive portal is detected
+			// so the user can log in.
+			if portal.Detected() {
+				return true
+			}
+			// Allow fallback to plain DNS for 10 minute after startup so
+			// routers can sync their clock.
 			return time.Since(startup) < 10*time.Minute
 		}),
 	}
+	if c.FallbackStrict {
+		p.resolver.AllowPlainDNS = fallbackAllowList(c.FallbackDomains)
+	}
+	if c.TolerateClockSkew {
+		p.resolver.Manager.ClockSkew = &endpoint.ClockSkew{
+			OnChange: func(offset time.Duration) {
+				if offset == 0 {
+					log.Info("System clock is valid, discarding clock skew correction")
+					return
+				}
+				log.Warningf("Clock skew detected: %v, validating certificates against server time", offset)
+			},
+		}
+	}
+
+	if c.UpstreamTLS != "" {
+		tlsOpts, err := endpoint.ParseTLSOptions(c.UpstreamTLS)
+		if err != nil {
+			return fmt.Errorf("upstream-tls: %v", err)
+		}
+		p.resolver.Manager.TLS = tlsOpts
+	}
+	blockPrivateRelay, err := config.ParsePrivateRelay(c.PrivateRelay)
+	if err != nil {
+		return fmt.Errorf("private-relay: %v", err)
+	}
+	p.resolver.Manager.Keepalive = c.Keepalive
+	if c.Prewarm > 0 {
+		p.OnInit = append(p.OnInit, func(ctx context.Context) {
+			p.resolver.Manager.KeepWarm(ctx, c.Prewarm)
+		})
+	}
+	ctl.Command("connect-stats", func(data interface{}) interface{} {
+		return p.resolver.Manager.ConnectStats()
+	})
 
 	cacheSize, err := config.ParseBytes(c.CacheSize)
 	if err != nil {
@@ -294,96 +440,125 @@ func run(args []string) error {
 	p.resolver.DNS53.MaxTTL = maxTTL
 	p.resolver.DOH.MaxTTL = maxTTL
 
-	if len(c.Profile) == 0 || (len(c.Profile) == 1 && c.Profile.Get(nil, nil, nil) != "") {
-		// Optimize for no dynamic configuration.
-		profile := c.Profile.Get(nil, nil, nil)
-		profileURL := "https://dns.nextdns.io/" + profile
-		p.resolver.DOH.GetProfileURL = func(q query.Query) (url, profile string) {
-			return profileURL, profile
-		}
-	} else {
-		p.resolver.DOH.GetProfileURL = func(q query.Query) (url, profile string) {
-			profile = c.Profile.Get(q.PeerIP, q.LocalIP, q.MAC)
-			return "https://dns.nextdns.io/" + profile, profile
-		}
+	// Profiles can be changed at runtime with the profile ctl command, the
+	// selector has a fast path for a single unconditional profile.
+	profiles := config.NewProfileSelector(c.Profile)
+	p.resolver.DOH.GetProfileURL = func(q query.Query) (url, profile string) {
+		profile = profiles.Get(q)
+		return "https://dns.nextdns.io/" + profile, profile
 	}
 
+	var logQueries atomic.Bool
+	logQueries.Store(c.LogQueries)
 	p.Proxy = proxy.Proxy{
 		Addrs:               c.Listens,
 		Upstream:            p.resolver,
-		BogusPriv:           c.BogusPriv,
+		BogusPriv:           &atomic.Bool{},
+		DoHCanary:           c.DoHCanary,
+		BlockPrivateRelay:   blockPrivateRelay,
 		Timeout:             c.Timeout,
 		MaxInflightRequests: c.MaxInflightRequests,
 	}
-
-	discoverHosts := &discovery.Hosts{OnError: func(err error) { log.Errorf("hosts: %v", err) }}
-	if c.UseHosts {
-		p.Proxy.LocalResolver = discovery.Resolver{discoverHosts}
-	}
-	localhostMode := isLocalhostMode(&c)
-	if c.ReportClientInfo {
-		// Only enable discovery if configured to listen to requests outside
-		// the local host or if setup router is on.
-		enableDiscovery := !localhostMode
-		var r discovery.Resolver
-		if enableDiscovery {
-			discoverDHCP := &discovery.DHCP{OnError: func(err error) { log.Errorf("dhcp: %v", err) }}
-			discoverDNS := &discovery.DNS{Upstream: c.DiscoveryDNS}
-			var discoverMDNS discovery.Source = discovery.Dummy{}
-			if c.MDNS != "disabled" {
-				mdns := &discovery.MDNS{OnError: func(err error) { log.Errorf("mdns: %v", err) }}
-				discoverMDNS = mdns
-				p.OnInit = append(p.OnInit, func(ctx context.Context) {
-					log.Info("Starting mDNS discovery")
-					if err := mdns.Start(ctx, c.MDNS); err != nil {
-						log.Errorf("Cannot start mDNS: %v", err)
-					}
-				})
-			}
-			discoveryResolver := discovery.Resolver{discoverMDNS, discoverDHCP}
-			if c.DiscoveryDNS != "" {
-				// Only include discovery DNS as discovery resolver if
-				// explicitly specified as auto-discovered DNS discovery can
-				// create loops.
-				discoveryResolver = append(discovery.Resolver{discoverDNS}, discoveryResolver...)
+	p.Proxy.BogusPriv.Store(c.BogusPriv)
+	if c.SetupRouter && c.HijackDNS {
+		p.Proxy.OriginalDst = logQueries.Load
+	}
+
+	clients := newClientDiscovery(log)
+	clients.Configure(c)
+	p.Proxy.LocalResolver = clients.local
+	p.Proxy.DiscoveryResolver = clients.lookup
+	p.OnInit = append(p.OnInit, clients.Run)
+	profiles.Names = clients
+	setupClientReporting(p, profiles, clients)
+	ctl.Command("discovered", func(data interface{}) interface{} {
+		d := map[string]map[string][]string{}
+		clients.Visit(func(source, name string, addrs []string) {
+			if d[source] == nil {
+				d[source] = map[string][]string{}
 			}
-			p.Proxy.DiscoveryResolver = discoveryResolver
-			r = discovery.Resolver{
-				discoverHosts,
-				&discovery.Merlin{},
-				&discovery.Ubios{},
-				&discovery.Firewalla{},
-				discoverMDNS,
-				discoverDHCP,
-				discoverDNS,
-			}
-			ctl.Command("discovered", func(data interface{}) interface{} {
-				d := map[string]map[string][]string{}
-				r.Visit(func(source, name string, addrs []string) {
-					if d[source] == nil {
-						d[source] = map[string][]string{}
-					}
-					d[source][name] = addrs
-				})
-				return d
-			})
-		}
-		setupClientReporting(p, &c.Profile, r)
-	}
-	if p.Proxy.DiscoveryResolver == nil && c.DiscoveryDNS != "" {
-		p.Proxy.DiscoveryResolver = &discovery.DNS{Upstream: c.DiscoveryDNS}
+			d[source][name] = addrs
+		})
+		return d
+	})
+	if !clients.Enabled() && c.Profile.HasNameConditions() {
+		log.Warning("Profile name conditions require client discovery (-report-client-info on a LAN listener)")
 	}
 
-	if len(c.Forwarders) > 0 {
-		// Append default doh server at the end of the forwarder list as a catch all.
-		fwd := make(config.Forwarders, 0, len(c.Forwarders)+1)
-		fwd = append(fwd, c.Forwarders...)
-		fwd = append(fwd, config.Resolver{Resolver: p.resolver})
-		p.Upstream = &fwd
+	// Use the default doh server as a catch all. The table is always setup so
+	// forwarders can be added at runtime with the forwarder ctl command.
+	fwd, err := config.NewForwarderTable(c.Forwarders, p.resolver)
+	if err != nil {
+		return fmt.Errorf("forwarder: %v", err)
 	}
+	for _, conflict := range config.OrderConflicts(c.Forwarders) {
+		log.Warningf("Forwarder: %s", conflict)
+	}
+	fwd.OnReload = func(rules int, err error) {
+		if err != nil {
+			log.Errorf("Forwarder list reload: %v", err)
+			return
+		}
+		log.Infof("Forwarder lists reloaded: %d rules", rules)
+	}
+	p.Upstream = fwd
+	p.OnInit = append(p.OnInit, func(ctx context.Context) {
+		fwd.Watch(ctx, 0)
+	})
+	if c.SplitDNS {
+		split := &splitDNS{table: fwd, log: log}
+		p.OnInit = append(p.OnInit, split.Run)
+		ctl.Command("split-dns", func(data interface{}) interface{} {
+			return split.Status()
+		})
+	}
+	rules := &ruleManager{conf: &c, profiles: profiles, fwd: fwd}
+	p.OnInit = append(p.OnInit, rules.Run)
+	ctl.Command("profile", rules.Profile)
+	ctl.Command("forwarder", rules.Forwarder)
+
+	p.reloader = &reloader{
+		p:          p,
+		log:        log,
+		cmd:        cmd,
+		args:       args,
+		useStorage: useStorage,
+		profiles:   profiles,
+		rules:      rules,
+		logQueries: &logQueries,
+		clients:    clients,
+		conf:       loaded,
+	}
+	ctl.Command("reload", func(data interface{}) interface{} {
+		return p.reloader.Reload().String()
+	})
+	ctl.Command("config", func(data interface{}) interface{} {
+		c := p.reloader.Config()
+		return c.Export()
+	})
+	ctl.Command("forwarders", func(data interface{}) interface{} {
+		type forwarderStatus struct {
+			Rule      string                  `json:"rule"`
+			Dynamic   bool                    `json:"dynamic,omitempty"`
+			Strategy  string                  `json:"strategy,omitempty"`
+			Endpoints []resolver.MemberStatus `json:"endpoints,omitempty"`
+		}
+		st := []forwarderStatus{}
+		rules := fwd.Forwarders()
+		dynamic := fwd.Dynamic()
+		for i, r := range append(rules[:len(rules):len(rules)], dynamic...) {
+			fs := forwarderStatus{Rule: r.String(), Dynamic: i >= len(rules)}
+			if g, ok := r.Resolver.(*resolver.Group); ok {
+				fs.Strategy = g.Strategy.String()
+				fs.Endpoints = g.Status()
+			}
+			st = append(st, fs)
+		}
+		return st
+	})
 
 	p.QueryLog = func(q proxy.QueryInfo) {
-		if !c.LogQueries && q.Error == nil {
+		if !logQueries.Load() && q.Error == nil {
 			return
 		}
 		var errStr string
@@ -401,8 +576,12 @@ func run(args []string) error {
 		if profile == "" {
 			profile = "none"
 		}
+		peer := q.PeerIP.String()
+		if q.DestIP != nil {
+			peer += "->" + q.DestIP.String()
+		}
 		log.Infof("Query %s %s %s %s %s (qry=%d/res=%d) %s %s%s",
-			q.PeerIP.String(),
+			peer,
 			q.Protocol,
 			q.Type,
 			q.Name,
@@ -419,18 +598,37 @@ func run(args []string) error {
 	p.ErrorLog = func(err error) {
 		log.Error(err)
 	}
-	if localhostMode {
+	if isLocalhostMode(&c) {
 		// If only listening on localhost, we may be running on a laptop or
 		// other sort of device that might change network from time to time.
 		// When such change is detected, it better to trigger a re-negotiation
-		// of the best endpoint sooner than later. We also reset the startup
-		// time so plain DNS fallback happen again (useful for captive portals).
+		// of the best endpoint sooner than later. We also check for captive
+		// portals so plain DNS fallback is allowed while the portal is
+		// present.
+		portal.OnChange = func(s captive.Status) {
+			switch s.State {
+			case captive.StateDetected:
+				log.Infof("Captive portal detected on %s (location: %s), enabling fallback", s.URL, s.Location)
+			case captive.StateNone:
+				log.Info("No captive portal detected")
+			case captive.StateOffline:
+				log.Infof("Captive portal detection: offline: %s", s.Error)
+			}
+			// Re-negotiate the endpoint so we fallback while the portal is
+			// detected and go back to DoH as soon as it is cleared.
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := p.resolver.Manager.Test(ctx); err != nil {
+				log.Errorf("Test after captive portal change failed: %v", err)
+			}
+		}
+		p.OnInit = append(p.OnInit, portal.Run)
 		p.OnInit = append(p.OnInit, func(ctx context.Context) {
 			netChange := make(chan netstatus.Change)
 			netstatus.Notify(netChange)
 			for c := range netChange {
 				log.Infof("Network change detected: %s", c)
-				startup = time.Now() // reset the startup marker so DNS fallback can happen again.
+				portal.Trigger()
 				if err := p.resolver.Manager.Test(ctx); err != nil {
 					log.Errorf("Test after network change failed: %v", err)
 				}
@@ -438,7 +636,16 @@ func run(args []string) error {
 		})
 	}
 
-	if err = service.Run("nextdns", p); err != nil {
+	if c.HealthAddr != "" {
+		go serveHealth(c.HealthAddr, p)
+	}
+
+	if c.Container {
+		err = service.RunForeground(p)
+	} else {
+		err = service.Run("nextdns", p)
+	}
+	if err != nil {
 		log.Errorf("Startup failed: %v", err)
 		return err
 	}
@@ -471,16 +678,52 @@ func isLocalhostMode(c *config.Config) bool {
 	return true
 }
 
+// setupEgress applies the upstream connection settings.
+func setupEgress(c config.Config) error {
+	if c.UpstreamInterface == "" && c.UpstreamSource == "" && c.UpstreamMark == 0 && c.UpstreamProxy == "" {
+		return nil
+	}
+	e := &endpoint.Egress{
+		Interface: c.UpstreamInterface,
+		Mark:      int(c.UpstreamMark),
+	}
+	if c.UpstreamSource != "" {
+		if e.Source = net.ParseIP(c.UpstreamSource); e.Source == nil {
+			return fmt.Errorf("upstream-source: %s: invalid IP address", c.UpstreamSource)
+		}
+	}
+	if c.UpstreamProxy != "" {
+		u, err := url.Parse(c.UpstreamProxy)
+		if err != nil {
+			return fmt.Errorf("upstream-proxy: %v", err)
+		}
+		e.Proxy = u
+	}
+	if err := endpoint.SetEgress(e); err != nil {
+		return fmt.Errorf("upstream: %v", err)
+	}
+	return nil
+}
+
 // nextdnsEndpointManager returns a endpoint.Manager configured to connect to
 // NextDNS using different steering techniques.
-func nextdnsEndpointManager(log host.Logger, debug bool, canFallback func() bool) *endpoint.Manager {
+func nextdnsEndpointManager(log host.Logger, debug bool, fallback endpoint.Provider, canFallback func() bool) *endpoint.Manager {
+	unicast := &endpoint.PersistentProvider{
+		Provider: &endpoint.SourceHTTPSSVCProvider{
+			Hostname: "dns.nextdns.io",
+			Source:   endpoint.MustNew("https://dns.nextdns.io#45.90.28.0,2a07:a8c0::,45.90.30.0,2a07:a8c1::"),
+		},
+		File:   filepath.Join(host.StateDir(), "endpoints.json"),
+		MaxAge: 7 * 24 * time.Hour,
+		OnError: func(err error) {
+			log.Warningf("Endpoint discovery: %v", err)
+		},
+	}
 	m := &endpoint.Manager{
 		Providers: []endpoint.Provider{
-			// Prefer unicast routing.
-			&endpoint.SourceHTTPSSVCProvider{
-				Hostname: "dns.nextdns.io",
-				Source:   endpoint.MustNew("https://dns.nextdns.io#45.90.28.0,2a07:a8c0::,45.90.30.0,2a07:a8c1::"),
-			},
+			// Prefer unicast routing, using the last discovered endpoints
+			// first while refreshing them in the background.
+			unicast,
 			// Try routing without anycast bootstrap.
 			// TOFIX: this creates circular dependency if the /etc/resolv.conf is setup to localhost.
 			// &endpoint.SourceHTTPSSVCProvider{
@@ -501,41 +744,42 @@ func nextdnsEndpointManager(log host.Logger, debug bool, canFallback func() bool
 			log.Warningf("Endpoint provider failed: %v: %v", p, err)
 		},
 		OnConnect: func(ci *endpoint.ConnectInfo) {
-			log.Infof("Connected %s (con=%dms tls=%dms, %s, %s)",
+			prewarm := ""
+			if ci.Prewarm {
+				prewarm = ", prewarm"
+			}
+			log.Infof("Connected %s (con=%dms tls=%dms, %s, %s%s)",
 				ci.ServerAddr,
 				ci.ConnectTimes[ci.ServerAddr]/time.Millisecond,
 				ci.TLSTime/time.Millisecond,
 				ci.Protocol,
-				ci.TLSVersion)
+				ci.TLSVersion,
+				prewarm)
 		},
 		OnChange: func(e endpoint.Endpoint) {
 			log.Infof("Switching endpoint: %s", e)
 		},
 	}
-	// Fallback on system DNS and set a short min test interval for when plain
-	// DNS protocol is used so we go back on safe DoH as soon as possible. This
-	// allows automatic handling of captive portals as well as NTP / DNS
-	// inter-dependency on some routers, when NTP needs DNS to sync the time,
-	// and DoH needs time properly set to establish a TLS session.
-	m.Providers = append(m.Providers, endpoint.ProviderFunc(func(ctx context.Context) ([]endpoint.Endpoint, error) {
-		if !canFallback() {
-			// Fallback disabled.
-			return nil, nil
-		}
-		ips := host.DNS()
-		endpoints := make([]endpoint.Endpoint, 0, len(ips)+1)
-		for _, ip := range ips {
-			endpoints = append(endpoints, &endpoint.DNSEndpoint{
-				Addr: net.JoinHostPort(ip, "53"),
-			})
-		}
-		// Add NextDNS anycast IP in case none of the system DNS works or we did
-		// not find any.
-		endpoints = append(endpoints, &endpoint.DNSEndpoint{
-			Addr: "45.90.28.0:53",
-		})
-		return endpoints, nil
-	}))
+	// Fallback on system DNS (or user defined servers) and set a short min
+	// test interval for when plain DNS protocol is used so we go back on safe
+	// DoH as soon as possible. This allows automatic handling of captive
+	// portals as well as NTP / DNS inter-dependency on some routers, when NTP
+	// needs DNS to sync the time, and DoH needs time properly set to establish
+	// a TLS session.
+	if fallback != nil {
+		m.Providers = append(m.Providers, endpoint.ProviderFunc(func(ctx context.Context) ([]endpoint.Endpoint, error) {
+			if !canFallback() {
+				// Fallback disabled.
+				return nil, nil
+			}
+			return fallback.GetEndpoints(ctx)
+		}))
+	}
+	if endpoints := unicast.Endpoints(); len(endpoints) > 0 {
+		// Start with the last known unicast endpoint so queries right after
+		// startup do not have to go through anycast.
+		m.InitEndpoint = endpoints[0]
+	}
 	m.EndpointTester = func(e endpoint.Endpoint) endpoint.Tester {
 		if e.Protocol() == endpoint.ProtocolDNS {
 			// Return a tester than never fail so we are always selected as
@@ -560,7 +804,7 @@ func nextdnsEndpointManager(log host.Logger, debug bool, canFallback func() bool
 	return m
 }
 
-func setupClientReporting(p *proxySvc, conf *config.Profiles, r discovery.Resolver) {
+func setupClientReporting(p *proxySvc, conf *config.ProfileSelector, r *clientDiscovery) {
 	deviceName, _ := host.Name()
 	deviceID, _ := machineid.ProtectedID("NextDNS")
 	deviceModel := host.Model()
@@ -571,13 +815,16 @@ func setupClientReporting(p *proxySvc, conf *config.Profiles, r discovery.Resolv
 	deviceID = strings.ToUpper(deviceID)
 
 	p.resolver.DOH.ClientInfo = func(q query.Query) (ci resolver.ClientInfo) {
+		if !r.ReportClientInfo() {
+			return
+		}
 		if !q.PeerIP.IsLoopback() {
 			// When acting as router, try to guess as much info as possible from
 			// LAN client.
 			ci.IP = q.PeerIP.String()
 			ci.Name = normalizeName(r.LookupAddr(q.PeerIP.String()))
 			if q.MAC != nil {
-				ci.ID = shortID(conf.Get(q.PeerIP, q.LocalIP, q.MAC), q.MAC)
+				ci.ID = shortID(conf.Get(q), q.MAC)
 				hex := q.MAC.String()
 				if len(hex) >= 8 {
 					// Only send the manufacturer part of the MAC.
@@ -588,7 +835,7 @@ func setupClientReporting(p *proxySvc, conf *config.Profiles, r discovery.Resolv
 				}
 			}
 			if ci.ID == "" {
-				ci.ID = shortID(conf.Get(q.PeerIP, q.LocalIP, q.MAC), q.PeerIP)
+				ci.ID = shortID(conf.Get(q), q.PeerIP)
 			}
 			return
 		}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nextdns/nextdns/config"
+	"github.com/nextdns/nextdns/host"
+	"github.com/nextdns/nextdns/netstatus"
+)
+
+// splitDNS installs forwarders for the domains learned from the host network
+// configuration, typically pushed by a VPN or DHCP, so those domains keep
+// being resolved by the servers of the network they belong to.
+type splitDNS struct {
+	table *config.ForwarderTable
+	log   host.Logger
+
+	// interfacesDNS returns the host DNS configuration, host.InterfacesDNS if
+	// nil.
+	interfacesDNS func() []host.InterfaceDNS
+
+	mu    sync.Mutex
+	state []host.InterfaceDNS
+	rules []string
+}
+
+// Run updates the forwarders on start, on network changes and every minute
+// until ctx is done.
+func (s *splitDNS) Run(ctx context.Context) {
+	s.update()
+	netChange := make(chan netstatus.Change, 1)
+	netstatus.Notify(netChange)
+	defer netstatus.Stop(netChange)
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-netChange:
+		case <-tick.C:
+		}
+		s.update()
+	}
+}
+
+// Status returns the DNS configuration learned per interface.
+func (s *splitDNS) Status() []host.InterfaceDNS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *splitDNS) update() {
+	get := s.interfacesDNS
+	if get == nil {
+		get = host.InterfacesDNS
+	}
+	state := filterInterfacesDNS(get(), localIPs())
+	rules := splitDNSRules(state)
+
+	s.mu.Lock()
+	s.state = state
+	changed := strings.Join(rules, " ") != strings.Join(s.rules, " ")
+	s.rules = rules
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+	var f config.Forwarders
+	for _, rule := range rules {
+		if err := f.Set(rule); err != nil {
+			s.log.Warningf("Split DNS: %s: %v", rule, err)
+		}
+	}
+	if err := s.table.SetDynamic(f); err != nil {
+		s.log.Errorf("Split DNS: %v", err)
+		return
+	}
+	if len(rules) == 0 {
+		s.log.Info("Split DNS: no domain learned")
+		return
+	}
+	s.log.Infof("Split DNS: %s", strings.Join(rules, ", "))
+}
+
+// filterInterfacesDNS removes the servers pointing to the host itself, which
+// could be us, and the domains that can't be forwarded.
+func filterInterfacesDNS(in []host.InterfaceDNS, local map[string]bool) []host.InterfaceDNS {
+	out := []host.InterfaceDNS{}
+	for _, i := range in {
+		var servers, domains []string
+		for _, srv := range i.Servers {
+			ip := net.ParseIP(srv)
+			if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || local[ip.String()] {
+				continue
+			}
+			servers = append(servers, ip.String())
+		}
+		for _, d := range i.Domains {
+			// systemd uses ~ for routing only domains and ~. for the default
+			// route.
+			d = strings.TrimSuffix(strings.TrimPrefix(d, "~"), ".")
+			if d == "" {
+				continue
+			}
+			domains = append(domains, strings.ToLower(d))
+		}
+		if len(servers) == 0 || len(domains) == 0 {
+			continue
+		}
+		i.Servers, i.Domains = servers, domains
+		out = append(out, i)
+	}
+	return out
+}
+
+// splitDNSRules returns the forwarder rules for state. When a domain is
+// learned from several interfaces, the first one wins.
+func splitDNSRules(state []host.InterfaceDNS) []string {
+	seen := map[string]bool{}
+	var rules []string
+	for _, i := range state {
+		for _, d := range i.Domains {
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+			rules = append(rules, fmt.Sprintf("%s=%s", d, strings.Join(i.Servers, ",")))
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// localIPs returns the IPs assigned to the host interfaces.
+func localIPs() map[string]bool {
+	ips := map[string]bool{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipn, ok := addr.(*net.IPNet); ok {
+			ips[ipn.IP.String()] = true
+		}
+	}
+	return ips
+}
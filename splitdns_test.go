@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nextdns/nextdns/host"
+)
+
+func TestSplitDNSRules(t *testing.T) {
+	in := []host.InterfaceDNS{
+		{Interface: "tun0", Servers: []string{"10.8.0.1", "10.8.0.2"}, Domains: []string{"corp.example", "~ad.corp.example"}},
+		{Interface: "wlan0", Servers: []string{"192.168.1.1"}, Domains: []string{"~.", "Home.Lan."}},
+		{Interface: "eth0", Servers: []string{"127.0.0.53"}, Domains: []string{"lan"}},
+		{Interface: "eth1", Servers: []string{"192.168.1.10"}, Domains: []string{"self.lan"}},
+		{Interface: "tun1", Servers: []string{"10.9.0.1"}, Domains: []string{"corp.example"}},
+	}
+	local := map[string]bool{"192.168.1.10": true}
+	got := splitDNSRules(filterInterfacesDNS(in, local))
+	want := []string{
+		"ad.corp.example=10.8.0.1,10.8.0.2",
+		"corp.example=10.8.0.1,10.8.0.2",
+		"home.lan=192.168.1.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitDNSRules() = %v, want %v", got, want)
+	}
+}